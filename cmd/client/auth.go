@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// httpClient is used for every request to the server. When an API key is
+// configured it is replaced by one that sends the key to that server.
+var httpClient = http.DefaultClient
+
+// bearerTransport adds an API key as a bearer token to outgoing requests
+// for the server it belongs to. Requests to any other host, including
+// redirects away from the server, are sent without it.
+type bearerTransport struct {
+	key    string
+	server *url.URL
+	base   http.RoundTripper
+}
+
+func (t bearerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != t.server.Scheme || req.URL.Host != t.server.Host {
+		return t.base.RoundTrip(req)
+	}
+
+	// RoundTrippers must not modify the caller's request.
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+t.key)
+
+	return t.base.RoundTrip(req)
+}
+
+// useAPIKey sends key with every request to server, the base URL of the
+// server the key was issued by.
+func useAPIKey(key, server string) {
+	if key == "" {
+		return
+	}
+
+	u, err := url.Parse(server)
+	if err != nil || u.Host == "" {
+		return
+	}
+
+	httpClient = &http.Client{Transport: bearerTransport{key: key, server: u, base: http.DefaultTransport}}
+}
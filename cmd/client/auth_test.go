@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAPIKeyOnlySentToItsServer(t *testing.T) {
+	saved := httpClient
+	t.Cleanup(func() { httpClient = saved })
+
+	got := make(map[string]string)
+	record := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got[name] = r.Header.Get("Authorization")
+		})
+	}
+
+	other := httptest.NewServer(record("other"))
+	defer other.Close()
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/", record("server"))
+	mux.HandleFunc("/away", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, other.URL+"/landed", http.StatusFound)
+	})
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	useAPIKey("secret", server.URL)
+
+	for _, target := range []string{server.URL + "/api/uploads/abc", server.URL + "/away"} {
+		res, err := httpClient.Get(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+
+	if got["server"] != "Bearer secret" {
+		t.Fatalf("expected the key to be sent to its server, got %q", got["server"])
+	}
+
+	if auth, ok := got["other"]; !ok || auth != "" {
+		t.Fatalf("expected the redirect to reach the other host without the key, got %q, %v", auth, ok)
+	}
+
+	res, err := httpClient.Get(other.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if got["other"] != "" {
+		t.Fatalf("expected no key to be sent to another host, got %q", got["other"])
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The config file holds default settings and named profiles that select
+// between servers. Settings before any [section] apply to every profile;
+// a profile's own settings override them. Keys are named after the flags
+// they provide defaults for:
+//
+//	server = https://beam.example.com
+//	expires = 24h
+//
+//	[staging]
+//	server = https://beam.staging.example.com
+//	api-key = 3q2+7wR9xN0vK1bT5mZc
+//
+// Environment variables override the file, and flags override both.
+
+// settings are the client defaults read from the config file and the
+// environment. Zero values are unset.
+type settings struct {
+	Profile string
+	Server  string
+	APIKey  string
+	Expires time.Duration
+	Workers int
+}
+
+// configEnv maps each setting to the environment variable overriding it.
+var configEnv = map[string]string{
+	"server":  "BEAM_SERVER",
+	"api-key": "BEAM_API_KEY",
+	"expires": "BEAM_EXPIRES",
+	"workers": "BEAM_WORKERS",
+}
+
+func configPath() (string, error) {
+	if path := os.Getenv("BEAM_CONFIG"); path != "" {
+		return path, nil
+	}
+
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "beam", "config"), nil
+}
+
+// loadSettings resolves the settings for a profile, or for $BEAM_PROFILE
+// when profile is empty. A missing config file is the same as an empty one.
+func loadSettings(profile string) (settings, error) {
+	if profile == "" {
+		profile = os.Getenv("BEAM_PROFILE")
+	}
+
+	s := settings{Profile: profile}
+
+	path, err := configPath()
+	if err != nil {
+		return s, err
+	}
+
+	sections, err := readConfig(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return s, err
+	}
+
+	if _, ok := sections[profile]; profile != "" && !ok {
+		return s, fmt.Errorf("no profile %q in %s", profile, path)
+	}
+
+	// Defaults first, then the profile, then the environment.
+	layers := []map[string]string{sections[""], sections[profile], make(map[string]string)}
+
+	for key, env := range configEnv {
+		if value, ok := os.LookupEnv(env); ok {
+			layers[2][key] = value
+		}
+	}
+
+	for _, layer := range layers {
+		for key, value := range layer {
+			if err := s.set(key, value); err != nil {
+				return s, err
+			}
+		}
+	}
+
+	return s, nil
+}
+
+func (s *settings) set(key, value string) error {
+	var err error
+
+	switch key {
+	case "server":
+		s.Server = strings.TrimSuffix(value, "/")
+	case "api-key":
+		s.APIKey = value
+	case "expires":
+		s.Expires, err = time.ParseDuration(value)
+	case "workers":
+		s.Workers, err = strconv.Atoi(value)
+	}
+
+	if err != nil {
+		return fmt.Errorf("invalid %s setting %q", key, value)
+	}
+
+	return nil
+}
+
+// readConfig parses the config file into its sections, keyed by profile
+// name with "" for the settings before the first section.
+func readConfig(path string) (map[string]map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sections := map[string]map[string]string{"": {}}
+	current := ""
+
+	scanner := bufio.NewScanner(f)
+
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		if name, ok := strings.CutPrefix(text, "["); ok {
+			name, ok = strings.CutSuffix(name, "]")
+			name = strings.TrimSpace(name)
+
+			if !ok || name == "" {
+				return nil, fmt.Errorf("%s:%d: expected [profile]", path, line)
+			}
+
+			if _, dup := sections[name]; dup {
+				return nil, fmt.Errorf("%s:%d: profile %s is defined twice", path, line, name)
+			}
+
+			sections[name] = make(map[string]string)
+			current = name
+			continue
+		}
+
+		key, value, ok := strings.Cut(text, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected key = value", path, line)
+		}
+
+		if _, known := configEnv[key]; !known {
+			return nil, fmt.Errorf("%s:%d: unknown setting %q", path, line, key)
+		}
+
+		sections[current][key] = value
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return sections, nil
+}
+
+// applySettings gives the flags in flags that were not on the command line
+// the values from s. It runs after parsing rather than setting the flags'
+// defaults, so flags win and -h never prints the key.
+func applySettings(flags *flag.FlagSet, s settings) {
+	values := map[string]string{
+		"server":  s.Server,
+		"api-key": s.APIKey,
+	}
+
+	if s.Expires > 0 {
+		values["expires"] = s.Expires.String()
+	}
+
+	if s.Workers > 0 {
+		values["workers"] = strconv.Itoa(s.Workers)
+	}
+
+	set := flagsSet(flags)
+
+	for name, value := range values {
+		if value != "" && !set[name] && flags.Lookup(name) != nil {
+			flags.Set(name, value)
+		}
+	}
+}
+
+// flagsSet returns the names of the flags given on the command line, whose
+// values take precedence over settings.
+func flagsSet(flags *flag.FlagSet) map[string]bool {
+	set := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	return set
+}
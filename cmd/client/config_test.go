@@ -0,0 +1,173 @@
+package main
+
+import (
+	"flag"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testConfig = `
+# defaults for every profile
+server = https://beam.example.com/
+expires = 24h
+
+[staging]
+server = https://beam.staging.example.com
+api-key = staging-key
+workers = 3
+`
+
+// clearConfigEnv points the client at config, with no BEAM_ variables set
+// for the rest of the test.
+func clearConfigEnv(t *testing.T, config string) {
+	t.Helper()
+
+	for _, env := range append(slices.Collect(maps.Values(configEnv)), "BEAM_PROFILE") {
+		t.Setenv(env, "")
+		os.Unsetenv(env)
+	}
+
+	path := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("BEAM_CONFIG", path)
+}
+
+func TestSettingsPrecedence(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile string
+		env     map[string]string
+		args    []string
+		want    settings
+	}{
+		{
+			name: "defaults",
+			want: settings{Server: "https://beam.example.com", Expires: 24 * time.Hour, Workers: 1},
+		},
+		{
+			name:    "profile over defaults",
+			profile: "staging",
+			want:    settings{Profile: "staging", Server: "https://beam.staging.example.com", APIKey: "staging-key", Expires: 24 * time.Hour, Workers: 3},
+		},
+		{
+			name: "profile from the environment",
+			env:  map[string]string{"BEAM_PROFILE": "staging"},
+			want: settings{Profile: "staging", Server: "https://beam.staging.example.com", APIKey: "staging-key", Expires: 24 * time.Hour, Workers: 3},
+		},
+		{
+			name:    "environment over profile",
+			profile: "staging",
+			env:     map[string]string{"BEAM_SERVER": "https://env.example.com", "BEAM_WORKERS": "5"},
+			want:    settings{Profile: "staging", Server: "https://env.example.com", APIKey: "staging-key", Expires: 24 * time.Hour, Workers: 5},
+		},
+		{
+			name:    "flags over environment",
+			profile: "staging",
+			env:     map[string]string{"BEAM_SERVER": "https://env.example.com", "BEAM_API_KEY": "env-key"},
+			args:    []string{"-server", "https://flag.example.com", "-api-key", "flag-key", "-expires", "1h", "-workers", "8"},
+			want:    settings{Profile: "staging", Server: "https://flag.example.com", APIKey: "flag-key", Expires: time.Hour, Workers: 8},
+		},
+		{
+			name: "flags set to their defaults still win",
+			env:  map[string]string{"BEAM_WORKERS": "5"},
+			args: []string{"-workers", "1"},
+			want: settings{Server: "https://beam.example.com", Expires: 24 * time.Hour, Workers: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearConfigEnv(t, testConfig)
+
+			for env, value := range tt.env {
+				t.Setenv(env, value)
+			}
+
+			s, err := loadSettings(tt.profile)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			flags := flag.NewFlagSet("beam", flag.ContinueOnError)
+			server := flags.String("server", "http://localhost:9001", "")
+			apiKey := flags.String("api-key", "", "")
+			expires := flags.Duration("expires", 0, "")
+			workers := flags.Int("workers", 1, "")
+
+			if err := flags.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+
+			applySettings(flags, s)
+
+			got := settings{Profile: s.Profile, Server: *server, APIKey: *apiKey, Expires: *expires, Workers: *workers}
+			if got != tt.want {
+				t.Fatalf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestLoadSettingsWithoutConfigFile(t *testing.T) {
+	clearConfigEnv(t, "")
+	t.Setenv("BEAM_CONFIG", filepath.Join(t.TempDir(), "missing"))
+
+	s, err := loadSettings("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s != (settings{}) {
+		t.Fatalf("expected no settings, got %+v", s)
+	}
+
+	if _, err := loadSettings("staging"); err == nil || !strings.Contains(err.Error(), `no profile "staging"`) {
+		t.Fatalf("expected an unknown profile to be an error, got %v", err)
+	}
+}
+
+func TestReadConfigRejectsMistakes(t *testing.T) {
+	tests := map[string]string{
+		"no equals":         "server https://beam.example.com",
+		"unknown setting":   "colour = blue",
+		"unclosed section":  "[staging",
+		"empty section":     "[ ]",
+		"duplicate profile": "[staging]\n[staging]",
+	}
+
+	for name, config := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config")
+			if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := readConfig(path); err == nil {
+				t.Fatalf("expected %q to be rejected", config)
+			}
+		})
+	}
+}
+
+func TestLoadSettingsRejectsInvalidValues(t *testing.T) {
+	clearConfigEnv(t, "expires = soon")
+
+	if _, err := loadSettings(""); err == nil {
+		t.Fatal("expected an invalid duration to be rejected")
+	}
+
+	clearConfigEnv(t, "")
+	t.Setenv("BEAM_WORKERS", "many")
+
+	if _, err := loadSettings(""); err == nil {
+		t.Fatal("expected an invalid worker count to be rejected")
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/elliota43/beam/internal/crypt"
+	"github.com/elliota43/beam/internal/upload"
+)
+
+// encryptFiles encrypts every file into dir and returns the files to send
+// in their place, named by their encrypted paths. Encrypting to disk first
+// lets encrypted files go through the resumable API like any other.
+func encryptFiles(files []upload.UploadFile, key crypt.Key, dir string) ([]upload.UploadFile, error) {
+	encrypted := make([]upload.UploadFile, len(files))
+
+	for i, file := range files {
+		target := filepath.Join(dir, strconv.Itoa(i))
+
+		if err := encryptFile(file.AbsolutePath, target, key); err != nil {
+			return nil, err
+		}
+
+		encrypted[i] = upload.UploadFile{
+			AbsolutePath: target,
+			RelativePath: crypt.EncryptName(key, file.RelativePath),
+		}
+	}
+
+	return encrypted, nil
+}
+
+func encryptFile(src, dst string, key crypt.Key) error {
+	in, err := openFile(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	if err := crypt.Encrypt(out, in, key); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elliota43/beam/internal/crypt"
+	"github.com/elliota43/beam/internal/upload"
+)
+
+// partSuffix marks a download in progress. Its bytes are kept when a
+// download fails so the next attempt can resume with a Range request.
+const partSuffix = ".part"
+
+// etagSuffix names the file beside a .part holding the ETag of the file its
+// bytes came from, so a download is only resumed while that is unchanged.
+const etagSuffix = ".etag"
+
+// getOptions are the settings shared by every file of a `beam get`.
+type getOptions struct {
+	Password string
+	Force    bool
+	// Key decrypts the files of an encrypted upload.
+	Key *crypt.Key
+	// Retries is how many times an interrupted download is resumed.
+	Retries int
+}
+
+// download is one file of an upload and where it is saved.
+type download struct {
+	file   fileResponse
+	name   string
+	target string
+}
+
+// runGet implements `beam get <url> [dest]`, downloading an upload, or a
+// single file when given a file's URL, into dest. Every file is checked
+// against the SHA-256 the server reports, and encrypted uploads are
+// decrypted with the key in the URL's fragment.
+func runGet(args []string) error {
+	flags := flag.NewFlagSet("get", flag.ExitOnError)
+	password := flags.String("password", "", "password for password-protected uploads")
+	force := flags.Bool("force", false, "overwrite files that already exist")
+	workers := flags.Int("workers", 4, "number of files to download concurrently")
+	profile := flags.String("profile", "", "named profile from the config file whose API key to send (default $BEAM_PROFILE)")
+	apiKey := flags.String("api-key", "", "API key for servers with private reads (default: the profile's, sent only to its server)")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: beam get [-profile NAME] [-password PASS] [-force] [-workers 4] <upload-url|file-url> [dest]\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	s, err := loadSettings(*profile)
+	if err != nil {
+		return fmt.Errorf("reading config: %w", err)
+	}
+
+	dest := "."
+	if flags.NArg() == 2 {
+		dest = flags.Arg(1)
+	}
+
+	server, uploadURL, filePath, err := parseUploadURL(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	// A key from the config or environment belongs to the configured server
+	// and is never sent to whichever server hosts the link.
+	keyServer := s.Server
+	if flagsSet(flags)["api-key"] {
+		keyServer = server
+	}
+
+	applySettings(flags, s)
+	useAPIKey(*apiKey, keyServer)
+
+	info, err := fetchUploadInfo(server+"/api/uploads/"+strings.TrimPrefix(uploadURL, server+"/u/"), *password)
+	if err != nil {
+		return err
+	}
+
+	opts := getOptions{Password: *password, Force: *force, Retries: maxResumeAttempts}
+
+	// Each request for a file of a burn-after-read upload spends a view,
+	// so a failed download is not retried.
+	if info.ViewsRemaining > 0 {
+		opts.Retries = 1
+	}
+
+	if info.Encrypted {
+		u, _ := url.Parse(flags.Arg(0))
+
+		key, err := crypt.ParseKey(u.Fragment)
+		if err != nil {
+			return fmt.Errorf("the upload is encrypted and the link has no valid key after its #")
+		}
+
+		opts.Key = &key
+	}
+
+	wanted, err := url.PathUnescape(filePath)
+	if err != nil {
+		return err
+	}
+
+	downloads, err := planDownloads(info, wanted, dest, opts)
+	if err != nil {
+		return err
+	}
+
+	if len(downloads) == 0 {
+		return fmt.Errorf("no file %s in %s", wanted, uploadURL)
+	}
+
+	return downloadAll(downloads, max(*workers, 1), opts)
+}
+
+// planDownloads picks the files to fetch and where to save them, refusing
+// to go ahead if any would overwrite an existing file without opts.Force.
+func planDownloads(info uploadResponse, wanted, dest string, opts getOptions) ([]download, error) {
+	var downloads []download
+
+	for _, f := range info.Files {
+		if wanted != "" && f.Path != wanted {
+			continue
+		}
+
+		name := f.Path
+		if opts.Key != nil {
+			var err error
+			if name, err = crypt.DecryptName(*opts.Key, f.Path); err != nil {
+				return nil, fmt.Errorf("decrypting file names: %w", err)
+			}
+		}
+
+		// A single file is saved under its base name, a whole upload with
+		// its tree recreated.
+		if wanted != "" {
+			name = path.Base(name)
+		}
+
+		local := filepath.FromSlash(name)
+		if !filepath.IsLocal(local) {
+			return nil, fmt.Errorf("refusing to write outside %s: %q", dest, name)
+		}
+
+		target := filepath.Join(dest, local)
+
+		if _, err := os.Lstat(target); !opts.Force && !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("%s already exists; pass -force to overwrite it", target)
+		}
+
+		downloads = append(downloads, download{file: f, name: name, target: target})
+	}
+
+	return downloads, nil
+}
+
+// downloadAll fetches the files with a pool of workers. A failed file does
+// not stop the others; every failure is reported at the end.
+func downloadAll(downloads []download, workers int, opts getOptions) error {
+	jobs := make(chan download)
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+
+	for range min(workers, len(downloads)) {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for d := range jobs {
+				n, err := downloadFile(d, opts)
+
+				mu.Lock()
+				if err != nil {
+					errs = append(errs, fmt.Errorf("downloading %s: %w", d.name, err))
+				} else {
+					fmt.Printf("%s (%d bytes)\n", d.target, n)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, d := range downloads {
+		jobs <- d
+	}
+
+	close(jobs)
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+func fetchUploadInfo(infoURL, password string) (uploadResponse, error) {
+	req, err := http.NewRequest(http.MethodGet, infoURL, nil)
+	if err != nil {
+		return uploadResponse{}, err
+	}
+
+	if password != "" {
+		req.Header.Set(upload.PasswordHeader, password)
+	}
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return uploadResponse{}, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return uploadResponse{}, responseError(res)
+	}
+
+	var info uploadResponse
+	if err := json.NewDecoder(res.Body).Decode(&info); err != nil {
+		return uploadResponse{}, err
+	}
+
+	return info, nil
+}
+
+// downloadFile saves a file to its target and returns the number of bytes
+// written. The stored bytes are collected in target.part, resuming whatever
+// an earlier attempt left there, and checked against the file's SHA-256
+// before being moved into place, decrypted if need be.
+func downloadFile(d download, opts getOptions) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(d.target), 0755); err != nil {
+		return 0, err
+	}
+
+	part := d.target + partSuffix
+
+	out, err := os.OpenFile(part, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+
+	// Hashing what is already there also leaves the file positioned at its
+	// end, ready to append.
+	h := sha256.New()
+
+	offset, err := io.Copy(h, out)
+	if err != nil {
+		return 0, err
+	}
+
+	backoff := resumeBackoff
+
+	for attempt := 1; offset != d.file.Size; attempt++ {
+		offset, err = fetchFrom(d.file, out, h, offset, opts.Password)
+		if err == nil && offset == d.file.Size {
+			break
+		}
+
+		if err == nil {
+			err = fmt.Errorf("got %d of %d bytes", offset, d.file.Size)
+		}
+
+		if attempt >= opts.Retries {
+			return 0, err
+		}
+
+		fmt.Fprintf(os.Stderr, "download of %s interrupted (%v), resuming in %s\n", d.name, err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+
+	if sum := hex.EncodeToString(h.Sum(nil)); d.file.SHA256 != "" && sum != d.file.SHA256 {
+		out.Close()
+		removePart(part)
+		return 0, fmt.Errorf("checksum mismatch: got sha256 %s, the server reported %s", sum, d.file.SHA256)
+	}
+
+	if opts.Key == nil {
+		if err := out.Close(); err != nil {
+			return 0, err
+		}
+
+		if err := os.Rename(part, d.target); err != nil {
+			return 0, err
+		}
+
+		os.Remove(part + etagSuffix)
+		return offset, nil
+	}
+
+	if _, err := out.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	n, err := decryptTo(d.target, out, *opts.Key)
+	if err != nil {
+		return 0, err
+	}
+
+	out.Close()
+	removePart(part)
+
+	return n, nil
+}
+
+// removePart deletes a download in progress along with its saved ETag.
+func removePart(part string) {
+	os.Remove(part)
+	os.Remove(part + etagSuffix)
+}
+
+// fetchFrom appends a file's bytes from offset onwards to out, which is
+// positioned at offset, and returns the new offset. A server that answers
+// with the whole file rather than the range, as it does when the file's
+// ETag no longer matches the one the earlier bytes came with, makes it
+// start over.
+func fetchFrom(f fileResponse, out *os.File, h hash.Hash, offset int64, password string) (int64, error) {
+	etagPath := out.Name() + etagSuffix
+
+	// More bytes than the file has cannot be resumed from.
+	if offset > f.Size {
+		if err := restart(out, h); err != nil {
+			return offset, err
+		}
+
+		offset = 0
+	}
+
+	req, err := http.NewRequest(http.MethodGet, f.URL, nil)
+	if err != nil {
+		return offset, err
+	}
+
+	if password != "" {
+		req.Header.Set(upload.PasswordHeader, password)
+	}
+
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+
+		if etag, err := os.ReadFile(etagPath); err == nil && len(etag) > 0 {
+			req.Header.Set("If-Range", string(etag))
+		}
+	}
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return offset, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		if offset > 0 {
+			if err := restart(out, h); err != nil {
+				return offset, err
+			}
+
+			offset = 0
+		}
+
+		// Save the ETag before any bytes, so they are never resumed
+		// against a different file.
+		if err := saveETag(etagPath, res.Header.Get("ETag")); err != nil {
+			return offset, err
+		}
+	default:
+		return offset, responseError(res)
+	}
+
+	n, err := io.Copy(io.MultiWriter(out, h), res.Body)
+	return offset + n, err
+}
+
+// saveETag records the ETag a download's bytes come with. Weak ETags
+// cannot be used with If-Range, so they are not kept.
+func saveETag(path, etag string) error {
+	if etag == "" || strings.HasPrefix(etag, "W/") {
+		err := os.Remove(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	return os.WriteFile(path, []byte(etag), 0644)
+}
+
+func restart(out *os.File, h hash.Hash) error {
+	h.Reset()
+
+	if err := out.Truncate(0); err != nil {
+		return err
+	}
+
+	_, err := out.Seek(0, io.SeekStart)
+	return err
+}
+
+// decryptTo decrypts an encrypted file into target, replacing it.
+func decryptTo(target string, r io.Reader, key crypt.Key) (int64, error) {
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, err
+	}
+
+	counter := &countingWriter{w: out}
+	err = crypt.Decrypt(counter, r, key)
+
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(target)
+		return 0, err
+	}
+
+	return counter.n, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
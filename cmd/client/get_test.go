@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// fileServer serves content with its hash as a strong ETag, like the beam
+// server, and records the Range and If-Range of each request.
+type fileServer struct {
+	content string
+
+	mu       sync.Mutex
+	requests []http.Header
+}
+
+func (s *fileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r.Header.Clone())
+	s.mu.Unlock()
+
+	w.Header().Set("ETag", strconv.Quote(sha256Hex(s.content)))
+	http.ServeContent(w, r, "", time.Time{}, strings.NewReader(s.content))
+}
+
+func TestDownloadFile(t *testing.T) {
+	const content = "the quick brown fox jumps over the lazy dog"
+
+	tests := []struct {
+		name string
+		// part and etag are left from an earlier attempt, if set.
+		part, etag  string
+		sha256      string
+		wantRange   string
+		wantIfRange string
+		wantErr     bool
+	}{
+		{name: "fresh"},
+		{name: "resume", part: content[:10], etag: strconv.Quote(sha256Hex(content)), wantRange: "bytes=10-", wantIfRange: strconv.Quote(sha256Hex(content))},
+		{name: "resume without etag", part: content[:10], wantRange: "bytes=10-"},
+		{name: "changed etag", part: "THE QUICK ", etag: strconv.Quote(sha256Hex("THE QUICK BROWN FOX")), wantRange: "bytes=10-", wantIfRange: strconv.Quote(sha256Hex("THE QUICK BROWN FOX"))},
+		{name: "part longer than file", part: content + " and more"},
+		{name: "checksum mismatch", sha256: sha256Hex("something else"), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := &fileServer{content: content}
+			server := httptest.NewServer(files)
+			defer server.Close()
+
+			target := filepath.Join(t.TempDir(), "out", "fox.txt")
+			part := target + partSuffix
+
+			if tt.part != "" {
+				os.MkdirAll(filepath.Dir(target), 0755)
+				os.WriteFile(part, []byte(tt.part), 0644)
+			}
+
+			if tt.etag != "" {
+				os.WriteFile(part+etagSuffix, []byte(tt.etag), 0644)
+			}
+
+			if tt.sha256 == "" {
+				tt.sha256 = sha256Hex(content)
+			}
+
+			d := download{
+				file:   fileResponse{Path: "fox.txt", Size: int64(len(content)), URL: server.URL + "/raw/abc/fox.txt", SHA256: tt.sha256},
+				name:   "fox.txt",
+				target: target,
+			}
+
+			n, err := downloadFile(d, getOptions{Retries: 1})
+
+			for _, leftover := range []string{part, part + etagSuffix} {
+				if _, err := os.Stat(leftover); !errors.Is(err, fs.ErrNotExist) {
+					t.Fatalf("expected %s to be removed, got %v", filepath.Base(leftover), err)
+				}
+			}
+
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+					t.Fatalf("expected a checksum mismatch, got %v", err)
+				}
+
+				if _, err := os.Stat(target); !errors.Is(err, fs.ErrNotExist) {
+					t.Fatalf("expected no file to be saved, got %v", err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			data, _ := os.ReadFile(target)
+			if string(data) != content || n != int64(len(content)) {
+				t.Fatalf("expected the whole file, got %d bytes %q", n, data)
+			}
+
+			first := files.requests[0]
+			if first.Get("Range") != tt.wantRange || first.Get("If-Range") != tt.wantIfRange {
+				t.Fatalf("expected Range %q and If-Range %q, got %q and %q", tt.wantRange, tt.wantIfRange, first.Get("Range"), first.Get("If-Range"))
+			}
+		})
+	}
+}
+
+func TestFetchFromSavesETagBeforeData(t *testing.T) {
+	const content = "hello"
+
+	server := httptest.NewServer(&fileServer{content: content})
+	defer server.Close()
+
+	part := filepath.Join(t.TempDir(), "hello.txt"+partSuffix)
+	out, err := os.Create(part)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	f := fileResponse{Size: int64(len(content)), URL: server.URL}
+	if _, err := fetchFrom(f, out, sha256.New(), 0, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	etag, err := os.ReadFile(part + etagSuffix)
+	if err != nil || string(etag) != strconv.Quote(sha256Hex(content)) {
+		t.Fatalf("expected the ETag to be saved beside the part, got %q, %v", etag, err)
+	}
+}
+
+func TestPlanDownloads(t *testing.T) {
+	dest := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(dest, "a.txt"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	info := uploadResponse{Files: []fileResponse{
+		{Path: "a.txt"},
+		{Path: "dir/b.txt"},
+	}}
+
+	tests := []struct {
+		name    string
+		files   []fileResponse
+		wanted  string
+		force   bool
+		want    []string
+		wantErr string
+	}{
+		{name: "refuses to overwrite", wantErr: "already exists"},
+		{name: "force overwrites", force: true, want: []string{"a.txt", "dir/b.txt"}},
+		{name: "single file by base name", wanted: "dir/b.txt", want: []string{"b.txt"}},
+		{name: "unknown file", wanted: "missing.txt"},
+		{name: "outside dest", files: []fileResponse{{Path: "../escape.txt"}}, wantErr: "refusing to write outside"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info := info
+			if tt.files != nil {
+				info.Files = tt.files
+			}
+
+			downloads, err := planDownloads(info, tt.wanted, dest, getOptions{Force: tt.force})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, d := range downloads {
+				rel, _ := filepath.Rel(dest, d.target)
+				got = append(got, filepath.ToSlash(rel))
+			}
+
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Fatalf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+
+	// Refusing must leave the existing file as it was.
+	if data, _ := os.ReadFile(filepath.Join(dest, "a.txt")); !bytes.Equal(data, []byte("old")) {
+		t.Fatalf("expected a.txt to be untouched, got %q", data)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Every upload is recorded in a local history so links can be found again
+// with `beam ls` and `beam show`, and deleted with `beam rm` using the owner
+// token saved alongside them.
+
+type historyEntry struct {
+	Slug string `json:"slug"`
+	// URL is the upload's link, including the #key of encrypted uploads.
+	URL        string        `json:"url"`
+	Server     string        `json:"server"`
+	Profile    string        `json:"profile,omitempty"`
+	CreatedAt  time.Time     `json:"created_at"`
+	ExpiresAt  time.Time     `json:"expires_at,omitzero"`
+	Views      int           `json:"views,omitempty"`
+	Password   bool          `json:"password,omitempty"`
+	Encrypted  bool          `json:"encrypted,omitempty"`
+	OwnerToken string        `json:"owner_token,omitempty"`
+	Files      []historyFile `json:"files"`
+}
+
+type historyFile struct {
+	// Path is the file's name as uploaded, decrypted for encrypted uploads.
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	// SHA256 is of the bytes the server stores: the ciphertext when encrypted.
+	SHA256 string `json:"sha256"`
+	URL    string `json:"url"`
+}
+
+// uploadURL is the entry's link without any #key, as used to address the
+// upload on the server.
+func (e historyEntry) uploadURL() string {
+	u, _, _ := strings.Cut(e.URL, "#")
+	return u
+}
+
+func (e historyEntry) expired(now time.Time) bool {
+	return !e.ExpiresAt.IsZero() && !now.Before(e.ExpiresAt)
+}
+
+func historyPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "beam", "history.json"), nil
+}
+
+// loadHistory returns the recorded uploads, oldest first.
+func loadHistory() ([]historyEntry, error) {
+	path, err := historyPath()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var history []historyEntry
+	if err := json.Unmarshal(data, &history); err != nil {
+		return nil, err
+	}
+
+	return history, nil
+}
+
+func writeHistory(history []historyEntry) error {
+	path, err := historyPath()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(history, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write beside the file and rename so a crash cannot lose the history.
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// updateHistory applies fn to the history and writes back what it returns.
+func updateHistory(fn func([]historyEntry) []historyEntry) error {
+	history, err := loadHistory()
+	if err != nil {
+		return err
+	}
+
+	return writeHistory(fn(history))
+}
+
+func recordUpload(entry historyEntry) error {
+	return updateHistory(func(history []historyEntry) []historyEntry {
+		return append(history, entry)
+	})
+}
+
+// findHistory looks an upload up by its slug or any URL within it.
+func findHistory(history []historyEntry, ref string) (historyEntry, bool) {
+	slug := ref
+
+	if server, uploadURL, _, err := parseUploadURL(ref); err == nil {
+		slug = strings.TrimPrefix(uploadURL, server+"/u/")
+	}
+
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Slug == slug {
+			return history[i], true
+		}
+	}
+
+	return historyEntry{}, false
+}
+
+// ownerToken returns the owner token saved in the history for an upload
+// URL, or "" if there is none.
+func ownerToken(uploadURL string) (string, error) {
+	history, err := loadHistory()
+	if err != nil {
+		return "", err
+	}
+
+	for _, e := range history {
+		if e.uploadURL() == uploadURL && e.OwnerToken != "" {
+			return e.OwnerToken, nil
+		}
+	}
+
+	return "", nil
+}
+
+// forgetRemoved drops a deleted upload from the history, or just the file
+// at filePath when only that was deleted.
+func forgetRemoved(uploadURL, filePath string) error {
+	return updateHistory(func(history []historyEntry) []historyEntry {
+		kept := history[:0]
+
+		for _, e := range history {
+			if e.uploadURL() != uploadURL {
+				kept = append(kept, e)
+				continue
+			}
+
+			if filePath == "" {
+				continue
+			}
+
+			files := e.Files[:0]
+			for _, f := range e.Files {
+				if _, _, p, _ := parseUploadURL(f.URL); !samePath(p, filePath) {
+					files = append(files, f)
+				}
+			}
+
+			e.Files = files
+			kept = append(kept, e)
+		}
+
+		return kept
+	})
+}
+
+// samePath compares two escaped URL paths by what they unescape to.
+func samePath(a, b string) bool {
+	a, errA := url.PathUnescape(a)
+	b, errB := url.PathUnescape(b)
+
+	return errA == nil && errB == nil && a == b
+}
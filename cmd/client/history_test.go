@@ -0,0 +1,219 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useTempConfigDir keeps the history for the rest of the test in a fresh
+// directory.
+func useTempConfigDir(t *testing.T) {
+	t.Helper()
+
+	dir := t.TempDir()
+	t.Setenv("HOME", dir)
+	t.Setenv("XDG_CONFIG_HOME", dir)
+}
+
+func testEntry(server, slug string, created time.Time) historyEntry {
+	return historyEntry{
+		Slug:       slug,
+		URL:        server + "/u/" + slug,
+		Server:     server,
+		CreatedAt:  created,
+		OwnerToken: "token-" + slug,
+		Files: []historyFile{
+			{Path: "a.txt", Size: 1, URL: server + "/u/" + slug + "/a.txt"},
+			{Path: "dir/b c.txt", Size: 2, URL: server + "/u/" + slug + "/dir/b%20c.txt"},
+		},
+	}
+}
+
+func historySlugs(t *testing.T) []string {
+	t.Helper()
+
+	history, err := loadHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var slugs []string
+	for _, e := range history {
+		slugs = append(slugs, e.Slug)
+	}
+
+	return slugs
+}
+
+func TestHistoryRecordsUploads(t *testing.T) {
+	useTempConfigDir(t)
+
+	if history, err := loadHistory(); err != nil || history != nil {
+		t.Fatalf("expected an empty history, got %v, %v", history, err)
+	}
+
+	created := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	first := testEntry("http://beam.test", "first", created)
+	first.ExpiresAt = created.Add(time.Hour)
+
+	for _, e := range []historyEntry{first, testEntry("http://beam.test", "second", created)} {
+		if err := recordUpload(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	history, err := loadHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(history) != 2 || history[0].Slug != "first" || history[1].Slug != "second" {
+		t.Fatalf("expected both uploads oldest first, got %+v", history)
+	}
+
+	if !history[0].ExpiresAt.Equal(first.ExpiresAt) || len(history[0].Files) != 2 || history[0].OwnerToken != "token-first" {
+		t.Fatalf("expected the entry to round-trip, got %+v", history[0])
+	}
+
+	path, _ := historyPath()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The history holds owner tokens and encryption keys.
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("expected the history to be private, got %v", info.Mode())
+	}
+}
+
+func TestFindHistory(t *testing.T) {
+	history := []historyEntry{
+		testEntry("http://beam.test", "abc", time.Now()),
+		testEntry("http://beam.test", "def", time.Now()),
+	}
+
+	tests := map[string]string{
+		"abc":                              "abc",
+		"http://beam.test/u/def":           "def",
+		"http://beam.test/u/abc/a.txt":     "abc",
+		"http://beam.test/u/def#secretkey": "def",
+		"ghi":                              "",
+		"http://beam.test/u/ghi":           "",
+	}
+
+	for ref, want := range tests {
+		e, ok := findHistory(history, ref)
+		if ok != (want != "") || e.Slug != want {
+			t.Errorf("findHistory(%q) = %q, %v, want %q", ref, e.Slug, ok, want)
+		}
+	}
+}
+
+func TestForgetRemoved(t *testing.T) {
+	useTempConfigDir(t)
+
+	for _, slug := range []string{"abc", "def"} {
+		if err := recordUpload(testEntry("http://beam.test", slug, time.Now())); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Removing one file keeps the rest of its upload.
+	if err := forgetRemoved("http://beam.test/u/abc", "dir/b c.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	history, _ := loadHistory()
+	if len(history) != 2 || len(history[0].Files) != 1 || history[0].Files[0].Path != "a.txt" {
+		t.Fatalf("expected only the removed file to be forgotten, got %+v", history)
+	}
+
+	if err := forgetRemoved("http://beam.test/u/abc", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if slugs := historySlugs(t); !slices.Equal(slugs, []string{"def"}) {
+		t.Fatalf("expected the removed upload to be forgotten, got %v", slugs)
+	}
+}
+
+func TestOwnerToken(t *testing.T) {
+	useTempConfigDir(t)
+
+	if err := recordUpload(testEntry("http://beam.test", "abc", time.Now())); err != nil {
+		t.Fatal(err)
+	}
+
+	for uploadURL, want := range map[string]string{
+		"http://beam.test/u/abc":  "token-abc",
+		"http://beam.test/u/none": "",
+	} {
+		if got, err := ownerToken(uploadURL); err != nil || got != want {
+			t.Errorf("ownerToken(%q) = %q, %v, want %q", uploadURL, got, err, want)
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+	// The server only still has "kept" and "old".
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch strings.TrimPrefix(r.URL.Path, "/api/uploads/") {
+		case "kept", "old":
+			w.Write([]byte(`{}`))
+		case "burned":
+			http.Error(w, "gone", http.StatusGone)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	now := time.Now()
+
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{name: "expired", want: []string{"kept", "old", "deleted", "burned"}},
+		{name: "older than", args: []string{"-older-than", "720h"}, want: []string{"kept", "deleted", "burned"}},
+		{name: "check", args: []string{"-check"}, want: []string{"kept", "old"}},
+		{name: "dry run", args: []string{"-n", "-older-than", "720h", "-check"}, want: []string{"kept", "expired", "old", "deleted", "burned"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTempConfigDir(t)
+			clearConfigEnv(t, "")
+
+			expired := testEntry(server.URL, "expired", now.Add(-time.Hour))
+			expired.ExpiresAt = now.Add(-time.Minute)
+
+			for _, e := range []historyEntry{
+				testEntry(server.URL, "kept", now),
+				expired,
+				testEntry(server.URL, "old", now.Add(-60*24*time.Hour)),
+				testEntry(server.URL, "deleted", now),
+				testEntry(server.URL, "burned", now),
+			} {
+				if err := recordUpload(e); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := runPrune(tt.args); err != nil {
+				t.Fatal(err)
+			}
+
+			if slugs := historySlugs(t); !slices.Equal(slugs, tt.want) {
+				t.Fatalf("expected %v to be left, got %v", tt.want, slugs)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"text/tabwriter"
+	"time"
+)
+
+// runList implements `beam ls`, listing recorded uploads newest first.
+func runList(args []string) error {
+	flags := flag.NewFlagSet("ls", flag.ExitOnError)
+	all := flags.Bool("a", false, "include expired uploads")
+	profile := flags.String("profile", "", "only list uploads made with this profile")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: beam ls [-a] [-profile NAME]\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	history, err := loadHistory()
+	if err != nil {
+		return fmt.Errorf("reading history: %w", err)
+	}
+
+	now := time.Now()
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CREATED\tEXPIRES\tFILES\tURL")
+
+	for _, e := range slices.Backward(history) {
+		if !*all && e.expired(now) {
+			continue
+		}
+
+		if *profile != "" && e.Profile != *profile {
+			continue
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", e.CreatedAt.Local().Format("2006-01-02 15:04"), describeExpiry(e, now), describeFiles(e), e.URL)
+	}
+
+	return tw.Flush()
+}
+
+// runShow implements `beam show <slug|url>`, printing everything recorded
+// about one upload.
+func runShow(args []string) error {
+	flags := flag.NewFlagSet("show", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: beam show <slug|upload-url>\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	history, err := loadHistory()
+	if err != nil {
+		return fmt.Errorf("reading history: %w", err)
+	}
+
+	e, ok := findHistory(history, flags.Arg(0))
+	if !ok {
+		return fmt.Errorf("no upload %s in the history", flags.Arg(0))
+	}
+
+	now := time.Now()
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "url:\t%s\n", e.URL)
+	fmt.Fprintf(tw, "server:\t%s\n", e.Server)
+
+	if e.Profile != "" {
+		fmt.Fprintf(tw, "profile:\t%s\n", e.Profile)
+	}
+
+	fmt.Fprintf(tw, "created:\t%s\n", e.CreatedAt.Local().Format(time.RFC1123))
+
+	if !e.ExpiresAt.IsZero() {
+		fmt.Fprintf(tw, "expires:\t%s (%s)\n", e.ExpiresAt.Local().Format(time.RFC1123), describeExpiry(e, now))
+	}
+
+	if e.Views > 0 {
+		fmt.Fprintf(tw, "views:\tdeleted after %d downloads\n", e.Views)
+	}
+
+	if e.Password {
+		fmt.Fprintf(tw, "password:\tyes\n")
+	}
+
+	if e.Encrypted {
+		fmt.Fprintf(tw, "encrypted:\tyes\n")
+	}
+
+	if e.OwnerToken != "" {
+		fmt.Fprintf(tw, "owner token:\t%s\n", e.OwnerToken)
+	}
+
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Println("files:")
+
+	tw = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, f := range e.Files {
+		fmt.Fprintf(tw, "  %s\t%d bytes\tsha256:%s\n", f.Path, f.Size, f.SHA256)
+	}
+
+	return tw.Flush()
+}
+
+func describeExpiry(e historyEntry, now time.Time) string {
+	switch {
+	case e.ExpiresAt.IsZero():
+		return "never"
+	case e.expired(now):
+		return "expired"
+	}
+
+	switch left := e.ExpiresAt.Sub(now); {
+	case left >= 48*time.Hour:
+		return fmt.Sprintf("in %dd", left/(24*time.Hour))
+	case left >= time.Hour:
+		return fmt.Sprintf("in %dh", left/time.Hour)
+	default:
+		return fmt.Sprintf("in %dm", max(left/time.Minute, 1))
+	}
+}
+
+func describeFiles(e historyEntry) string {
+	switch len(e.Files) {
+	case 0:
+		return "-"
+	case 1:
+		return e.Files[0].Path
+	default:
+		return fmt.Sprintf("%s +%d more", e.Files[0].Path, len(e.Files)-1)
+	}
+}
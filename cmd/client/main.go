@@ -3,82 +3,291 @@ package main
 // Usage:
 // go run ./cmd/client ./README.md
 // go run ./cmd/client -server http://localhost:9001 ./README.md
+// go run ./cmd/client ./myproject
+// go run ./cmd/client -workers 8 ./myproject
+// go run ./cmd/client -expires 24h ./README.md
+// go run ./cmd/client -views 1 ./credentials.txt
+// go run ./cmd/client -ask-password ./credentials.txt
+// go run ./cmd/client -encrypt ./customer-export.csv
+// go test ./... 2>&1 | go run ./cmd/client
+// dmesg | go run ./cmd/client -name dmesg.log -
+// go run ./cmd/client get 'http://localhost:9001/u/oDZBbI5ZGLk#key' ./out
+// go run ./cmd/client get -force -workers 8 http://localhost:9001/u/oDZBbI5ZGLk ./out
+// go run ./cmd/client rm http://localhost:9001/u/oDZBbI5ZGLk
+// go run ./cmd/client ls
+// go run ./cmd/client show oDZBbI5ZGLk
+// go run ./cmd/client prune -check
+// go run ./cmd/client -profile staging ./README.md
+// BEAM_API_KEY=... go run ./cmd/client ./README.md
 
 import (
-	"bytes"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"mime/multipart"
 	"net/http"
+	"net/textproto"
 	"os"
-	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elliota43/beam/internal/crypt"
+	"github.com/elliota43/beam/internal/upload"
 )
 
 type uploadResponse struct {
-	URL   string `json:"url"`
-	Files []struct {
-		Name   string `json:"name"`
-		Size   int64  `json:"size"`
-		URL    string `json:"url"`
-		SHA256 string `json:"sha256"`
-	} `json:"files"`
+	URL            string         `json:"url"`
+	ExpiresAt      time.Time      `json:"expires_at"`
+	ViewsRemaining int            `json:"views_remaining"`
+	Encrypted      bool           `json:"encrypted"`
+	OwnerToken     string         `json:"owner_token"`
+	Files          []fileResponse `json:"files"`
+}
+
+type fileResponse struct {
+	Name   string `json:"name"`
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	URL    string `json:"url"`
+	SHA256 string `json:"sha256"`
+}
+
+// subcommands are run as `beam <name> [args]` instead of uploading.
+var subcommands = map[string]func(args []string) error{
+	"rm":    runRemove,
+	"get":   runGet,
+	"ls":    runList,
+	"show":  runShow,
+	"prune": runPrune,
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			if err := run(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "%s failed: %v\n", os.Args[1], err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	profile := flag.String("profile", "", "named profile from the config file (default $BEAM_PROFILE)")
 	server := flag.String("server", "http://localhost:9001", "beam server URL")
+	workers := flag.Int("workers", 1, "number of files to upload concurrently")
+	expires := flag.Duration("expires", 0, "how long the server should keep the upload, e.g. 24h (default: the server's default)")
+	views := flag.Int("views", 0, "delete the upload after it has been downloaded this many times (burn after reading)")
+	apiKey := flag.String("api-key", "", "API key for servers that require one (default $BEAM_API_KEY)")
+	password := flag.String("password", "", "password that must be given to view or download the upload")
+	askPassword := flag.Bool("ask-password", false, "prompt for the upload's password instead of passing -password")
+	name := flag.String("name", "", "file name for data read from standard input (default: stdin plus an extension for the detected type)")
+	encrypt := flag.Bool("encrypt", false, "encrypt files and their names before sending; the key is only kept in the returned link's #fragment")
 	flag.Parse()
 
+	s, err := loadSettings(*profile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "reading config: %v\n", err)
+		os.Exit(1)
+	}
+
+	applySettings(flag.CommandLine, s)
+	useAPIKey(*apiKey, *server)
+
 	paths := flag.Args()
+
+	// Without paths, read piped or redirected input, but never wait on a
+	// terminal or upload an empty stdin, as under cron or CI; "-" reads
+	// it regardless.
+	if len(paths) == 0 && stdinHasData() {
+		paths = []string{stdinPath}
+	}
+
 	if len(paths) == 0 {
-		fmt.Fprintf(os.Stderr, "usage: beam [-server http://localhost:9001] <file> [file...]\n")
+		fmt.Fprintf(os.Stderr, "usage: beam [-profile NAME] [-server http://localhost:9001] [-workers 1] [-expires 24h] [-views 1] [-password PASS | -ask-password] [-encrypt] [-name NAME] <file|dir|-> [file|dir...]\n")
+		fmt.Fprintf(os.Stderr, "       beam rm [-token TOKEN] <upload-url|file-url>\n")
+		fmt.Fprintf(os.Stderr, "       beam get [-profile NAME] [-password PASS] <upload-url|file-url> [dest]\n")
+		fmt.Fprintf(os.Stderr, "       beam ls [-a] [-profile NAME]\n")
+		fmt.Fprintf(os.Stderr, "       beam show <slug|upload-url>\n")
+		fmt.Fprintf(os.Stderr, "       beam prune [-older-than 720h] [-check] [-n]\n")
 		os.Exit(2)
 	}
 
-	resp, err := uploadFiles(*server, paths)
+	if *askPassword {
+		p, err := promptPassword()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "reading password: %v\n", err)
+			os.Exit(1)
+		}
+
+		*password = p
+	}
+
+	opts := uploadOptions{
+		Workers:  max(*workers, 1),
+		Expires:  *expires,
+		Views:    *views,
+		Password: *password,
+		Name:     *name,
+	}
+
+	if *encrypt {
+		key := crypt.NewKey()
+		opts.Key = &key
+	}
+
+	resp, err := uploadFiles(*server, paths, opts)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "upload failed: %v\n", err)
 		os.Exit(1)
 	}
 
-	fmt.Println(resp.URL)
+	// The key goes after the # so browsers never send it to the server.
+	fragment := ""
+	if opts.Key != nil {
+		fragment = "#" + opts.Key.String()
+	}
 
-	for _, f := range resp.Files {
-		fmt.Printf("- %s (%d bytes): %s\n", f.Name, f.Size, f.URL)
+	fmt.Println(resp.URL + fragment)
+
+	entry := newHistoryEntry(resp, *server, s.Profile, opts, fragment)
+
+	if err := recordUpload(entry); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: could not record the upload in the history, so `beam rm` will need -token %s: %v\n", resp.OwnerToken, err)
+	}
+
+	if !resp.ExpiresAt.IsZero() {
+		fmt.Printf("expires %s\n", resp.ExpiresAt.Local().Format(time.RFC1123))
+	}
+
+	if resp.ViewsRemaining > 0 {
+		fmt.Printf("deleted after %d downloads\n", resp.ViewsRemaining)
+	}
+
+	if opts.Password != "" {
+		fmt.Println("password protected")
+	}
+
+	if opts.Key != nil {
+		fmt.Println("end-to-end encrypted: anyone with the full link can read it")
+	}
+
+	for _, f := range entry.Files {
+		fmt.Printf("- %s (%d bytes): %s\n", f.Path, f.Size, f.URL)
 	}
 }
 
-func uploadFiles(server string, paths []string) (uploadResponse, error) {
-	var body bytes.Buffer
-	writer := multipart.NewWriter(&body)
+// newHistoryEntry describes a finished upload for the history, with the
+// names, sizes and links of encrypted files as the user knows them.
+func newHistoryEntry(resp uploadResponse, server, profile string, opts uploadOptions, fragment string) historyEntry {
+	entry := historyEntry{
+		URL:        resp.URL + fragment,
+		Server:     server,
+		Profile:    profile,
+		CreatedAt:  time.Now().UTC(),
+		ExpiresAt:  resp.ExpiresAt,
+		Views:      resp.ViewsRemaining,
+		Password:   opts.Password != "",
+		Encrypted:  opts.Key != nil,
+		OwnerToken: resp.OwnerToken,
+	}
 
-	for _, path := range paths {
-		if err := addFile(writer, path); err != nil {
-			return uploadResponse{}, err
+	if base, uploadURL, _, err := parseUploadURL(resp.URL); err == nil {
+		entry.Slug = strings.TrimPrefix(uploadURL, base+"/u/")
+	}
+
+	for _, f := range resp.Files {
+		file := historyFile{Path: f.Path, Size: f.Size, SHA256: f.SHA256, URL: f.URL + fragment}
+
+		if opts.Key != nil {
+			file.Path, _ = crypt.DecryptName(*opts.Key, f.Path)
+			file.Size = crypt.DecryptedSize(f.Size)
 		}
+
+		entry.Files = append(entry.Files, file)
 	}
 
-	if err := writer.Close(); err != nil {
+	return entry
+}
+
+// uploadOptions are the per-upload settings chosen on the command line.
+type uploadOptions struct {
+	Workers  int
+	Expires  time.Duration
+	Views    int
+	Password string
+	// Name is the file name given to standard input.
+	Name string
+	// Key, when set, encrypts files and their names before they are sent.
+	Key *crypt.Key
+}
+
+// uploadFiles sends every file into a single upload. With one worker, small
+// files are streamed in the final multipart request and only large files go
+// through the resumable API first. With more workers, every file is sent as
+// a resumable partial concurrently and the final request just attaches them.
+func uploadFiles(server string, paths []string, opts uploadOptions) (uploadResponse, error) {
+	files, err := collectFiles(paths, opts.Name)
+	if err != nil {
 		return uploadResponse{}, err
 	}
 
-	req, err := http.NewRequest(http.MethodPost, server+"/api/uploads", &body)
+	if len(files) == 0 {
+		return uploadResponse{}, fmt.Errorf("no files found to upload")
+	}
+
+	if opts.Key != nil {
+		dir, err := os.MkdirTemp("", "beam-encrypted-")
+		if err != nil {
+			return uploadResponse{}, err
+		}
+		defer os.RemoveAll(dir)
+
+		if files, err = encryptFiles(files, *opts.Key, dir); err != nil {
+			return uploadResponse{}, err
+		}
+	}
+
+	partialIDs, err := uploadPartials(server, files, opts.Workers)
 	if err != nil {
 		return uploadResponse{}, err
 	}
 
-	req.Header.Set("Content-Type", writer.FormDataContentType())
+	// A rate-limited upload is sent again from the start, which standard
+	// input cannot be.
+	attempts := maxResumeAttempts
+	if slices.ContainsFunc(files, func(f upload.UploadFile) bool { return f.AbsolutePath == stdinPath }) {
+		attempts = 1
+	}
+
+	res, err := doRetrying(attempts, func() (*http.Request, error) {
+		pr, pw := io.Pipe()
+		writer := multipart.NewWriter(pw)
+
+		go func() {
+			pw.CloseWithError(writeParts(writer, files, partialIDs, opts))
+		}()
 
-	res, err := http.DefaultClient.Do(req)
+		req, err := http.NewRequest(http.MethodPost, server+"/api/uploads", pr)
+		if err != nil {
+			pr.Close()
+			return nil, err
+		}
+
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+
+		return req, nil
+	})
 	if err != nil {
 		return uploadResponse{}, err
 	}
 	defer res.Body.Close()
 
 	if res.StatusCode < 200 || res.StatusCode >= 300 {
-		msg, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
-		return uploadResponse{}, fmt.Errorf("server returned %s: %s", res.Status, bytes.TrimSpace(msg))
+		return uploadResponse{}, responseError(res)
 	}
 
 	var out uploadResponse
@@ -89,24 +298,143 @@ func uploadFiles(server string, paths []string) (uploadResponse, error) {
 	return out, nil
 }
 
-func addFile(writer *multipart.Writer, path string) error {
-	f, err := os.Open(path)
+// uploadPartials sends the files that should go through the resumable API
+// using the given number of workers. The returned slice holds the partial
+// id for each such file, and "" for files to send inline.
+func uploadPartials(server string, files []upload.UploadFile, workers int) ([]string, error) {
+	ids := make([]string, len(files))
+	sizes := make([]int64, len(files))
+
+	var pending []int
+
+	for i, file := range files {
+		// Standard input has no size up front, so it is always sent inline.
+		if file.AbsolutePath == stdinPath {
+			continue
+		}
+
+		info, err := os.Stat(file.AbsolutePath)
+		if err != nil {
+			return nil, err
+		}
+
+		sizes[i] = info.Size()
+
+		if workers > 1 || sizes[i] >= resumableThreshold {
+			pending = append(pending, i)
+		}
+	}
+
+	jobs := make(chan int)
+	failed := make(chan struct{})
+
+	var (
+		wg       sync.WaitGroup
+		failOnce sync.Once
+		firstErr error
+	)
+
+	for range min(workers, len(pending)) {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for i := range jobs {
+				id, err := uploadPartial(server, files[i], sizes[i])
+				if err != nil {
+					failOnce.Do(func() {
+						firstErr = err
+						close(failed)
+					})
+					continue
+				}
+
+				ids[i] = id
+			}
+		}()
+	}
+
+feed:
+	for _, i := range pending {
+		select {
+		case jobs <- i:
+		case <-failed:
+			break feed
+		}
+	}
+
+	close(jobs)
+	wg.Wait()
+
+	return ids, firstErr
+}
+
+// writeParts writes the multipart body: the upload's settings, then in file
+// order an inline "files" part for small files, or a "partial" field for
+// files already uploaded.
+func writeParts(writer *multipart.Writer, files []upload.UploadFile, partialIDs []string, opts uploadOptions) error {
+	if opts.Expires > 0 {
+		if err := writer.WriteField("expires", opts.Expires.String()); err != nil {
+			return err
+		}
+	}
+
+	if opts.Views > 0 {
+		if err := writer.WriteField("views", strconv.Itoa(opts.Views)); err != nil {
+			return err
+		}
+	}
+
+	if opts.Password != "" {
+		if err := writer.WriteField("password", opts.Password); err != nil {
+			return err
+		}
+	}
+
+	if opts.Key != nil {
+		if err := writer.WriteField("encrypted", "true"); err != nil {
+			return err
+		}
+	}
+
+	for i, file := range files {
+		if partialIDs[i] != "" {
+			if err := writer.WriteField("partial", partialIDs[i]); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := addFile(writer, file); err != nil {
+			return err
+		}
+	}
+
+	return writer.Close()
+}
+
+func addFile(writer *multipart.Writer, file upload.UploadFile) error {
+	f, err := openFile(file.AbsolutePath)
 	if err != nil {
 		return err
 	}
 
 	defer f.Close()
 
-	info, err := f.Stat()
-	if err != nil {
-		return err
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", multipart.FileContentDisposition("files", file.RelativePath))
+	header.Set("Content-Type", "application/octet-stream")
+
+	if file.ContentType != "" {
+		header.Set("Content-Type", file.ContentType)
 	}
 
-	if info.IsDir() {
-		return fmt.Errorf("%s is a directory; this prototype only accepts explicit files right now", path)
+	if !file.ModTime.IsZero() {
+		header.Set("Last-Modified", file.ModTime.UTC().Format(http.TimeFormat))
 	}
 
-	part, err := writer.CreateFormFile("files", filepath.Base(path))
+	part, err := writer.CreatePart(header)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestUploadFilesWaitsOutRateLimits(t *testing.T) {
+	var posts atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if posts.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			t.Error(err)
+		}
+
+		json.NewEncoder(w).Encode(uploadResponse{URL: "http://beam.test/u/abc"})
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "hello.txt")
+	if err := os.WriteFile(path, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := uploadFiles(server.URL, []string{path}, uploadOptions{Workers: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.URL != "http://beam.test/u/abc" || posts.Load() != 2 {
+		t.Fatalf("expected the upload to be sent again after Retry-After, got %q after %d requests", resp.URL, posts.Load())
+	}
+}
+
+func TestUploadFilesWithWorkersSendsEveryFileOnce(t *testing.T) {
+	dir := t.TempDir()
+
+	var want []string
+	for i := range 12 {
+		name := fmt.Sprintf("file%02d.txt", i)
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		want = append(want, filepath.Base(dir)+"/"+name)
+	}
+
+	tus, server := newTusServer(t)
+
+	if _, err := uploadFiles(server.URL, []string{dir}, uploadOptions{Workers: 4}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tus.created) != len(want) {
+		t.Fatalf("expected a partial for each of %d files, got %v", len(want), tus.created)
+	}
+
+	for _, name := range want {
+		if tus.created[name] != 1 {
+			t.Fatalf("expected %s to be sent exactly once, got %d", name, tus.created[name])
+		}
+	}
+
+	if len(tus.uploads) != 1 || len(tus.uploads[0]) != len(want) {
+		t.Fatalf("expected one upload attaching every partial, got %v", tus.uploads)
+	}
+
+	// The upload attaches the partials in file order.
+	for i, id := range tus.uploads[0] {
+		p := tus.partials[id]
+		if p.name != want[i] || string(p.data) != filepath.Base(p.name) {
+			t.Fatalf("expected partial %d to hold %s, got %s with %q", i, want[i], p.name, p.data)
+		}
+	}
+}
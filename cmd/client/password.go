@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/term"
+)
+
+// promptPassword reads a password from the terminal without echoing it,
+// asking twice so a typo does not lock the upload. Standard input may be
+// the data being uploaded, so the terminal is opened directly if possible.
+func promptPassword() (string, error) {
+	tty := os.Stdin
+
+	if f, err := os.Open("/dev/tty"); err == nil {
+		defer f.Close()
+		tty = f
+	}
+
+	fd := int(tty.Fd())
+	if !term.IsTerminal(fd) {
+		return "", errors.New("no terminal to prompt on; use -password")
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	first, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+
+	if len(first) == 0 {
+		return "", errors.New("password must not be empty")
+	}
+
+	fmt.Fprint(os.Stderr, "Confirm password: ")
+	second, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+
+	if string(first) != string(second) {
+		return "", errors.New("passwords do not match")
+	}
+
+	return string(first), nil
+}
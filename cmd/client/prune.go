@@ -0,0 +1,100 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// runPrune implements `beam prune`, dropping uploads from the history once
+// they have expired, are older than -older-than, or with -check, are gone
+// from the server because they were deleted or burned.
+func runPrune(args []string) error {
+	flags := flag.NewFlagSet("prune", flag.ExitOnError)
+	olderThan := flags.Duration("older-than", 0, "also prune uploads made longer ago than this, e.g. 720h")
+	check := flags.Bool("check", false, "ask the server about every upload and prune the ones it no longer has")
+	profile := flags.String("profile", "", "named profile whose API key to send with -check (default $BEAM_PROFILE)")
+	dryRun := flags.Bool("n", false, "only print what would be pruned")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: beam prune [-older-than 720h] [-check [-profile NAME]] [-n]\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if *check {
+		s, err := loadSettings(*profile)
+		if err != nil {
+			return fmt.Errorf("reading config: %w", err)
+		}
+
+		useAPIKey(s.APIKey, s.Server)
+	}
+
+	history, err := loadHistory()
+	if err != nil {
+		return fmt.Errorf("reading history: %w", err)
+	}
+
+	now := time.Now()
+	pruned := make(map[string]bool)
+
+	for _, e := range history {
+		switch {
+		case e.expired(now):
+		case *olderThan > 0 && now.Sub(e.CreatedAt) > *olderThan:
+		case *check && uploadGone(e):
+		default:
+			continue
+		}
+
+		pruned[e.URL] = true
+
+		if *dryRun {
+			fmt.Printf("would prune %s\n", e.URL)
+		} else {
+			fmt.Printf("pruned %s\n", e.URL)
+		}
+	}
+
+	if *dryRun || len(pruned) == 0 {
+		return nil
+	}
+
+	return updateHistory(func(history []historyEntry) []historyEntry {
+		kept := history[:0]
+
+		for _, e := range history {
+			if !pruned[e.URL] {
+				kept = append(kept, e)
+			}
+		}
+
+		return kept
+	})
+}
+
+// uploadGone reports whether the server says an upload no longer exists.
+// Any other answer, including an error reaching the server, keeps it.
+func uploadGone(e historyEntry) bool {
+	server, uploadURL, _, err := parseUploadURL(e.uploadURL())
+	if err != nil {
+		return false
+	}
+
+	res, err := httpClient.Get(server + "/api/uploads/" + strings.TrimPrefix(uploadURL, server+"/u/"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: checking %s: %v\n", e.URL, err)
+		return false
+	}
+	res.Body.Close()
+
+	return res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusGone
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/elliota43/beam/internal/upload"
+)
+
+const (
+	// Files at least this large are sent through the resumable protocol so
+	// a dropped connection doesn't restart them from scratch.
+	resumableThreshold = 8 << 20
+	maxResumeAttempts  = 5
+)
+
+// resumeBackoff is how long an interrupted transfer first waits before
+// resuming. Each further attempt waits twice as long.
+var resumeBackoff = time.Second
+
+// uploadPartial sends a file with the server's resumable upload API and
+// returns the partial id to attach to the final upload. Failed transfers
+// are resumed from the offset the server reports.
+func uploadPartial(server string, file upload.UploadFile, size int64) (string, error) {
+	location, err := createPartial(server, file, size)
+	if err != nil {
+		return "", err
+	}
+
+	var offset int64
+	backoff := resumeBackoff
+
+	for attempt := 1; ; attempt++ {
+		// After an interruption the server may have kept some of the data,
+		// so ask where to resume. A failure here is retried like the PATCH.
+		if attempt > 1 {
+			offset, err = partialOffset(location)
+		}
+
+		if err == nil {
+			offset, err = patchPartial(location, file.AbsolutePath, offset, size)
+			if err == nil && offset == size {
+				return path.Base(location), nil
+			}
+
+			if err == nil {
+				err = fmt.Errorf("server acknowledged %d of %d bytes", offset, size)
+			}
+		}
+
+		if attempt == maxResumeAttempts {
+			return "", fmt.Errorf("uploading %s: %w", file.RelativePath, err)
+		}
+
+		wait := backoff
+		backoff *= 2
+
+		var limited rateLimited
+		if errors.As(err, &limited) {
+			wait = limited.wait
+		}
+
+		fmt.Fprintf(os.Stderr, "upload of %s interrupted (%v), resuming in %s\n", file.RelativePath, err, wait)
+		time.Sleep(wait)
+	}
+}
+
+func createPartial(server string, file upload.UploadFile, size int64) (string, error) {
+	metadata := "filename " + base64.StdEncoding.EncodeToString([]byte(file.RelativePath))
+	if contentType := mime.TypeByExtension(path.Ext(file.RelativePath)); contentType != "" {
+		metadata += ",filetype " + base64.StdEncoding.EncodeToString([]byte(contentType))
+	}
+
+	if !file.ModTime.IsZero() {
+		metadata += ",lastmodified " + base64.StdEncoding.EncodeToString([]byte(file.ModTime.UTC().Format(http.TimeFormat)))
+	}
+
+	res, err := doRetrying(maxResumeAttempts, func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, server+"/api/partials", nil)
+		if err != nil {
+			return nil, err
+		}
+
+		req.Header.Set("Tus-Resumable", upload.TusVersion)
+		req.Header.Set("Upload-Length", strconv.FormatInt(size, 10))
+		req.Header.Set("Upload-Metadata", metadata)
+
+		return req, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusCreated {
+		return "", responseError(res)
+	}
+
+	location, err := res.Location()
+	if err != nil {
+		return "", fmt.Errorf("server did not return a partial upload location")
+	}
+
+	return location.String(), nil
+}
+
+// patchPartial streams the file from offset and returns the offset the
+// server acknowledged.
+func patchPartial(location, filePath string, offset, size int64) (int64, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return offset, err
+	}
+	defer f.Close()
+
+	req, err := http.NewRequest(http.MethodPatch, location, io.NewSectionReader(f, offset, size-offset))
+	if err != nil {
+		return offset, err
+	}
+
+	req.ContentLength = size - offset
+	req.Header.Set("Tus-Resumable", upload.TusVersion)
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return offset, err
+	}
+	defer res.Body.Close()
+
+	if wait, ok := retryAfter(res); ok {
+		return offset, rateLimited{wait: wait}
+	}
+
+	if res.StatusCode != http.StatusNoContent {
+		return offset, responseError(res)
+	}
+
+	return strconv.ParseInt(res.Header.Get("Upload-Offset"), 10, 64)
+}
+
+func partialOffset(location string) (int64, error) {
+	res, err := doRetrying(maxResumeAttempts, func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodHead, location, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		req.Header.Set("Tus-Resumable", upload.TusVersion)
+
+		return req, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("server returned %s", res.Status)
+	}
+
+	return strconv.ParseInt(res.Header.Get("Upload-Offset"), 10, 64)
+}
+
+func responseError(res *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+	return fmt.Errorf("server returned %s: %s", res.Status, bytes.TrimSpace(msg))
+}
+
+// rateLimited is returned for a 429 Too Many Requests, with how long the
+// server asked the client to wait.
+type rateLimited struct {
+	wait time.Duration
+}
+
+func (e rateLimited) Error() string {
+	return fmt.Sprintf("rate limited by the server for %s", e.wait)
+}
+
+// retryAfter reports whether res is a 429 Too Many Requests and how long its
+// Retry-After header asks the client to wait.
+func retryAfter(res *http.Response) (time.Duration, bool) {
+	if res.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+
+	seconds, err := strconv.Atoi(res.Header.Get("Retry-After"))
+	if err != nil || seconds < 1 {
+		seconds = 1
+	}
+
+	return time.Duration(seconds) * time.Second, true
+}
+
+// doRetrying sends the request built by newRequest, waiting out the server's
+// Retry-After and sending a fresh one while it is rate limited, up to
+// attempts times in all.
+func doRetrying(attempts int, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		wait, limited := retryAfter(res)
+		if !limited || attempt >= attempts {
+			return res, nil
+		}
+
+		res.Body.Close()
+
+		fmt.Fprintf(os.Stderr, "rate limited by the server, retrying in %s\n", wait)
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elliota43/beam/internal/upload"
+)
+
+// tusServer is a minimal resumable upload server. Its hooks can fail
+// requests to act out dropped connections and outages.
+type tusServer struct {
+	t *testing.T
+
+	mu       sync.Mutex
+	partials map[string]*tusPartial
+	// created counts the partials created for each file name.
+	created map[string]int
+	// uploads holds the partial ids attached by each final upload.
+	uploads [][]string
+
+	// dropPatch, if set, reports whether to drop a PATCH to id after
+	// keeping n bytes of it.
+	dropPatch func(id string) (n int, drop bool)
+	// failHead, if set, reports whether to answer a HEAD with an error.
+	failHead func(id string) bool
+}
+
+type tusPartial struct {
+	name   string
+	length int64
+	data   []byte
+}
+
+func newTusServer(t *testing.T) (*tusServer, *httptest.Server) {
+	s := &tusServer{t: t, partials: make(map[string]*tusPartial), created: make(map[string]int)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/partials", s.create)
+	mux.HandleFunc("HEAD /api/partials/{id}", s.head)
+	mux.HandleFunc("PATCH /api/partials/{id}", s.patch)
+	mux.HandleFunc("POST /api/uploads", s.finish)
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	saved := resumeBackoff
+	resumeBackoff = time.Millisecond
+	t.Cleanup(func() { resumeBackoff = saved })
+
+	return s, server
+}
+
+func (s *tusServer) create(w http.ResponseWriter, r *http.Request) {
+	length, _ := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+
+	encoded := strings.TrimPrefix(strings.Split(r.Header.Get("Upload-Metadata"), ",")[0], "filename ")
+	name, _ := base64.StdEncoding.DecodeString(encoded)
+
+	s.mu.Lock()
+	id := fmt.Sprintf("p%d", len(s.partials))
+	s.partials[id] = &tusPartial{name: string(name), length: length}
+	s.created[string(name)]++
+	s.mu.Unlock()
+
+	w.Header().Set("Location", "http://"+r.Host+"/api/partials/"+id)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *tusServer) head(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	if s.failHead != nil && s.failHead(id) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	s.mu.Lock()
+	p := s.partials[id]
+	s.mu.Unlock()
+
+	w.Header().Set("Upload-Offset", strconv.Itoa(len(p.data)))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *tusServer) patch(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	s.mu.Lock()
+	p := s.partials[id]
+	s.mu.Unlock()
+
+	if offset, _ := strconv.Atoi(r.Header.Get("Upload-Offset")); offset != len(p.data) {
+		s.t.Errorf("PATCH of %s at offset %d, expected %d", p.name, offset, len(p.data))
+		http.Error(w, "wrong offset", http.StatusConflict)
+		return
+	}
+
+	if s.dropPatch != nil {
+		if n, drop := s.dropPatch(id); drop {
+			buf := make([]byte, n)
+			io.ReadFull(r.Body, buf)
+			p.data = append(p.data, buf...)
+
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				s.t.Fatal(err)
+			}
+			conn.Close()
+			return
+		}
+	}
+
+	data, _ := io.ReadAll(r.Body)
+	p.data = append(p.data, data...)
+
+	w.Header().Set("Upload-Offset", strconv.Itoa(len(p.data)))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *tusServer) finish(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	s.uploads = append(s.uploads, r.MultipartForm.Value["partial"])
+	s.mu.Unlock()
+
+	json.NewEncoder(w).Encode(uploadResponse{URL: "http://" + r.Host + "/u/abc"})
+}
+
+func TestUploadPartialResumesAfterDroppedPatch(t *testing.T) {
+	content := strings.Repeat("resumable beam ", 1000)
+
+	path := filepath.Join(t.TempDir(), "big.log")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tus, server := newTusServer(t)
+
+	var patches, heads int
+	tus.dropPatch = func(string) (int, bool) {
+		patches++
+		return len(content) / 3, patches == 1
+	}
+
+	// The first HEAD after the drop fails too, as if the server were still
+	// unreachable.
+	tus.failHead = func(string) bool {
+		heads++
+		return heads == 1
+	}
+
+	id, err := uploadPartial(server.URL, upload.UploadFile{AbsolutePath: path, RelativePath: "big.log"}, int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := string(tus.partials[id].data); got != content {
+		t.Fatalf("expected the whole file after resuming, got %d of %d bytes", len(got), len(content))
+	}
+
+	if patches != 2 || heads != 2 {
+		t.Fatalf("expected one dropped and one resumed PATCH after two HEADs, got %d PATCHes and %d HEADs", patches, heads)
+	}
+}
+
+func TestUploadPartialGivesUpAfterMaxAttempts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "big.log")
+	if err := os.WriteFile(path, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tus, server := newTusServer(t)
+
+	var heads int
+	tus.dropPatch = func(string) (int, bool) { return 0, true }
+	tus.failHead = func(string) bool {
+		heads++
+		return true
+	}
+
+	if _, err := uploadPartial(server.URL, upload.UploadFile{AbsolutePath: path, RelativePath: "big.log"}, 5); err == nil {
+		t.Fatal("expected the upload to fail")
+	}
+
+	if heads != maxResumeAttempts-1 {
+		t.Fatalf("expected a HEAD before each of %d retries, got %d", maxResumeAttempts-1, heads)
+	}
+}
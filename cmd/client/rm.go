@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/elliota43/beam/internal/upload"
+)
+
+// runRemove implements `beam rm <url>`, deleting an upload, or a single file
+// when given a file's URL.
+func runRemove(args []string) error {
+	flags := flag.NewFlagSet("rm", flag.ExitOnError)
+	token := flags.String("token", "", "owner token (default: the one saved when the upload was made)")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: beam rm [-token TOKEN] <upload-url|file-url>\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	server, uploadURL, filePath, err := parseUploadURL(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if *token == "" {
+		if *token, err = ownerToken(uploadURL); err != nil {
+			return fmt.Errorf("reading saved tokens: %w", err)
+		}
+
+		if *token == "" {
+			return fmt.Errorf("no saved owner token for %s; pass -token", uploadURL)
+		}
+	}
+
+	target := server + "/api/uploads/" + strings.TrimPrefix(uploadURL, server+"/u/")
+	if filePath != "" {
+		target += "/" + filePath
+	}
+
+	req, err := http.NewRequest(http.MethodDelete, target, nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set(upload.OwnerTokenHeader, *token)
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent {
+		return responseError(res)
+	}
+
+	if err := forgetRemoved(uploadURL, filePath); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: could not update the upload history: %v\n", err)
+	}
+
+	fmt.Printf("deleted %s\n", flags.Arg(0))
+	return nil
+}
+
+// parseUploadURL splits a URL such as http://host/u/{slug}/{path} into the
+// server's base URL, the upload's URL and the escaped path of a file within
+// it, which is empty for the upload itself.
+func parseUploadURL(raw string) (server, uploadURL, filePath string, err error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	base, rest, ok := strings.Cut(u.EscapedPath(), "/u/")
+	if !ok || u.Host == "" {
+		return "", "", "", fmt.Errorf("not a beam upload URL: %s", raw)
+	}
+
+	slug, filePath, _ := strings.Cut(rest, "/")
+	if slug == "" {
+		return "", "", "", fmt.Errorf("not a beam upload URL: %s", raw)
+	}
+
+	server = u.Scheme + "://" + u.Host + base
+	return server, server + "/u/" + slug, strings.TrimSuffix(filePath, "/"), nil
+}
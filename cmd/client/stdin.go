@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"slices"
+
+	"github.com/elliota43/beam/internal/upload"
+)
+
+// stdinPath stands for standard input among the paths to upload.
+const stdinPath = "-"
+
+// stdin is buffered so its first bytes can be sniffed before it is sent.
+var stdin = bufio.NewReader(os.Stdin)
+
+// collectFiles expands the paths to upload like upload.CollectFiles, adding
+// standard input as a file named name when "-" is among them. Without a
+// name, one is made up from the sniffed content type.
+func collectFiles(paths []string, name string) ([]upload.UploadFile, error) {
+	fromStdin := slices.Contains(paths, stdinPath)
+	paths = slices.DeleteFunc(slices.Clone(paths), func(p string) bool { return p == stdinPath })
+
+	if name != "" && !fromStdin {
+		return nil, errors.New("-name only applies when reading standard input")
+	}
+
+	files, err := upload.CollectFiles(paths)
+	if err != nil || !fromStdin {
+		return files, err
+	}
+
+	// Peek blocks until the sniffing window is full or input ends, and
+	// leaves the bytes in place to be sent.
+	head, err := stdin.Peek(512)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, err
+	}
+
+	contentType := http.DetectContentType(head)
+	if name == "" {
+		name = stdinName(contentType)
+	}
+
+	return append(files, upload.UploadFile{
+		AbsolutePath: stdinPath,
+		RelativePath: name,
+		ContentType:  contentType,
+	}), nil
+}
+
+// stdinName names standard input after its content type, e.g. stdin.txt.
+func stdinName(contentType string) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+
+	switch mediaType {
+	case "text/plain":
+		return "stdin.txt"
+	case "application/octet-stream":
+		return "stdin"
+	}
+
+	if exts, _ := mime.ExtensionsByType(mediaType); len(exts) > 0 {
+		return "stdin" + exts[0]
+	}
+
+	return "stdin"
+}
+
+// stdinHasData reports whether standard input is a pipe or file with
+// something to read. Terminals, /dev/null and empty input are not.
+func stdinHasData() bool {
+	fi, err := os.Stdin.Stat()
+	if err != nil {
+		return false
+	}
+
+	mode := fi.Mode()
+	if mode&os.ModeNamedPipe == 0 && !(mode.IsRegular() && fi.Size() > 0) {
+		return false
+	}
+
+	// Wait for the first byte so a pipe closed without writing anything
+	// counts as empty.
+	_, err = stdin.Peek(1)
+	return err == nil
+}
+
+// openFile opens a file to upload, which may be standard input.
+func openFile(p string) (io.ReadCloser, error) {
+	if p == stdinPath {
+		return io.NopCloser(stdin), nil
+	}
+
+	return os.Open(p)
+}
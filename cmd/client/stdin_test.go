@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeStdin makes standard input read data for the rest of the test.
+func fakeStdin(t *testing.T, data string) {
+	t.Helper()
+
+	saved := stdin
+	stdin = bufio.NewReader(strings.NewReader(data))
+	t.Cleanup(func() { stdin = saved })
+}
+
+func TestStdinName(t *testing.T) {
+	tests := map[string]string{
+		"text/plain; charset=utf-8": "stdin.txt",
+		"application/octet-stream":  "stdin",
+		"image/png":                 "stdin.png",
+		"application/pdf":           "stdin.pdf",
+		"application/x-unknown":     "stdin",
+		"":                          "stdin",
+	}
+
+	for contentType, want := range tests {
+		if got := stdinName(contentType); got != want {
+			t.Errorf("stdinName(%q) = %q, want %q", contentType, got, want)
+		}
+	}
+}
+
+func TestCollectFiles(t *testing.T) {
+	dir := t.TempDir()
+	notes := filepath.Join(dir, "notes.md")
+	if err := os.WriteFile(notes, []byte("# notes"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	png := "\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 16)
+
+	tests := []struct {
+		name  string
+		paths []string
+		flag  string
+		input string
+		// want lists the uploaded paths, with standard input last.
+		want        []string
+		contentType string
+		wantErr     bool
+	}{
+		{name: "text", paths: []string{"-"}, input: "hello\n", want: []string{"stdin.txt"}, contentType: "text/plain; charset=utf-8"},
+		{name: "sniffed extension", paths: []string{"-"}, input: png, want: []string{"stdin.png"}, contentType: "image/png"},
+		{name: "empty", paths: []string{"-"}, want: []string{"stdin.txt"}, contentType: "text/plain; charset=utf-8"},
+		{name: "named", paths: []string{"-"}, flag: "dmesg.log", input: "hello\n", want: []string{"dmesg.log"}, contentType: "text/plain; charset=utf-8"},
+		{name: "with files", paths: []string{notes, "-"}, input: "hello\n", want: []string{"notes.md", "stdin.txt"}, contentType: "text/plain; charset=utf-8"},
+		{name: "files only", paths: []string{notes}, want: []string{"notes.md"}},
+		{name: "name without stdin", paths: []string{notes}, flag: "x.txt", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeStdin(t, tt.input)
+
+			files, err := collectFiles(tt.paths, tt.flag)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, f := range files {
+				got = append(got, f.RelativePath)
+			}
+
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Fatalf("expected %v, got %v", tt.want, got)
+			}
+
+			last := files[len(files)-1]
+			if last.AbsolutePath == stdinPath && last.ContentType != tt.contentType {
+				t.Fatalf("expected content type %q, got %q", tt.contentType, last.ContentType)
+			}
+		})
+	}
+}
+
+func TestCollectFilesLeavesStdinToBeSent(t *testing.T) {
+	fakeStdin(t, "hello\n")
+
+	files, err := collectFiles([]string{"-"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := openFile(files[0].AbsolutePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "hello\n" {
+		t.Fatalf("expected sniffing to leave the input intact, got %q", data)
+	}
+}
@@ -1,29 +1,308 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/elliota43/beam/internal/ratelimit"
+	"github.com/elliota43/beam/internal/storage"
 	"github.com/elliota43/beam/internal/upload"
 )
 
 func main() {
+	// Commands other than serving take the same flags, so they find the
+	// same storage and index. The command may come before or after them.
+	command, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
 	addr := flag.String("addr", ":9001", "server listen address")
 	baseURL := flag.String("base-url", "http://localhost:9001", "public base URL used in returned links")
 	storageDir := flag.String("storage", "./data/uploads", "directory where uploaded files are stored")
-	flag.Parse()
+	indexPath := flag.String("index", "", "bbolt file indexing upload metadata (default: index.db in -storage, or \"off\" with -s3-bucket); \"off\" keeps a metadata.json beside each upload")
+	s3Endpoint := flag.String("s3-endpoint", "https://s3.amazonaws.com", "S3-compatible endpoint URL")
+	s3Bucket := flag.String("s3-bucket", "", "store uploads in this S3 bucket instead of -storage; credentials come from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	s3Region := flag.String("s3-region", "us-east-1", "S3 region")
+	s3Prefix := flag.String("s3-prefix", "", "key prefix for objects in the S3 bucket")
+	s3PathStyle := flag.Bool("s3-path-style", true, "address the bucket as {endpoint}/{bucket} rather than {bucket}.{endpoint}")
+	partialsDir := flag.String("partials-dir", "", "directory where resumable uploads are staged until attached (default: .partials in -storage); required with -s3-bucket, and must persist across restarts")
+	partialTTL := flag.Duration("partial-ttl", 24*time.Hour, "how long an idle resumable upload is kept before it expires")
+	maxFileSize := flag.Int64("max-file-size", 100<<20, "maximum size in bytes of a single uploaded file")
+	maxUploadSize := flag.Int64("max-upload-size", 1<<30, "maximum size in bytes of a whole upload request")
+	defaultExpiry := flag.Duration("default-expiry", 7*24*time.Hour, "how long uploads are kept when the client does not ask for a lifetime; 0 keeps them forever")
+	maxExpiry := flag.Duration("max-expiry", 30*24*time.Hour, "longest lifetime a client may ask for; 0 for no limit")
+	apiKeysFile := flag.String("api-keys", "", "file of \"identity key\" lines; when set, uploads require one of the keys as a bearer token")
+	privateReads := flag.Bool("private-reads", false, "also require an API key to view and download uploads")
+	limitUploads := flag.String("limit-uploads", "", "uploads each client may create, as N/window, e.g. 60/1h")
+	limitUploadBytes := flag.String("limit-upload-bytes", "", "bytes each client may upload, as size/window, e.g. 10GiB/24h")
+	limitDownloads := flag.String("limit-downloads", "", "view and download requests each client may make, as N/window, e.g. 600/1m")
+	quota := flag.Int64("quota", 0, "bytes each API key identity may keep stored, with anonymous uploads sharing one allowance; 0 for no quota")
+	minFreeSpace := flag.Int64("min-free-space", 0, "refuse uploads with 507 when the -storage disk has less than this many bytes free; 0 disables the check")
+	repair := flag.Bool("repair", false, "fsck: fix the problems found, deleting orphaned and corrupt objects")
+	quarantine := flag.Bool("quarantine", false, "fsck: with -repair, move orphaned and corrupt objects under quarantine/ instead of deleting them")
+	trustedProxies := flag.String("trusted-proxies", "", "comma-separated addresses or CIDRs of proxies whose X-Forwarded-For is trusted")
+	flag.CommandLine.Parse(args)
+
+	if command == "serve" && flag.NArg() > 0 {
+		command = flag.Arg(0)
+		flag.CommandLine.Parse(flag.Args()[1:])
+	}
+
+	if flag.NArg() > 0 {
+		log.Fatalf("unexpected arguments: %v", flag.Args())
+	}
 
 	h := upload.NewHandler(*baseURL, *storageDir)
+	h.MaxFileSize = *maxFileSize
+	h.MaxUploadSize = *maxUploadSize
+	h.PartialTTL = *partialTTL
+	h.DefaultExpiry = *defaultExpiry
+	h.MaxExpiry = *maxExpiry
+	h.Quota = *quota
+	h.MinFreeSpace = *minFreeSpace
+
+	if *apiKeysFile != "" {
+		keys, err := upload.LoadAPIKeys(*apiKeysFile)
+		if err != nil {
+			log.Fatalf("loading API keys: %v", err)
+		}
+
+		h.APIKeys = keys
+	}
+
+	h.Limits.Uploads = parseLimit("limit-uploads", *limitUploads)
+	h.Limits.UploadBytes = parseLimit("limit-upload-bytes", *limitUploadBytes)
+	h.Limits.Downloads = parseLimit("limit-downloads", *limitDownloads)
+
+	proxies, err := ratelimit.ParsePrefixes(*trustedProxies)
+	if err != nil {
+		log.Fatalf("-trusted-proxies: %v", err)
+	}
+
+	h.Limits.TrustedProxies = proxies
+
+	if *partialsDir != "" {
+		h.PartialsDir = *partialsDir
+	}
+
+	if *s3Bucket != "" {
+		// Partials are appended to in place, which a bucket cannot do, so
+		// they stay on local disk. -storage is only scratch space next to
+		// a bucket, so make sure they are put somewhere that lasts.
+		if *partialsDir == "" {
+			log.Fatal("-s3-bucket needs -partials-dir: resumable uploads are staged on local disk, which must persist across restarts")
+		}
+
+		h.Store = &storage.S3{
+			Endpoint:  *s3Endpoint,
+			Bucket:    *s3Bucket,
+			Region:    *s3Region,
+			Prefix:    *s3Prefix,
+			AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			PathStyle: *s3PathStyle,
+		}
+	}
+
+	if *indexPath == "" {
+		*indexPath = filepath.Join(*storageDir, "index.db")
+
+		// -storage is only scratch space next to a bucket, so the index
+		// must be asked for explicitly.
+		if *s3Bucket != "" {
+			*indexPath = "off"
+		}
+	}
+
+	var index *upload.BoltIndex
+
+	if *indexPath != "off" {
+		if err := os.MkdirAll(filepath.Dir(*indexPath), 0755); err != nil {
+			log.Fatal(err)
+		}
+
+		index, err = upload.OpenBoltIndex(*indexPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer index.Close()
+
+		h.Index = index
+	}
+
+	if command == "migrate" {
+		migrate(h, index, *indexPath)
+		return
+	}
+
+	if index != nil {
+		if err := upload.CheckImported(context.Background(), h.Store, index); err != nil {
+			log.Fatalf("%v; import them with `%s migrate` and the same flags", err, filepath.Base(os.Args[0]))
+		}
+	}
+
+	switch command {
+	case "serve":
+	case "fsck":
+		if !fsck(h, upload.FsckOptions{Repair: *repair, Quarantine: *quarantine}) {
+			os.Exit(1)
+		}
+		return
+	default:
+		log.Fatalf("unknown command %q; expected migrate, fsck or none", command)
+	}
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("POST /api/uploads", h.CreateUpload)
-	mux.HandleFunc("GET /u/", h.ServeUpload)
+	// Rate limits are checked before API keys so that requests with a
+	// wrong key are throttled too; clients with a valid key are still
+	// limited by key rather than by address. Deleting needs the upload's
+	// owner token rather than an API key.
+	mux.HandleFunc("POST /api/uploads", h.LimitUploads(h.RequireAPIKey(h.CreateUpload)))
+	mux.HandleFunc("DELETE /api/uploads/", h.DeleteUpload)
+	mux.HandleFunc("GET /api/quota", h.LimitDownloads(h.RequireAPIKey(h.ServeQuota)))
+
+	read := func(next http.HandlerFunc) http.HandlerFunc { return next }
+	if *privateReads {
+		read = h.RequireAPIKey
+	}
+
+	mux.HandleFunc("GET /u/", h.LimitDownloads(read(h.ServeUpload)))
+	mux.HandleFunc("GET /raw/", h.LimitDownloads(read(h.ServeRaw)))
+	mux.HandleFunc("GET /api/uploads/", h.LimitDownloads(read(h.ServeUploadInfo)))
+	// Password attempts count as downloads so they are throttled too.
+	mux.HandleFunc("POST /u/", h.LimitDownloads(read(h.UnlockUpload)))
+
+	mux.HandleFunc("OPTIONS /api/partials", h.PartialOptions)
+	// Partials only count towards the byte limit. The upload that claims
+	// them is charged once by LimitUploads on POST /api/uploads.
+	mux.HandleFunc("POST /api/partials", h.LimitUploadBytes(h.RequireAPIKey(h.CreatePartial)))
+	mux.HandleFunc("HEAD /api/partials/{id}", h.LimitDownloads(h.RequireAPIKey(h.HeadPartial)))
+	mux.HandleFunc("PATCH /api/partials/{id}", h.LimitUploadBytes(h.RequireAPIKey(h.PatchPartial)))
+	mux.HandleFunc("DELETE /api/partials/{id}", h.LimitDownloads(h.RequireAPIKey(h.DeletePartial)))
+
+	go expirePartials(h, 10*time.Minute)
+	go expireUploads(h, time.Minute)
+	go collectGarbage(h, time.Hour)
 
 	log.Printf("beam server listening on%s", *addr)
-	log.Printf("storing uploads in %s", *storageDir)
+	if index != nil {
+		log.Printf("indexing upload metadata in %s", *indexPath)
+	}
+
+	if *s3Bucket != "" {
+		log.Printf("storing uploads in s3 bucket %s at %s (partial uploads in %s)", *s3Bucket, *s3Endpoint, h.PartialsDir)
+	} else {
+		log.Printf("storing uploads in %s", *storageDir)
+	}
 
 	if err := http.ListenAndServe(*addr, mux); err != nil {
 		log.Fatal(err)
 	}
 }
+
+// parseLimit builds a rate limiter from a flag value, or returns nil when
+// the flag is unset.
+func parseLimit(name, value string) *ratelimit.Limiter {
+	if value == "" {
+		return nil
+	}
+
+	rate, err := ratelimit.ParseRate(value)
+	if err != nil {
+		log.Fatalf("-%s: %v", name, err)
+	}
+
+	return ratelimit.New(rate)
+}
+
+// migrate imports the metadata.json of every upload into the index, keeping
+// the originals as metadata.json.migrated.
+func migrate(h *upload.Handler, index *upload.BoltIndex, indexPath string) {
+	if index == nil {
+		log.Fatal("migrate needs an index; pass -index")
+	}
+
+	n, err := upload.ImportMetadata(context.Background(), h.Store, index)
+	if err != nil {
+		log.Fatalf("importing metadata: %v", err)
+	}
+
+	log.Printf("imported %d uploads into %s", n, indexPath)
+}
+
+// fsck checks storage against the index, printing each problem found, and
+// reports whether everything was consistent or has been repaired.
+func fsck(h *upload.Handler, opts upload.FsckOptions) bool {
+	problems, err := h.Fsck(context.Background(), time.Now(), opts)
+
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+
+	if err != nil {
+		log.Printf("fsck: %v", err)
+		return false
+	}
+
+	switch {
+	case len(problems) == 0:
+		log.Print("fsck: no problems found")
+	case opts.Repair:
+		log.Printf("fsck: repaired %d problems", len(problems))
+	default:
+		log.Printf("fsck: found %d problems; run again with -repair to fix them", len(problems))
+		return false
+	}
+
+	return true
+}
+
+func expirePartials(h *upload.Handler, interval time.Duration) {
+	for range time.Tick(interval) {
+		removed, err := h.ExpirePartials(time.Now())
+		if err != nil {
+			log.Printf("expiring partial uploads: %v", err)
+			continue
+		}
+
+		if removed > 0 {
+			log.Printf("expired %d abandoned partial uploads", removed)
+		}
+	}
+}
+
+func expireUploads(h *upload.Handler, interval time.Duration) {
+	for range time.Tick(interval) {
+		removed, err := h.ExpireUploads(context.Background(), time.Now())
+		if err != nil {
+			log.Printf("expiring uploads: %v", err)
+			continue
+		}
+
+		if removed > 0 {
+			log.Printf("removed %d expired uploads", removed)
+		}
+	}
+}
+
+func collectGarbage(h *upload.Handler, interval time.Duration) {
+	for range time.Tick(interval) {
+		removed, err := h.CollectGarbage(context.Background(), time.Now())
+		if err != nil {
+			log.Printf("collecting unreferenced blobs: %v", err)
+			continue
+		}
+
+		if removed > 0 {
+			log.Printf("removed %d unreferenced blobs", removed)
+		}
+	}
+}
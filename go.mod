@@ -1,3 +1,11 @@
 module github.com/elliota43/beam
 
 go 1.26.2
+
+require (
+	go.etcd.io/bbolt v1.4.3
+	golang.org/x/crypto v0.54.0
+	golang.org/x/term v0.45.0
+)
+
+require golang.org/x/sys v0.47.0 // indirect
@@ -0,0 +1,202 @@
+// Package crypt implements beam's end-to-end encryption format. Files and
+// their names are encrypted by the client with a random key that is only
+// ever shared in the fragment of the upload's URL, so the server stores and
+// serves ciphertext it cannot read.
+//
+// Everything uses AES-256-GCM so browsers can decrypt with WebCrypto. A file
+// is an 8 byte random nonce prefix followed by the plaintext sealed in
+// ChunkSize chunks. Chunk i uses the nonce prefix || uint32(i) and carries
+// a single byte of additional data, 1 for the last chunk and 0 otherwise,
+// so truncating or reordering chunks fails to decrypt. Every chunk but the
+// last holds exactly ChunkSize bytes of plaintext; the last holds fewer,
+// possibly none.
+package crypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	KeySize   = 32
+	ChunkSize = 64 << 10
+
+	prefixSize = 8
+	nonceSize  = 12
+	tagSize    = 16
+)
+
+// nameData is the additional data sealed with encrypted names, keeping them
+// from being confused with file chunks.
+var nameData = []byte("beam-name")
+
+var ErrDecrypt = errors.New("decryption failed: wrong key or corrupted data")
+
+// Key is a file encryption key.
+type Key [KeySize]byte
+
+// NewKey returns a random key.
+func NewKey() Key {
+	var k Key
+	rand.Read(k[:])
+	return k
+}
+
+// ParseKey decodes a key from the form returned by Key.String.
+func ParseKey(s string) (Key, error) {
+	var k Key
+
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) != KeySize {
+		return k, fmt.Errorf("invalid encryption key")
+	}
+
+	copy(k[:], b)
+	return k, nil
+}
+
+// String encodes the key for use in a URL fragment.
+func (k Key) String() string {
+	return base64.RawURLEncoding.EncodeToString(k[:])
+}
+
+func (k Key) aead() cipher.AEAD {
+	block, err := aes.NewCipher(k[:])
+	if err != nil {
+		panic(err) // only fails for bad key sizes
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+
+	return aead
+}
+
+// EncryptedSize returns the size of a file of n bytes once encrypted.
+func EncryptedSize(n int64) int64 {
+	return prefixSize + n + (n/ChunkSize+1)*tagSize
+}
+
+// DecryptedSize returns the size of the plaintext of an encrypted file of n
+// bytes.
+func DecryptedSize(n int64) int64 {
+	chunks := (n - prefixSize + ChunkSize + tagSize - 1) / (ChunkSize + tagSize)
+	return n - prefixSize - chunks*tagSize
+}
+
+// Encrypt reads src to the end and writes it encrypted to dst.
+func Encrypt(dst io.Writer, src io.Reader, key Key) error {
+	aead := key.aead()
+
+	nonce := make([]byte, nonceSize)
+	rand.Read(nonce[:prefixSize])
+
+	if _, err := dst.Write(nonce[:prefixSize]); err != nil {
+		return err
+	}
+
+	buf := make([]byte, ChunkSize, ChunkSize+tagSize)
+
+	for i := uint32(0); ; i++ {
+		n, err := io.ReadFull(src, buf)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return err
+		}
+
+		last := n < ChunkSize
+		binary.BigEndian.PutUint32(nonce[prefixSize:], i)
+
+		if _, err := dst.Write(aead.Seal(buf[:0], nonce, buf[:n], chunkData(last))); err != nil {
+			return err
+		}
+
+		if last {
+			return nil
+		}
+	}
+}
+
+// Decrypt reads an encrypted file from src to the end and writes the
+// plaintext to dst. Data written before an error is returned has been
+// authenticated, but the file as a whole has not.
+func Decrypt(dst io.Writer, src io.Reader, key Key) error {
+	aead := key.aead()
+
+	nonce := make([]byte, nonceSize)
+	if _, err := io.ReadFull(src, nonce[:prefixSize]); err != nil {
+		return ErrDecrypt
+	}
+
+	// Read one byte past each chunk to tell whether it is the last.
+	buf := make([]byte, ChunkSize+tagSize+1)
+	have := 0
+
+	for i := uint32(0); ; i++ {
+		n, err := io.ReadFull(src, buf[have:])
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return err
+		}
+
+		have += n
+		last := have <= ChunkSize+tagSize
+
+		chunk := buf[:min(have, ChunkSize+tagSize)]
+		binary.BigEndian.PutUint32(nonce[prefixSize:], i)
+
+		plain, err := aead.Open(nil, nonce, chunk, chunkData(last))
+		if err != nil {
+			return ErrDecrypt
+		}
+
+		if _, err := dst.Write(plain); err != nil {
+			return err
+		}
+
+		if last {
+			return nil
+		}
+
+		have = copy(buf, buf[len(chunk):have])
+	}
+}
+
+func chunkData(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+
+	return []byte{0}
+}
+
+// EncryptName encrypts a file's path into a string that is safe to use as
+// a single path segment.
+func EncryptName(key Key, name string) string {
+	nonce := make([]byte, nonceSize)
+	rand.Read(nonce)
+
+	sealed := key.aead().Seal(nonce, nonce, []byte(name), nameData)
+	return base64.RawURLEncoding.EncodeToString(sealed)
+}
+
+// DecryptName reverses EncryptName.
+func DecryptName(key Key, encrypted string) (string, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(encrypted)
+	if err != nil || len(sealed) < nonceSize {
+		return "", ErrDecrypt
+	}
+
+	name, err := key.aead().Open(nil, sealed[:nonceSize], sealed[nonceSize:], nameData)
+	if err != nil {
+		return "", ErrDecrypt
+	}
+
+	return string(name), nil
+}
@@ -0,0 +1,103 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+func TestEncryptRoundTrip(t *testing.T) {
+	key := NewKey()
+
+	for _, size := range []int{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1, 3 * ChunkSize} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+
+		var sealed bytes.Buffer
+		if err := Encrypt(&sealed, bytes.NewReader(plain), key); err != nil {
+			t.Fatal(err)
+		}
+
+		if got, want := int64(sealed.Len()), EncryptedSize(int64(size)); got != want {
+			t.Fatalf("size %d: expected %d encrypted bytes, got %d", size, want, got)
+		}
+
+		if got := DecryptedSize(int64(sealed.Len())); got != int64(size) {
+			t.Fatalf("size %d: expected DecryptedSize to undo EncryptedSize, got %d", size, got)
+		}
+
+		var opened bytes.Buffer
+		if err := Decrypt(&opened, bytes.NewReader(sealed.Bytes()), key); err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+
+		if !bytes.Equal(opened.Bytes(), plain) {
+			t.Fatalf("size %d: decrypted data does not match", size)
+		}
+	}
+}
+
+func TestDecryptRejectsTampering(t *testing.T) {
+	key := NewKey()
+
+	plain := make([]byte, 2*ChunkSize+10)
+
+	var sealed bytes.Buffer
+	if err := Encrypt(&sealed, bytes.NewReader(plain), key); err != nil {
+		t.Fatal(err)
+	}
+
+	data := sealed.Bytes()
+
+	flipped := bytes.Clone(data)
+	flipped[len(flipped)/2] ^= 1
+
+	for name, input := range map[string][]byte{
+		"truncated at a chunk": data[:prefixSize+2*(ChunkSize+tagSize)],
+		"truncated mid-chunk":  data[:len(data)-1],
+		"flipped bit":          flipped,
+		"empty":                nil,
+	} {
+		if err := Decrypt(&bytes.Buffer{}, bytes.NewReader(input), key); !errors.Is(err, ErrDecrypt) {
+			t.Fatalf("%s: expected ErrDecrypt, got %v", name, err)
+		}
+	}
+
+	if err := Decrypt(&bytes.Buffer{}, bytes.NewReader(data), NewKey()); !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("wrong key: expected ErrDecrypt, got %v", err)
+	}
+}
+
+func TestNames(t *testing.T) {
+	key := NewKey()
+
+	encrypted := EncryptName(key, "docs/secret plans.txt")
+	if bytes.ContainsAny([]byte(encrypted), "/ ") {
+		t.Fatalf("expected a single path segment, got %q", encrypted)
+	}
+
+	name, err := DecryptName(key, encrypted)
+	if err != nil || name != "docs/secret plans.txt" {
+		t.Fatalf("expected the name back, got %q, %v", name, err)
+	}
+
+	if _, err := DecryptName(NewKey(), encrypted); err == nil {
+		t.Fatal("expected the wrong key to fail")
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	key := NewKey()
+
+	parsed, err := ParseKey(key.String())
+	if err != nil || parsed != key {
+		t.Fatalf("expected the key back, got %v, %v", parsed, err)
+	}
+
+	for _, s := range []string{"", "short", key.String() + "AA"} {
+		if _, err := ParseKey(s); err == nil {
+			t.Fatalf("expected %q to be rejected", s)
+		}
+	}
+}
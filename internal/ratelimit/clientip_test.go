@@ -0,0 +1,50 @@
+package ratelimit
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted, err := ParsePrefixes("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		remote string
+		xff    []string
+		want   string
+	}{
+		// Headers from untrusted clients are ignored.
+		{"203.0.113.9:4000", []string{"1.2.3.4"}, "203.0.113.9"},
+		{"10.0.0.5:4000", nil, "10.0.0.5"},
+		{"10.0.0.5:4000", []string{"198.51.100.7"}, "198.51.100.7"},
+		// A client cannot hide behind an address it prepends itself.
+		{"10.0.0.5:4000", []string{"1.2.3.4, 198.51.100.7, 192.168.1.1"}, "198.51.100.7"},
+		{"10.0.0.5:4000", []string{"1.2.3.4", "198.51.100.7"}, "198.51.100.7"},
+		{"10.0.0.5:4000", []string{"garbage, 10.0.0.9"}, "10.0.0.9"},
+		{"[::ffff:203.0.113.9]:4000", nil, "203.0.113.9"},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = c.remote
+
+		for _, v := range c.xff {
+			req.Header.Add("X-Forwarded-For", v)
+		}
+
+		if got := ClientIP(req, trusted); got != c.want {
+			t.Fatalf("%s %v: expected %s, got %s", c.remote, c.xff, c.want, got)
+		}
+	}
+}
+
+func TestParsePrefixesRejectsGarbage(t *testing.T) {
+	for _, input := range []string{"10.0.0.0/33", "not-an-ip", "10.0.0.1/8/2"} {
+		if _, err := ParsePrefixes(input); err == nil {
+			t.Fatalf("expected %q to be rejected", input)
+		}
+	}
+}
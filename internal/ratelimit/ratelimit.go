@@ -0,0 +1,167 @@
+// Package ratelimit provides per-client token buckets for throttling
+// requests and bytes.
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rate is an allowance of N tokens per Window. A bucket holds at most N
+// tokens and refills continuously at N per Window.
+type Rate struct {
+	N      float64
+	Window time.Duration
+}
+
+// ParseRate parses rates such as "60/1m" or "10GiB/24h". Byte sizes may use
+// K, M, G or T suffixes, which are powers of 1024.
+func ParseRate(s string) (Rate, error) {
+	count, window, ok := strings.Cut(strings.TrimSpace(s), "/")
+	if !ok {
+		return Rate{}, fmt.Errorf("invalid rate %q: expected N/window, e.g. 60/1m", s)
+	}
+
+	n, err := parseSize(count)
+	if err != nil || n <= 0 {
+		return Rate{}, fmt.Errorf("invalid rate %q: bad count %q", s, count)
+	}
+
+	d, err := time.ParseDuration(window)
+	if err != nil || d <= 0 {
+		return Rate{}, fmt.Errorf("invalid rate %q: bad window %q", s, window)
+	}
+
+	return Rate{N: n, Window: d}, nil
+}
+
+func parseSize(s string) (float64, error) {
+	s = strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(s), "B"), "I")
+
+	multiplier := 1.0
+	if s != "" {
+		if i := strings.IndexByte("KMGT", s[len(s)-1]); i >= 0 {
+			multiplier = math.Pow(1024, float64(i+1))
+			s = s[:len(s)-1]
+		}
+	}
+
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return n * multiplier, nil
+}
+
+// Limiter keeps a token bucket per key, such as a client address.
+type Limiter struct {
+	rate Rate
+	now  func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	ops     int
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// pruneEvery is how many operations pass between sweeps for idle buckets.
+const pruneEvery = 1024
+
+func New(rate Rate) *Limiter {
+	return &Limiter{
+		rate:    rate,
+		now:     time.Now,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Take removes n tokens from key's bucket. If the bucket holds fewer than n
+// it is left untouched and Take returns how long until it will hold enough.
+func (l *Limiter) Take(key string, n float64) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b := l.bucket(key)
+
+	if b.tokens < n {
+		return l.until(b, n)
+	}
+
+	b.tokens -= n
+	return 0
+}
+
+// Charge removes n tokens from key's bucket even if that leaves it in debt.
+// It is for costs, like bytes read from a streamed body, that are only
+// known once they have been incurred.
+func (l *Limiter) Charge(key string, n float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.bucket(key).tokens -= n
+}
+
+// Debt returns how long until key's bucket is out of debt, or 0 if it is
+// not in debt.
+func (l *Limiter) Debt(key string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b := l.bucket(key)
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return l.until(b, 0)
+}
+
+// bucket returns key's bucket refilled up to now. The caller must hold mu.
+func (l *Limiter) bucket(key string) *bucket {
+	now := l.now()
+
+	l.ops++
+	if l.ops%pruneEvery == 0 {
+		l.prune(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.rate.N, updated: now}
+		l.buckets[key] = b
+		return b
+	}
+
+	elapsed := now.Sub(b.updated)
+	b.tokens = min(l.rate.N, b.tokens+elapsed.Seconds()*l.perSecond())
+	b.updated = now
+
+	return b
+}
+
+// until returns how long b takes to refill to n tokens.
+func (l *Limiter) until(b *bucket, n float64) time.Duration {
+	return time.Duration((n - b.tokens) / l.perSecond() * float64(time.Second))
+}
+
+func (l *Limiter) perSecond() float64 {
+	return l.rate.N / l.rate.Window.Seconds()
+}
+
+// prune drops buckets that have been idle long enough to be full again,
+// which behave exactly like missing ones.
+func (l *Limiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		if now.Sub(b.updated) >= l.until(b, l.rate.N) {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestLimiter(rate Rate) (*Limiter, *time.Time) {
+	now := time.Unix(1_700_000_000, 0)
+
+	l := New(rate)
+	l.now = func() time.Time { return now }
+
+	return l, &now
+}
+
+func TestParseRate(t *testing.T) {
+	cases := map[string]Rate{
+		"60/1m":     {N: 60, Window: time.Minute},
+		"10GiB/24h": {N: 10 << 30, Window: 24 * time.Hour},
+		"512k/1s":   {N: 512 << 10, Window: time.Second},
+		"1.5M/1h":   {N: 1.5 * (1 << 20), Window: time.Hour},
+	}
+
+	for input, want := range cases {
+		got, err := ParseRate(input)
+		if err != nil {
+			t.Fatalf("%q: %v", input, err)
+		}
+
+		if got != want {
+			t.Fatalf("%q: expected %+v, got %+v", input, want, got)
+		}
+	}
+
+	for _, input := range []string{"", "60", "60/", "/1m", "0/1m", "60/0s", "-1/1m", "lots/1m"} {
+		if _, err := ParseRate(input); err == nil {
+			t.Fatalf("expected %q to be rejected", input)
+		}
+	}
+}
+
+func TestTakeRefillsOverTime(t *testing.T) {
+	l, now := newTestLimiter(Rate{N: 2, Window: time.Minute})
+
+	for i := 0; i < 2; i++ {
+		if wait := l.Take("a", 1); wait != 0 {
+			t.Fatalf("expected token %d to be available, got wait %s", i, wait)
+		}
+	}
+
+	if wait := l.Take("a", 1); wait != 30*time.Second {
+		t.Fatalf("expected to wait 30s for the next token, got %s", wait)
+	}
+
+	if wait := l.Take("b", 1); wait != 0 {
+		t.Fatalf("expected other keys to have their own bucket, got wait %s", wait)
+	}
+
+	*now = now.Add(30 * time.Second)
+
+	if wait := l.Take("a", 1); wait != 0 {
+		t.Fatalf("expected a token after refilling, got wait %s", wait)
+	}
+
+	*now = now.Add(time.Hour)
+	l.Take("a", 0)
+
+	if got := l.buckets["a"].tokens; got != 2 {
+		t.Fatalf("expected bucket to refill only up to its size, got %v", got)
+	}
+}
+
+func TestChargeGoesIntoDebt(t *testing.T) {
+	l, now := newTestLimiter(Rate{N: 100, Window: 100 * time.Second})
+
+	if wait := l.Debt("a"); wait != 0 {
+		t.Fatalf("expected no debt, got %s", wait)
+	}
+
+	l.Charge("a", 150)
+
+	if wait := l.Debt("a"); wait != 50*time.Second {
+		t.Fatalf("expected 50s of debt, got %s", wait)
+	}
+
+	*now = now.Add(50 * time.Second)
+
+	if wait := l.Debt("a"); wait != 0 {
+		t.Fatalf("expected debt to be paid off, got %s", wait)
+	}
+}
+
+func TestPruneDropsFullBuckets(t *testing.T) {
+	l, now := newTestLimiter(Rate{N: 1, Window: time.Second})
+
+	l.Take("idle", 1)
+	*now = now.Add(time.Minute)
+
+	for i := 0; i < pruneEvery; i++ {
+		l.Take("busy", 0)
+	}
+
+	if _, ok := l.buckets["idle"]; ok {
+		t.Fatal("expected idle bucket to be pruned")
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !(linux || darwin || freebsd)
+
+package storage
+
+import "errors"
+
+// ErrFreeSpaceUnsupported is returned by FreeSpace on platforms where it
+// has not been implemented.
+var ErrFreeSpaceUnsupported = errors.New("free space is not supported on this platform")
+
+// FreeSpace returns the bytes available to unprivileged users on the file
+// system holding dir.
+func FreeSpace(dir string) (int64, error) {
+	return 0, ErrFreeSpaceUnsupported
+}
@@ -0,0 +1,16 @@
+//go:build linux || darwin || freebsd
+
+package storage
+
+import "syscall"
+
+// FreeSpace returns the bytes available to unprivileged users on the file
+// system holding dir.
+func FreeSpace(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
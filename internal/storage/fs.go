@@ -0,0 +1,331 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FS stores objects as files under Root, one file per key. This is the
+// layout beam has always used: {slug}/metadata.json next to the blobs.
+// Directories whose name starts with a dot are ignored by List and
+// ListDirs.
+type FS struct {
+	Root string
+}
+
+func NewFS(root string) *FS {
+	return &FS{Root: root}
+}
+
+func (s *FS) path(key string) (string, error) {
+	if err := validKey(key); err != nil {
+		return "", err
+	}
+
+	return filepath.Join(s.Root, filepath.FromSlash(key)), nil
+}
+
+func (s *FS) Put(ctx context.Context, key string, r io.Reader) (Info, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return Info{}, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return Info{}, err
+	}
+
+	// Write to a temporary file in the same directory and rename it into
+	// place so readers never see a partial object. Both the file and the
+	// rename are synced before returning, so an object that Put reported
+	// as stored survives a crash whole.
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return Info{}, err
+	}
+
+	// On failure, drop the temporary file and any directories created
+	// only to hold it.
+	discard := func(err error) (Info, error) {
+		tmp.Close()
+		_ = os.Remove(tmp.Name())
+		s.removeEmptyParents(path)
+		return Info{}, err
+	}
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		return discard(err)
+	}
+
+	if err := tmp.Chmod(0644); err != nil {
+		return discard(err)
+	}
+
+	if err := tmp.Sync(); err != nil {
+		return discard(err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return discard(err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return discard(err)
+	}
+
+	if err := syncDir(filepath.Dir(path)); err != nil {
+		return Info{}, err
+	}
+
+	return s.Stat(ctx, key)
+}
+
+func (s *FS) Get(ctx context.Context, key string) (Object, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if fi.IsDir() {
+		f.Close()
+		return nil, &fs.PathError{Op: "open", Path: path, Err: ErrNotExist}
+	}
+
+	return &fileObject{File: f, info: Info{Key: key, Size: fi.Size(), ModTime: fi.ModTime()}}, nil
+}
+
+func (s *FS) Stat(ctx context.Context, key string) (Info, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return Info{}, err
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return Info{}, err
+	}
+
+	if fi.IsDir() {
+		return Info{}, &fs.PathError{Op: "stat", Path: path, Err: ErrNotExist}
+	}
+
+	return Info{Key: key, Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+func (s *FS) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+
+	s.removeEmptyParents(path)
+	return nil
+}
+
+// removeEmptyParents tidies up directories left empty, such as an upload
+// whose last file was just removed. Failure only means the directory is
+// still in use.
+func (s *FS) removeEmptyParents(path string) {
+	for dir := filepath.Dir(path); dir != filepath.Clean(s.Root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+}
+
+func (s *FS) Rename(ctx context.Context, oldKey, newKey string) error {
+	oldPath, err := s.path(oldKey)
+	if err != nil {
+		return err
+	}
+
+	newPath, err := s.path(newKey)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
+		return err
+	}
+
+	if err := os.Rename(oldPath, newPath); err != nil {
+		return err
+	}
+
+	if err := syncDir(filepath.Dir(newPath)); err != nil {
+		return err
+	}
+
+	s.removeEmptyParents(oldPath)
+	return nil
+}
+
+// Link hard links path into place, so the object shares the file's data.
+// The object is given the current time, like one just written by Put.
+func (s *FS) Link(ctx context.Context, path, key string) (Info, error) {
+	newPath, err := s.path(key)
+	if err != nil {
+		return Info{}, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
+		return Info{}, err
+	}
+
+	if err := os.Link(path, newPath); err != nil {
+		s.removeEmptyParents(newPath)
+		return Info{}, err
+	}
+
+	now := time.Now()
+	if err := os.Chtimes(newPath, now, now); err != nil {
+		_ = s.Delete(ctx, key)
+		return Info{}, err
+	}
+
+	if err := syncDir(filepath.Dir(newPath)); err != nil {
+		return Info{}, err
+	}
+
+	return s.Stat(ctx, key)
+}
+
+// syncDir flushes a directory's entries, making renames into it durable.
+// Platforms that cannot open directories for syncing are left to their own
+// guarantees.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return nil
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil && !errors.Is(err, errors.ErrUnsupported) {
+		return err
+	}
+
+	return nil
+}
+
+func (s *FS) List(ctx context.Context, prefix string) ([]Info, error) {
+	var out []Info
+
+	err := filepath.WalkDir(s.Root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+
+		rel, err := filepath.Rel(s.Root, path)
+		if err != nil {
+			return err
+		}
+
+		key := filepath.ToSlash(rel)
+
+		if d.IsDir() {
+			if key == "." {
+				return nil
+			}
+
+			// Hidden directories hold server scratch space, such as partial
+			// uploads, rather than objects. Also skip directories that cannot
+			// contain a matching key.
+			if strings.HasPrefix(d.Name(), ".") || !strings.HasPrefix(key+"/", prefix) && !strings.HasPrefix(prefix, key+"/") {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		if !strings.HasPrefix(key, prefix) || strings.HasPrefix(d.Name(), ".tmp-") {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		out = append(out, Info{Key: key, Size: fi.Size(), ModTime: fi.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+
+	return out, nil
+}
+
+// ListDirs reads only the directory under prefix. Directories are removed
+// once empty, so each one returned holds at least one object.
+func (s *FS) ListDirs(ctx context.Context, prefix string) ([]string, error) {
+	dir := s.Root
+
+	if prefix != "" {
+		if !strings.HasSuffix(prefix, "/") || validKey(strings.TrimSuffix(prefix, "/")) != nil {
+			return nil, fmt.Errorf("storage: invalid prefix %q", prefix)
+		}
+
+		dir = filepath.Join(s.Root, filepath.FromSlash(prefix))
+	}
+
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var out []string
+
+	for _, e := range entries {
+		if e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+			out = append(out, e.Name())
+		}
+	}
+
+	return out, nil
+}
+
+type fileObject struct {
+	*os.File
+	info Info
+}
+
+func (o *fileObject) Info() Info {
+	return o.info
+}
@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory keeps objects in memory. It is meant for tests.
+type Memory struct {
+	mu      sync.RWMutex
+	objects map[string]memoryObject
+}
+
+type memoryObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+func NewMemory() *Memory {
+	return &Memory{objects: make(map[string]memoryObject)}
+}
+
+func (s *Memory) Put(ctx context.Context, key string, r io.Reader) (Info, error) {
+	if err := validKey(key); err != nil {
+		return Info{}, err
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return Info{}, err
+	}
+
+	obj := memoryObject{data: data, modTime: time.Now()}
+
+	s.mu.Lock()
+	s.objects[key] = obj
+	s.mu.Unlock()
+
+	return Info{Key: key, Size: int64(len(data)), ModTime: obj.modTime}, nil
+}
+
+func (s *Memory) Get(ctx context.Context, key string) (Object, error) {
+	s.mu.RLock()
+	obj, ok := s.objects[key]
+	s.mu.RUnlock()
+
+	if !ok {
+		return nil, ErrNotExist
+	}
+
+	return &bytesObject{
+		Reader: bytes.NewReader(obj.data),
+		info:   Info{Key: key, Size: int64(len(obj.data)), ModTime: obj.modTime},
+	}, nil
+}
+
+func (s *Memory) Stat(ctx context.Context, key string) (Info, error) {
+	s.mu.RLock()
+	obj, ok := s.objects[key]
+	s.mu.RUnlock()
+
+	if !ok {
+		return Info{}, ErrNotExist
+	}
+
+	return Info{Key: key, Size: int64(len(obj.data)), ModTime: obj.modTime}, nil
+}
+
+func (s *Memory) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.objects[key]; !ok {
+		return ErrNotExist
+	}
+
+	delete(s.objects, key)
+	return nil
+}
+
+func (s *Memory) Rename(ctx context.Context, oldKey, newKey string) error {
+	if err := validKey(newKey); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	obj, ok := s.objects[oldKey]
+	if !ok {
+		return ErrNotExist
+	}
+
+	s.objects[newKey] = obj
+	delete(s.objects, oldKey)
+	return nil
+}
+
+func (s *Memory) List(ctx context.Context, prefix string) ([]Info, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var out []Info
+	for key, obj := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			out = append(out, Info{Key: key, Size: int64(len(obj.data)), ModTime: obj.modTime})
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+
+	return out, nil
+}
+
+func (s *Memory) ListDirs(ctx context.Context, prefix string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	var out []string
+
+	for key := range s.objects {
+		rest, ok := strings.CutPrefix(key, prefix)
+		if !ok {
+			continue
+		}
+
+		if dir, _, ok := strings.Cut(rest, "/"); ok && !seen[dir] {
+			seen[dir] = true
+			out = append(out, dir)
+		}
+	}
+
+	sort.Strings(out)
+
+	return out, nil
+}
+
+type bytesObject struct {
+	*bytes.Reader
+	info Info
+}
+
+func (o *bytesObject) Close() error {
+	return nil
+}
+
+func (o *bytesObject) Info() Info {
+	return o.info
+}
@@ -0,0 +1,576 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3 stores objects in an S3-compatible bucket, signing requests with AWS
+// Signature Version 4. Keys are stored under Prefix, if set.
+type S3 struct {
+	Endpoint  string
+	Bucket    string
+	Region    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	// PathStyle addresses the bucket as {endpoint}/{bucket}/{key} rather
+	// than {bucket}.{endpoint}/{key}. Most self-hosted S3 servers need it.
+	PathStyle bool
+	Client    *http.Client
+	// TempDir is where uploads of unknown length are spooled so they can be
+	// sent with a Content-Length and payload hash. Defaults to os.TempDir.
+	TempDir string
+
+	now func() time.Time
+}
+
+func (s *S3) client() *http.Client {
+	if s.Client != nil {
+		return s.Client
+	}
+
+	return http.DefaultClient
+}
+
+func (s *S3) objectURL(key string) (*url.URL, error) {
+	u, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.PathStyle {
+		u.Path = "/" + s.Bucket + "/" + s.Prefix + key
+	} else {
+		u.Host = s.Bucket + "." + u.Host
+		u.Path = "/" + s.Prefix + key
+	}
+
+	u.RawPath = awsEscape(u.Path, true)
+	return u, nil
+}
+
+func (s *S3) bucketURL() (*url.URL, error) {
+	u, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.PathStyle {
+		u.Path = "/" + s.Bucket
+	} else {
+		u.Host = s.Bucket + "." + u.Host
+		u.Path = "/"
+	}
+
+	return u, nil
+}
+
+func (s *S3) Put(ctx context.Context, key string, r io.Reader) (Info, error) {
+	if err := validKey(key); err != nil {
+		return Info{}, err
+	}
+
+	// S3 needs the length up front. Spool the body to disk, hashing it on
+	// the way, so it can be sent with a signed payload hash.
+	tmp, err := os.CreateTemp(s.TempDir, "beam-s3-*")
+	if err != nil {
+		return Info{}, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hasher := sha256.New()
+
+	size, err := io.Copy(io.MultiWriter(tmp, hasher), r)
+	if err != nil {
+		return Info{}, err
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return Info{}, err
+	}
+
+	u, err := s.objectURL(key)
+	if err != nil {
+		return Info{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), io.NopCloser(tmp))
+	if err != nil {
+		return Info{}, err
+	}
+
+	req.ContentLength = size
+
+	res, err := s.do(req, hex.EncodeToString(hasher.Sum(nil)))
+	if err != nil {
+		return Info{}, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return Info{}, s3Error(res, key)
+	}
+
+	return Info{Key: key, Size: size, ModTime: s.clock()}, nil
+}
+
+func (s *S3) Get(ctx context.Context, key string) (Object, error) {
+	info, err := s.Stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3Object{ctx: ctx, store: s, info: info}, nil
+}
+
+func (s *S3) Stat(ctx context.Context, key string) (Info, error) {
+	if err := validKey(key); err != nil {
+		return Info{}, err
+	}
+
+	u, err := s.objectURL(key)
+	if err != nil {
+		return Info{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, u.String(), nil)
+	if err != nil {
+		return Info{}, err
+	}
+
+	res, err := s.do(req, emptyPayloadHash)
+	if err != nil {
+		return Info{}, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return Info{}, s3Error(res, key)
+	}
+
+	modTime, _ := http.ParseTime(res.Header.Get("Last-Modified"))
+
+	return Info{Key: key, Size: res.ContentLength, ModTime: modTime}, nil
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	if _, err := s.Stat(ctx, key); err != nil {
+		return err
+	}
+
+	u, err := s.objectURL(key)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, u.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.do(req, emptyPayloadHash)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK {
+		return s3Error(res, key)
+	}
+
+	return nil
+}
+
+// Rename copies the object server-side and then deletes the original, since
+// S3 has no native rename.
+func (s *S3) Rename(ctx context.Context, oldKey, newKey string) error {
+	if err := validKey(oldKey); err != nil {
+		return err
+	}
+
+	if err := validKey(newKey); err != nil {
+		return err
+	}
+
+	u, err := s.objectURL(newKey)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("x-amz-copy-source", awsEscape("/"+s.Bucket+"/"+s.Prefix+oldKey, true))
+
+	res, err := s.do(req, emptyPayloadHash)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return s3Error(res, oldKey)
+	}
+
+	return s.Delete(ctx, oldKey)
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *S3) List(ctx context.Context, prefix string) ([]Info, error) {
+	var out []Info
+
+	err := s.listPages(ctx, prefix, "", func(result *listBucketResult) {
+		for _, c := range result.Contents {
+			out = append(out, Info{
+				Key:     strings.TrimPrefix(c.Key, s.Prefix),
+				Size:    c.Size,
+				ModTime: c.LastModified,
+			})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+
+	return out, nil
+}
+
+// ListDirs lists with a "/" delimiter, so S3 rolls the keys under each
+// directory up into a single common prefix instead of returning them all.
+func (s *S3) ListDirs(ctx context.Context, prefix string) ([]string, error) {
+	var out []string
+
+	err := s.listPages(ctx, prefix, "/", func(result *listBucketResult) {
+		for _, p := range result.CommonPrefixes {
+			out = append(out, strings.TrimSuffix(strings.TrimPrefix(p.Prefix, s.Prefix+prefix), "/"))
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(out)
+
+	return out, nil
+}
+
+// listPages runs a ListObjectsV2 request for prefix, following continuation
+// tokens, and passes each page of results to fn.
+func (s *S3) listPages(ctx context.Context, prefix, delimiter string, fn func(*listBucketResult)) error {
+	token := ""
+
+	for {
+		u, err := s.bucketURL()
+		if err != nil {
+			return err
+		}
+
+		q := url.Values{}
+		q.Set("list-type", "2")
+		q.Set("prefix", s.Prefix+prefix)
+		if delimiter != "" {
+			q.Set("delimiter", delimiter)
+		}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+
+		u.RawQuery = q.Encode()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return err
+		}
+
+		res, err := s.do(req, emptyPayloadHash)
+		if err != nil {
+			return err
+		}
+
+		if res.StatusCode != http.StatusOK {
+			err := s3Error(res, prefix)
+			res.Body.Close()
+			return err
+		}
+
+		var result listBucketResult
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		fn(&result)
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+
+		token = result.NextContinuationToken
+	}
+}
+
+func (s *S3) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	s.sign(req, payloadHash, s.clock())
+	return s.client().Do(req)
+}
+
+func (s *S3) clock() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+
+	return time.Now()
+}
+
+// sign adds AWS Signature Version 4 headers to req.
+// See https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html.
+func (s *S3) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if lower == "host" || lower == "range" || lower == "content-type" || strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsEscape(req.URL.Path, true),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signedHeaders, signature,
+	))
+}
+
+func canonicalQuery(values url.Values) string {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		vs := append([]string(nil), values[k]...)
+		sort.Strings(vs)
+
+		for _, v := range vs {
+			parts = append(parts, awsEscape(k, false)+"="+awsEscape(v, false))
+		}
+	}
+
+	return strings.Join(parts, "&")
+}
+
+// awsEscape percent-encodes everything except the RFC 3986 unreserved
+// characters, as SigV4 requires. Slashes are kept when keepSlash is set.
+func awsEscape(s string, keepSlash bool) string {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func s3Error(res *http.Response, key string) error {
+	if res.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("s3 %s: %w", key, ErrNotExist)
+	}
+
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+	return fmt.Errorf("s3 %s: %s: %s", key, res.Status, strings.TrimSpace(string(msg)))
+}
+
+// s3Object reads an object lazily with ranged GETs, so seeking (as
+// http.ServeContent does to serve ranges) doesn't download the whole blob.
+type s3Object struct {
+	ctx   context.Context
+	store *S3
+	info  Info
+
+	pos     int64
+	body    io.ReadCloser
+	bodyPos int64
+}
+
+func (o *s3Object) Info() Info {
+	return o.info
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.pos >= o.info.Size {
+		return 0, io.EOF
+	}
+
+	if o.body == nil || o.bodyPos != o.pos {
+		if err := o.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := o.body.Read(p)
+	o.pos += int64(n)
+	o.bodyPos = o.pos
+
+	return n, err
+}
+
+func (o *s3Object) open() error {
+	if o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+
+	u, err := o.store.objectURL(o.info.Key)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(o.ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	if o.pos > 0 {
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(o.pos, 10)+"-")
+	}
+
+	res, err := o.store.do(req, emptyPayloadHash)
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusPartialContent {
+		defer res.Body.Close()
+		return s3Error(res, o.info.Key)
+	}
+
+	o.body = res.Body
+	o.bodyPos = o.pos
+	return nil
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = o.pos + offset
+	case io.SeekEnd:
+		pos = o.info.Size + offset
+	default:
+		return 0, fmt.Errorf("s3: invalid whence %d", whence)
+	}
+
+	if pos < 0 {
+		return 0, fmt.Errorf("s3: negative position")
+	}
+
+	o.pos = pos
+	return pos, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body == nil {
+		return nil
+	}
+
+	err := o.body.Close()
+	o.body = nil
+	return err
+}
@@ -0,0 +1,103 @@
+// Package storage provides the object stores beam keeps uploaded blobs and
+// upload metadata in.
+//
+// Keys are slash separated paths such as "{slug}/metadata.json". Every
+// implementation must treat them as opaque apart from prefix listing.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+	"time"
+)
+
+// ErrNotExist is returned when a key has no object. It is fs.ErrNotExist so
+// callers can use errors.Is with either.
+var ErrNotExist = fs.ErrNotExist
+
+type Info struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Object is an open stored object. It is seekable so it can be served with
+// http.ServeContent, including range requests.
+type Object interface {
+	io.ReadSeekCloser
+	Info() Info
+}
+
+type Store interface {
+	// Put stores the contents of r under key, replacing any existing object.
+	// Readers never observe a partially written object.
+	Put(ctx context.Context, key string, r io.Reader) (Info, error)
+	Get(ctx context.Context, key string) (Object, error)
+	Stat(ctx context.Context, key string) (Info, error)
+	Delete(ctx context.Context, key string) error
+	// Rename moves the object at oldKey to newKey, replacing any object
+	// already there, without passing its contents through the caller.
+	Rename(ctx context.Context, oldKey, newKey string) error
+	// List returns every object whose key starts with prefix, sorted by key.
+	List(ctx context.Context, prefix string) ([]Info, error)
+	// ListDirs returns the distinct path segments that follow prefix in
+	// keys with another segment after them, sorted: the "directories"
+	// directly under prefix, which must be empty or end in a slash. It
+	// does not have to read the objects beneath them.
+	ListDirs(ctx context.Context, prefix string) ([]string, error)
+}
+
+// Linker is implemented by stores that can add a local file without copying
+// its contents.
+type Linker interface {
+	// Link stores the file at path under key, sharing its contents with
+	// path, which must not change afterwards. It fails if the file cannot
+	// be shared, such as when it is on another filesystem, and the caller
+	// should Put a copy instead.
+	Link(ctx context.Context, path, key string) (Info, error)
+}
+
+// DeletePrefix removes every object whose key starts with prefix.
+func DeletePrefix(ctx context.Context, s Store, prefix string) error {
+	objects, err := s.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+
+	for _, o := range objects {
+		if err := s.Delete(ctx, o.Key); err != nil && !errors.Is(err, ErrNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ReadAll returns the full contents of the object stored under key.
+func ReadAll(ctx context.Context, s Store, key string) ([]byte, error) {
+	obj, err := s.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+
+	return io.ReadAll(obj)
+}
+
+func validKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.HasSuffix(key, "/") {
+		return fmt.Errorf("storage: invalid key %q", key)
+	}
+
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return fmt.Errorf("storage: invalid key %q", key)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,216 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testStore runs the behaviour every Store implementation must share.
+func testStore(t *testing.T, s Store) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	info, err := s.Put(ctx, "abc123/metadata.json", strings.NewReader(`{"slug":"abc123"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Size != 17 {
+		t.Fatalf("expected size 17, got %d", info.Size)
+	}
+
+	if _, err := s.Put(ctx, "abc123/blob one", strings.NewReader("hello storage")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Put(ctx, "other/blob", strings.NewReader("x")); err != nil {
+		t.Fatal(err)
+	}
+
+	obj, err := s.Get(ctx, "abc123/blob one")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if obj.Info().Size != 13 {
+		t.Fatalf("expected object size 13, got %d", obj.Info().Size)
+	}
+
+	if _, err := obj.Seek(6, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	rest, err := io.ReadAll(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(rest) != "storage" {
+		t.Fatalf("expected seeked read to return %q, got %q", "storage", rest)
+	}
+
+	if _, err := obj.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := io.ReadAll(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(all) != "hello storage" {
+		t.Fatalf("expected full read, got %q", all)
+	}
+
+	obj.Close()
+
+	if _, err := s.Put(ctx, "abc123/blob one", strings.NewReader("replaced")); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ReadAll(ctx, s, "abc123/blob one")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "replaced" {
+		t.Fatalf("expected replaced object, got %q", data)
+	}
+
+	listed, err := s.List(ctx, "abc123/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(listed) != 2 || listed[0].Key != "abc123/blob one" || listed[1].Key != "abc123/metadata.json" {
+		t.Fatalf("unexpected listing: %+v", listed)
+	}
+
+	all2, err := s.List(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(all2) != 3 {
+		t.Fatalf("expected 3 objects in full listing, got %+v", all2)
+	}
+
+	dirs, err := s.ListDirs(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(dirs, []string{"abc123", "other"}) {
+		t.Fatalf("unexpected directories: %v", dirs)
+	}
+
+	if dirs, err := s.ListDirs(ctx, "abc123/"); err != nil || len(dirs) != 0 {
+		t.Fatalf("expected no directories under abc123/, got %v, %v", dirs, err)
+	}
+
+	if _, err := s.Stat(ctx, "abc123/missing"); !errors.Is(err, ErrNotExist) {
+		t.Fatalf("expected ErrNotExist from Stat, got %v", err)
+	}
+
+	if _, err := s.Get(ctx, "abc123/missing"); !errors.Is(err, ErrNotExist) {
+		t.Fatalf("expected ErrNotExist from Get, got %v", err)
+	}
+
+	if err := s.Rename(ctx, "abc123/blob one", "moved/blob"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Stat(ctx, "abc123/blob one"); !errors.Is(err, ErrNotExist) {
+		t.Fatalf("expected renamed object to be gone from old key, got %v", err)
+	}
+
+	data, err = ReadAll(ctx, s, "moved/blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "replaced" {
+		t.Fatalf("expected renamed object contents, got %q", data)
+	}
+
+	if err := s.Rename(ctx, "moved/blob", "abc123/blob one"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := DeletePrefix(ctx, s, "abc123/"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Stat(ctx, "abc123/metadata.json"); !errors.Is(err, ErrNotExist) {
+		t.Fatalf("expected deleted object to be gone, got %v", err)
+	}
+
+	if err := s.Delete(ctx, "abc123/metadata.json"); !errors.Is(err, ErrNotExist) {
+		t.Fatalf("expected ErrNotExist deleting missing object, got %v", err)
+	}
+
+	if _, err := s.Stat(ctx, "other/blob"); err != nil {
+		t.Fatalf("expected unrelated object to survive prefix delete: %v", err)
+	}
+
+	if _, err := s.Put(ctx, "../escape", strings.NewReader("x")); err == nil {
+		t.Fatal("expected invalid key to be rejected")
+	}
+}
+
+func TestFS(t *testing.T) {
+	testStore(t, NewFS(t.TempDir()))
+}
+
+func TestMemory(t *testing.T) {
+	testStore(t, NewMemory())
+}
+
+func TestFSLink(t *testing.T) {
+	ctx := context.Background()
+	s := NewFS(t.TempDir())
+
+	src := filepath.Join(t.TempDir(), "data")
+	if err := os.WriteFile(src, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	old := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(src, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := s.Link(ctx, src, "staging/abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Size != 5 || !info.ModTime.After(old) {
+		t.Fatalf("expected a fresh 5 byte object, got %+v", info)
+	}
+
+	if data, err := ReadAll(ctx, s, "staging/abc"); err != nil || string(data) != "hello" {
+		t.Fatalf("expected the linked contents, got %q, %v", data, err)
+	}
+
+	// The source is left in place.
+	if data, err := os.ReadFile(src); err != nil || string(data) != "hello" {
+		t.Fatalf("expected the source to be kept, got %q, %v", data, err)
+	}
+
+	if _, err := s.Link(ctx, filepath.Join(t.TempDir(), "missing"), "staging/def"); err == nil {
+		t.Fatal("expected linking a missing file to fail")
+	}
+
+	if dirs, _ := s.ListDirs(ctx, ""); !slices.Equal(dirs, []string{"staging"}) {
+		t.Fatalf("expected a failed link to leave no directories behind, got %v", dirs)
+	}
+}
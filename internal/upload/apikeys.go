@@ -0,0 +1,117 @@
+package upload
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// MinAPIKeyLength keeps guessable keys out of the key file.
+const MinAPIKeyLength = 16
+
+// APIKeys maps the SHA-256 of each accepted API key to the identity it
+// belongs to. Keys are looked up by hash so comparisons do not leak how much
+// of a key matched.
+type APIKeys map[string]string
+
+type identityKey struct{}
+
+// LoadAPIKeys reads a key file. Each line holds an identity and its key
+// separated by whitespace; blank lines and lines starting with # are
+// ignored.
+//
+//	# identity  key
+//	alice       3q2+7wR9xN0vK1bT5mZc
+//	ci          Yp8dQ4sL6hJ2uF0aE7kW
+func LoadAPIKeys(path string) (APIKeys, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := make(APIKeys)
+	scanner := bufio.NewScanner(f)
+
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected an identity and a key", path, line)
+		}
+
+		identity, key := fields[0], fields[1]
+
+		if len(key) < MinAPIKeyLength {
+			return nil, fmt.Errorf("%s:%d: key for %s is shorter than %d characters", path, line, identity, MinAPIKeyLength)
+		}
+
+		hash := hashAPIKey(key)
+		if _, ok := keys[hash]; ok {
+			return nil, fmt.Errorf("%s:%d: key for %s is already in use", path, line, identity)
+		}
+
+		keys[hash] = identity
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// RequireAPIKey wraps a handler so it only runs for requests carrying a
+// known key as "Authorization: Bearer <key>". The key's identity is made
+// available to the handler and recorded on uploads it creates. Without any
+// configured keys every request is let through anonymously.
+func (h *Handler) RequireAPIKey(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(h.APIKeys) == 0 {
+			next(w, r)
+			return
+		}
+
+		identity, ok := h.apiKeyIdentity(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="beam"`)
+			http.Error(w, "a valid API key is required", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, identity)))
+	}
+}
+
+// apiKeyIdentity returns the identity of the known key the request carries
+// as "Authorization: Bearer <key>", if any.
+func (h *Handler) apiKeyIdentity(r *http.Request) (string, bool) {
+	key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return "", false
+	}
+
+	identity, known := h.APIKeys[hashAPIKey(strings.TrimSpace(key))]
+	return identity, known
+}
+
+// identityFrom returns the identity of the API key that authenticated the
+// request, or "" for anonymous requests.
+func identityFrom(ctx context.Context) string {
+	identity, _ := ctx.Value(identityKey{}).(string)
+	return identity
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,162 @@
+package upload
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// archiveTypes are the archive formats an upload can be downloaded as, by
+// the extension appended to its slug: /u/{slug}.zip or /u/{slug}.tar.gz.
+var archiveTypes = map[string]string{
+	".zip":    "application/zip",
+	".tar.gz": "application/gzip",
+}
+
+// parseArchivePath reports whether an /u/ path asks for an archive of a
+// whole upload, returning the upload's slug and the archive's extension.
+func parseArchivePath(urlPath string) (slug, ext string, ok bool) {
+	name := strings.TrimPrefix(urlPath, "/u/")
+	if strings.Contains(name, "/") {
+		return "", "", false
+	}
+
+	for ext := range archiveTypes {
+		if slug, ok := strings.CutSuffix(name, ext); ok {
+			return slug, ext, true
+		}
+	}
+
+	return "", "", false
+}
+
+// serveArchive streams every file of an upload as a single archive, keeping
+// their relative paths and modification times. Nothing is assembled on disk;
+// files are copied from storage straight into the response. For
+// burn-after-read uploads the whole archive counts as one view, and HEAD
+// requests count as none.
+func (h *Handler) serveArchive(w http.ResponseWriter, r *http.Request, slug, ext string) {
+	meta, ok := h.openUpload(w, r, slug)
+	if !ok {
+		return
+	}
+
+	if meta.MaxViews > 0 {
+		if meta, ok = h.takeView(r, slug); !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		if meta.ViewsRemaining() == 0 {
+			defer h.discardUpload(meta)
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Beam-Views-Remaining", strconv.Itoa(meta.ViewsRemaining()))
+	}
+
+	files := slices.Clone(meta.Files)
+	slices.SortFunc(files, func(a, b FileMetadata) int {
+		return strings.Compare(a.Path(), b.Path())
+	})
+
+	w.Header().Set("Content-Type", archiveTypes[ext])
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", slug+ext))
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	var err error
+
+	switch ext {
+	case ".zip":
+		err = h.writeZip(r.Context(), w, meta.Slug, files)
+	case ".tar.gz":
+		err = h.writeTarGz(r.Context(), w, meta.Slug, files)
+	}
+
+	// The status line is long gone, so the only way left to report a
+	// failure is to cut the response off rather than end it cleanly.
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func (h *Handler) writeZip(ctx context.Context, w io.Writer, slug string, files []FileMetadata) error {
+	zw := zip.NewWriter(w)
+
+	for _, f := range files {
+		entry, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     f.Path(),
+			Method:   zip.Deflate,
+			Modified: f.archiveModTime(),
+		})
+		if err != nil {
+			return err
+		}
+
+		if err := h.copyStored(ctx, entry, slug, f); err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
+
+func (h *Handler) writeTarGz(ctx context.Context, w io.Writer, slug string, files []FileMetadata) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	for _, f := range files {
+		err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     f.Path(),
+			Mode:     0644,
+			Size:     f.Size,
+			ModTime:  f.archiveModTime(),
+		})
+		if err != nil {
+			return err
+		}
+
+		if err := h.copyStored(ctx, tw, slug, f); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	return gz.Close()
+}
+
+func (h *Handler) copyStored(ctx context.Context, w io.Writer, slug string, f FileMetadata) error {
+	stored, err := h.Store.Get(ctx, f.storageKey(slug))
+	if err != nil {
+		return err
+	}
+	defer stored.Close()
+
+	_, err = io.Copy(w, stored)
+	return err
+}
+
+// archiveModTime is the time a file is given in archives: its time on the
+// uploader's machine when known, otherwise when it was uploaded.
+func (f FileMetadata) archiveModTime() time.Time {
+	if !f.ModTime.IsZero() {
+		return f.ModTime
+	}
+
+	return f.CreatedAt
+}
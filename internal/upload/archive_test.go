@@ -0,0 +1,140 @@
+package upload
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+var archiveModTime = time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+
+// createArchiveUpload uploads two files, the first with a modification time
+// as the client sends it, and returns the upload's slug.
+func createArchiveUpload(t *testing.T, h *Handler, fields url.Values) string {
+	t.Helper()
+
+	rr := createUpload(t, h, fields,
+		testFile{name: "src/main.go", content: "package main\n", modTime: archiveModTime},
+		testFile{name: "README.md", content: "# hi\n"},
+	)
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+
+	var resp UploadResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	return strings.TrimPrefix(resp.URL, h.BaseURL+"/u/")
+}
+
+func getArchive(t *testing.T, h *Handler, target string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	rr := httptest.NewRecorder()
+	h.ServeUpload(rr, httptest.NewRequest(http.MethodGet, target, nil))
+
+	return rr
+}
+
+func TestServeUploadAsZip(t *testing.T) {
+	h := NewHandler("http://example.com", t.TempDir())
+	slug := createArchiveUpload(t, h, nil)
+
+	rr := getArchive(t, h, "/u/"+slug+".zip")
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("expected a zip, got %d %v", rr.Code, rr.Header())
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(zr.File) != 2 || zr.File[0].Name != "README.md" || zr.File[1].Name != "src/main.go" {
+		t.Fatalf("expected both files in path order, got %v", zr.File)
+	}
+
+	if !zr.File[1].Modified.Equal(archiveModTime) {
+		t.Fatalf("expected the client's modification time, got %s", zr.File[1].Modified)
+	}
+
+	f, err := zr.File[1].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if data, _ := io.ReadAll(f); string(data) != "package main\n" {
+		t.Fatalf("unexpected contents %q", data)
+	}
+}
+
+func TestServeUploadAsTarGz(t *testing.T) {
+	h := NewHandler("http://example.com", t.TempDir())
+	slug := createArchiveUpload(t, h, nil)
+
+	rr := getArchive(t, h, "/u/"+slug+".tar.gz")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, rr.Code)
+	}
+
+	gz, err := gzip.NewReader(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr := tar.NewReader(gz)
+	contents := make(map[string]string)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, _ := io.ReadAll(tr)
+		contents[hdr.Name] = string(data)
+
+		if hdr.Name == "src/main.go" && !hdr.ModTime.Equal(archiveModTime) {
+			t.Fatalf("expected the client's modification time, got %s", hdr.ModTime)
+		}
+
+		if hdr.Name == "README.md" && hdr.ModTime.IsZero() {
+			t.Fatal("expected files without a modification time to use the upload time")
+		}
+	}
+
+	if contents["src/main.go"] != "package main\n" || contents["README.md"] != "# hi\n" {
+		t.Fatalf("unexpected archive contents %v", contents)
+	}
+}
+
+func TestServeArchiveSpendsOneView(t *testing.T) {
+	h := NewHandler("http://example.com", t.TempDir())
+	slug := createArchiveUpload(t, h, url.Values{"views": {"1"}})
+
+	rr := getArchive(t, h, "/u/"+slug+".zip")
+	if rr.Code != http.StatusOK || rr.Header().Get("Beam-Views-Remaining") != "0" {
+		t.Fatalf("expected the archive to spend the last view, got %d %v", rr.Code, rr.Header())
+	}
+
+	if rr := getArchive(t, h, "/u/"+slug+".tar.gz"); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected the upload to be gone, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,316 @@
+package upload
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elliota43/beam/internal/storage"
+)
+
+// File contents are stored once per distinct SHA-256 under blobs/, no matter
+// how many uploads contain them. Each blob has a reference count under refs/
+// recording how many files point at it; the count is raised before a file is
+// committed and lowered when its upload is deleted, and the blob is removed
+// when the last reference goes. New data is written under staging/ first
+// because its hash is only known once it has been read.
+const (
+	blobsPrefix   = "blobs/"
+	refsPrefix    = "refs/"
+	stagingPrefix = "staging/"
+
+	// gcGracePeriod is how long CollectGarbage leaves staged data and
+	// unconfirmed references alone, so uploads still in flight are not
+	// reclaimed underneath them.
+	gcGracePeriod = 24 * time.Hour
+)
+
+// stagedBlob is data written to staging but not yet moved into place.
+type stagedBlob struct {
+	key  string
+	hash string
+	size int64
+}
+
+func contentKey(hash string) string {
+	return blobsPrefix + hash[:2] + "/" + hash
+}
+
+func refsKey(hash string) string {
+	return refsPrefix + hash[:2] + "/" + hash
+}
+
+// storageKey returns where a file's contents are stored. Files from before
+// content addressing have a per-upload stored name instead of a shared blob.
+func (f FileMetadata) storageKey(slug string) string {
+	if f.StoredName != "" {
+		return blobKey(slug, f.StoredName)
+	}
+
+	return contentKey(f.SHA256)
+}
+
+// stageBlob writes r to a new staging object, hashing it on the way through.
+func (h *Handler) stageBlob(ctx context.Context, r io.Reader) (stagedBlob, error) {
+	name, err := randomSlug(StorageSlugLength)
+	if err != nil {
+		return stagedBlob{}, err
+	}
+
+	key := stagingPrefix + name
+	hasher := sha256.New()
+
+	info, err := h.Store.Put(ctx, key, io.TeeReader(r, hasher))
+	if err != nil {
+		return stagedBlob{}, err
+	}
+
+	return stagedBlob{
+		key:  key,
+		hash: hex.EncodeToString(hasher.Sum(nil)),
+		size: info.Size,
+	}, nil
+}
+
+// discardStaged removes staged data that will not be committed.
+func (h *Handler) discardStaged(b stagedBlob) {
+	_ = h.Store.Delete(context.Background(), b.key)
+}
+
+// commitBlob takes a reference to the staged data's blob, moving the data
+// into place if no upload has stored the same contents yet and dropping it
+// otherwise. The reference must later be released with releaseBlobs.
+func (h *Handler) commitBlob(ctx context.Context, b stagedBlob) error {
+	h.blobMu.Lock()
+	defer h.blobMu.Unlock()
+
+	if _, err := h.adjustRefs(ctx, b.hash, 1); err != nil {
+		h.discardStaged(b)
+		return err
+	}
+
+	_, err := h.Store.Stat(ctx, contentKey(b.hash))
+	if err == nil {
+		h.discardStaged(b)
+		return nil
+	}
+
+	if errors.Is(err, storage.ErrNotExist) {
+		err = h.Store.Rename(ctx, b.key, contentKey(b.hash))
+	}
+
+	if err != nil {
+		h.discardStaged(b)
+		_, _ = h.adjustRefs(context.Background(), b.hash, -1)
+		return err
+	}
+
+	return nil
+}
+
+// releaseBlobs drops the references held by files, deleting any blob that
+// is no longer referenced. Files stored before content addressing hold no
+// reference and are skipped.
+func (h *Handler) releaseBlobs(ctx context.Context, files []FileMetadata) error {
+	h.blobMu.Lock()
+	defer h.blobMu.Unlock()
+
+	var firstErr error
+
+	for _, f := range files {
+		if f.StoredName != "" {
+			continue
+		}
+
+		n, err := h.adjustRefs(ctx, f.SHA256, -1)
+		if err == nil && n == 0 {
+			err = h.Store.Delete(ctx, contentKey(f.SHA256))
+			if errors.Is(err, storage.ErrNotExist) {
+				err = nil
+			}
+		}
+
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// adjustRefs changes a blob's reference count by delta and returns the new
+// count. The caller must hold blobMu.
+func (h *Handler) adjustRefs(ctx context.Context, hash string, delta int) (int, error) {
+	n, _, err := h.readRefs(ctx, hash)
+	if err != nil {
+		return 0, err
+	}
+
+	return n + delta, h.writeRefs(ctx, hash, n+delta)
+}
+
+// readRefs returns a blob's reference count and when it last changed. A
+// blob without a count has no references.
+func (h *Handler) readRefs(ctx context.Context, hash string) (int, time.Time, error) {
+	obj, err := h.Store.Get(ctx, refsKey(hash))
+	if errors.Is(err, storage.ErrNotExist) {
+		return 0, time.Time{}, nil
+	}
+
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	defer obj.Close()
+
+	data, err := io.ReadAll(obj)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	return n, obj.Info().ModTime, nil
+}
+
+func (h *Handler) writeRefs(ctx context.Context, hash string, n int) error {
+	if n <= 0 {
+		err := h.Store.Delete(ctx, refsKey(hash))
+		if errors.Is(err, storage.ErrNotExist) {
+			return nil
+		}
+
+		return err
+	}
+
+	_, err := h.Store.Put(ctx, refsKey(hash), strings.NewReader(strconv.Itoa(n)+"\n"))
+	return err
+}
+
+// deleteUpload removes an upload: its metadata first, so it stops being
+// served, then its references to shared blobs and any files stored before
+// content addressing.
+func (h *Handler) deleteUpload(ctx context.Context, meta UploadMetadata) error {
+	if err := h.index().Delete(ctx, meta.Slug); err != nil {
+		return err
+	}
+
+	h.releaseQuota(meta.Owner, meta.Files)
+
+	if err := h.releaseBlobs(ctx, meta.Files); err != nil {
+		return err
+	}
+
+	return storage.DeletePrefix(ctx, h.Store, meta.Slug+"/")
+}
+
+// CollectGarbage removes blobs that no upload refers to and staged data
+// abandoned by crashed or interrupted uploads. Reference counts normally
+// free blobs as soon as they are unused; this pass catches what they miss,
+// such as counts left behind by a crash between taking a reference and
+// committing the upload, and repairs counts for blobs still in use. It
+// returns the number of blobs removed.
+func (h *Handler) CollectGarbage(ctx context.Context, now time.Time) (int, error) {
+	// The set of referenced blobs is gathered before taking blobMu so
+	// uploads are not blocked while every upload's metadata is read. A blob
+	// referenced only by an upload committed after this point has a fresh
+	// reference count, which keeps it safe below.
+	live, err := h.liveBlobs(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	blobs, err := h.Store.List(ctx, blobsPrefix)
+	if err != nil {
+		return 0, err
+	}
+
+	h.blobMu.Lock()
+	defer h.blobMu.Unlock()
+
+	removed := 0
+
+	for _, blob := range blobs {
+		hash := path.Base(blob.Key)
+
+		refs, changed, err := h.readRefs(ctx, hash)
+		if err != nil {
+			return removed, err
+		}
+
+		// Counts that changed recently belong to uploads in flight, or to
+		// deletions since the snapshot above, so only older ones are fixed.
+		stale := now.Sub(changed) > gcGracePeriod
+
+		// The blob may have been released since it was listed.
+		if _, err := h.Store.Stat(ctx, blob.Key); errors.Is(err, storage.ErrNotExist) {
+			continue
+		}
+
+		if live[hash] > 0 {
+			if refs != live[hash] && stale {
+				if err := h.writeRefs(ctx, hash, live[hash]); err != nil {
+					return removed, err
+				}
+			}
+			continue
+		}
+
+		if refs > 0 && !stale {
+			continue
+		}
+
+		if err := h.Store.Delete(ctx, blob.Key); err != nil && !errors.Is(err, storage.ErrNotExist) {
+			return removed, err
+		}
+
+		if err := h.writeRefs(ctx, hash, 0); err != nil {
+			return removed, err
+		}
+
+		removed++
+	}
+
+	staged, err := h.Store.List(ctx, stagingPrefix)
+	if err != nil {
+		return removed, err
+	}
+
+	for _, obj := range staged {
+		if now.Sub(obj.ModTime) > gcGracePeriod {
+			_ = h.Store.Delete(ctx, obj.Key)
+		}
+	}
+
+	return removed, nil
+}
+
+// liveBlobs counts the references to each blob across all committed uploads.
+func (h *Handler) liveBlobs(ctx context.Context) (map[string]int, error) {
+	// Guessing past unreadable metadata could free blobs a damaged upload
+	// still needs, so any error stops the pass.
+	uploads, err := h.index().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	live := make(map[string]int)
+
+	for _, meta := range uploads {
+		for _, f := range meta.Files {
+			if f.StoredName == "" {
+				live[f.SHA256]++
+			}
+		}
+	}
+
+	return live, nil
+}
@@ -0,0 +1,191 @@
+package upload
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elliota43/beam/internal/storage"
+)
+
+// postUpload sends files through CreateUpload and returns the stored
+// metadata for the new upload.
+func postUpload(t *testing.T, h *Handler, files map[string]string) UploadMetadata {
+	t.Helper()
+
+	var parts []testFile
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		parts = append(parts, testFile{name: name, content: files[name]})
+	}
+
+	rr := createUpload(t, h, nil, parts...)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+
+	var resp UploadResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	meta, err := h.index().Get(context.Background(), strings.TrimPrefix(resp.URL, h.BaseURL+"/u/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return meta
+}
+
+func hashOf(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func refCount(t *testing.T, h *Handler, hash string) int {
+	t.Helper()
+
+	n, _, err := h.readRefs(context.Background(), hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return n
+}
+
+func TestUploadsShareIdenticalContent(t *testing.T) {
+	h := NewHandler("http://example.com", t.TempDir())
+	ctx := context.Background()
+
+	first := postUpload(t, h, map[string]string{"a.txt": "same bytes", "b.txt": "same bytes"})
+	second := postUpload(t, h, map[string]string{"c.txt": "same bytes"})
+
+	hash := hashOf("same bytes")
+
+	blobs, err := h.Store.List(ctx, blobsPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(blobs) != 1 || blobs[0].Key != contentKey(hash) {
+		t.Fatalf("expected a single shared blob, got %+v", blobs)
+	}
+
+	if n := refCount(t, h, hash); n != 3 {
+		t.Fatalf("expected 3 references, got %d", n)
+	}
+
+	if err := h.deleteUpload(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := refCount(t, h, hash); n != 1 {
+		t.Fatalf("expected 1 reference after delete, got %d", n)
+	}
+
+	data, err := storage.ReadAll(ctx, h.Store, second.Files[0].storageKey(second.Slug))
+	if err != nil || string(data) != "same bytes" {
+		t.Fatalf("expected remaining upload to keep its contents, got %q, %v", data, err)
+	}
+
+	if err := h.deleteUpload(ctx, second); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := h.Store.Stat(ctx, contentKey(hash)); !errors.Is(err, storage.ErrNotExist) {
+		t.Fatalf("expected unreferenced blob to be removed, got %v", err)
+	}
+
+	if _, err := h.Store.Stat(ctx, refsKey(hash)); !errors.Is(err, storage.ErrNotExist) {
+		t.Fatalf("expected reference count to be removed, got %v", err)
+	}
+}
+
+func TestFailedUploadReleasesBlobs(t *testing.T) {
+	h := NewHandler("http://example.com", t.TempDir())
+	h.MaxFileSize = 4
+
+	rr := createUpload(t, h, nil, testFile{name: "ok.txt", content: "ok"}, testFile{name: "big.txt", content: "too large"})
+
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected %d, got %d", http.StatusBadRequest, rr.Code)
+	}
+
+	objects, err := h.Store.List(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(objects) != 0 {
+		t.Fatalf("expected failed upload to leave nothing behind, got %+v", objects)
+	}
+}
+
+func TestCollectGarbageRemovesUnreferencedBlobs(t *testing.T) {
+	h := NewHandler("http://example.com", t.TempDir())
+	h.Store = storage.NewMemory()
+	ctx := context.Background()
+
+	kept := postUpload(t, h, map[string]string{"kept.txt": "kept"})
+
+	orphan := hashOf("orphan")
+	if _, err := h.Store.Put(ctx, contentKey(orphan), strings.NewReader("orphan")); err != nil {
+		t.Fatal(err)
+	}
+
+	leaked := hashOf("leaked")
+	if _, err := h.Store.Put(ctx, contentKey(leaked), strings.NewReader("leaked")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.writeRefs(ctx, leaked, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := h.Store.Put(ctx, stagingPrefix+"abandoned", strings.NewReader("partial")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A reference taken moments ago may belong to an upload in flight.
+	removed, err := h.CollectGarbage(ctx, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if removed != 1 {
+		t.Fatalf("expected only the orphan to be collected, got %d", removed)
+	}
+
+	if _, err := h.Store.Stat(ctx, contentKey(leaked)); err != nil {
+		t.Fatalf("expected recently referenced blob to survive: %v", err)
+	}
+
+	removed, err = h.CollectGarbage(ctx, time.Now().Add(2*gcGracePeriod))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if removed != 1 {
+		t.Fatalf("expected stale reference to be collected, got %d", removed)
+	}
+
+	if _, err := h.Store.Stat(ctx, stagingPrefix+"abandoned"); !errors.Is(err, storage.ErrNotExist) {
+		t.Fatalf("expected abandoned staging data to be removed, got %v", err)
+	}
+
+	data, err := storage.ReadAll(ctx, h.Store, kept.Files[0].storageKey(kept.Slug))
+	if err != nil || string(data) != "kept" {
+		t.Fatalf("expected referenced blob to survive, got %q, %v", data, err)
+	}
+
+	if n := refCount(t, h, hashOf("kept")); n != 1 {
+		t.Fatalf("expected referenced blob to keep its count, got %d", n)
+	}
+}
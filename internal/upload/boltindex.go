@@ -0,0 +1,303 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/elliota43/beam/internal/storage"
+	bolt "go.etcd.io/bbolt"
+	berrors "go.etcd.io/bbolt/errors"
+)
+
+var (
+	// uploadsBucket maps each slug to its UploadMetadata as JSON.
+	uploadsBucket = []byte("uploads")
+	// expiryBucket has a key for every upload with an expiry: the expiry
+	// in big-endian Unix nanoseconds followed by the slug, so uploads can
+	// be walked in the order they expire.
+	expiryBucket = []byte("expiry")
+	// stateBucket holds flags about the index itself.
+	stateBucket = []byte("state")
+	importedKey = []byte("imported")
+)
+
+// BoltIndex keeps upload metadata in a single bbolt database file, so it
+// can be read and listed without opening a file per upload and every change
+// is a transaction.
+type BoltIndex struct {
+	db *bolt.DB
+}
+
+// OpenBoltIndex opens or creates the index at path. It fails rather than
+// waiting when another process has it open.
+func OpenBoltIndex(path string) (*BoltIndex, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if errors.Is(err, berrors.ErrTimeout) {
+		return nil, fmt.Errorf("index %s is in use by another process, such as a running server", path)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("opening index %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{uploadsBucket, expiryBucket, stateBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltIndex{db: db}, nil
+}
+
+func (b *BoltIndex) Close() error {
+	return b.db.Close()
+}
+
+func (b *BoltIndex) Get(ctx context.Context, slug string) (UploadMetadata, error) {
+	var meta UploadMetadata
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(uploadsBucket).Get([]byte(slug))
+		if data == nil {
+			return storage.ErrNotExist
+		}
+
+		return json.Unmarshal(data, &meta)
+	})
+
+	return meta, err
+}
+
+func (b *BoltIndex) Put(ctx context.Context, meta UploadMetadata) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if err := deleteExpiry(tx, meta.Slug); err != nil {
+			return err
+		}
+
+		if !meta.ExpiresAt.IsZero() {
+			if err := tx.Bucket(expiryBucket).Put(expiryKey(meta.ExpiresAt, meta.Slug), nil); err != nil {
+				return err
+			}
+		}
+
+		return tx.Bucket(uploadsBucket).Put([]byte(meta.Slug), data)
+	})
+}
+
+func (b *BoltIndex) Delete(ctx context.Context, slug string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if err := deleteExpiry(tx, slug); err != nil {
+			return err
+		}
+
+		return tx.Bucket(uploadsBucket).Delete([]byte(slug))
+	})
+}
+
+func (b *BoltIndex) List(ctx context.Context) ([]UploadMetadata, error) {
+	var uploads []UploadMetadata
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(uploadsBucket).ForEach(func(_, data []byte) error {
+			var meta UploadMetadata
+			if err := json.Unmarshal(data, &meta); err != nil {
+				return err
+			}
+
+			uploads = append(uploads, meta)
+			return nil
+		})
+	})
+
+	return uploads, err
+}
+
+// Expired walks the expiry keys up to now rather than every upload. Keys
+// left behind without a matching upload, by a crash or an older index, are
+// skipped and then removed.
+func (b *BoltIndex) Expired(ctx context.Context, now time.Time) ([]UploadMetadata, error) {
+	var expired []UploadMetadata
+	var dangling [][]byte
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		uploads := tx.Bucket(uploadsBucket)
+		c := tx.Bucket(expiryBucket).Cursor()
+
+		for k, _ := c.First(); k != nil && !now.Before(expiryTime(k)); k, _ = c.Next() {
+			data := uploads.Get(k[8:])
+			if data == nil {
+				dangling = append(dangling, bytes.Clone(k))
+				continue
+			}
+
+			var meta UploadMetadata
+			if err := json.Unmarshal(data, &meta); err != nil {
+				return err
+			}
+
+			if !meta.ExpiresAt.Equal(expiryTime(k)) {
+				dangling = append(dangling, bytes.Clone(k))
+				continue
+			}
+
+			expired = append(expired, meta)
+		}
+
+		return nil
+	})
+	if err != nil || len(dangling) == 0 {
+		return expired, err
+	}
+
+	return expired, b.db.Update(func(tx *bolt.Tx) error {
+		for _, k := range dangling {
+			if err := deleteDanglingExpiry(tx, k); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// deleteDanglingExpiry removes expiry key k unless its upload has since
+// been given that expiry again.
+func deleteDanglingExpiry(tx *bolt.Tx, k []byte) error {
+	if data := tx.Bucket(uploadsBucket).Get(k[8:]); data != nil {
+		var meta UploadMetadata
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return err
+		}
+
+		if meta.ExpiresAt.Equal(expiryTime(k)) {
+			return nil
+		}
+	}
+
+	return tx.Bucket(expiryBucket).Delete(k)
+}
+
+// Imported reports whether ImportMetadata has run against this index.
+func (b *BoltIndex) Imported() (bool, error) {
+	var imported bool
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		imported = tx.Bucket(stateBucket).Get(importedKey) != nil
+		return nil
+	})
+
+	return imported, err
+}
+
+// MigratedSuffix is added to the name of each metadata.json that
+// ImportMetadata has copied into the index. The originals are kept so a
+// migration can be undone by renaming them back, and go when their upload
+// is deleted.
+const MigratedSuffix = ".migrated"
+
+// ImportMetadata copies the metadata.json of every upload in store into the
+// index and, once the whole import has committed, renames each one with
+// MigratedSuffix so the index is the only live copy. It returns how many
+// uploads were imported. Running it again imports nothing new.
+func ImportMetadata(ctx context.Context, store storage.Store, b *BoltIndex) (int, error) {
+	legacy := storeIndex{store: store}
+
+	uploads, err := legacy.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, meta := range uploads {
+		if err := b.Put(ctx, meta); err != nil {
+			return 0, err
+		}
+	}
+
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(stateBucket).Put(importedKey, []byte(time.Now().UTC().Format(time.RFC3339)))
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, meta := range uploads {
+		key := metadataKey(meta.Slug)
+
+		err := store.Rename(ctx, key, key+MigratedSuffix)
+		if err != nil && !errors.Is(err, storage.ErrNotExist) {
+			return 0, err
+		}
+	}
+
+	return len(uploads), nil
+}
+
+// CheckImported fails if store holds metadata.json files that were never
+// imported into the index; the uploads they describe would otherwise seem
+// not to exist, and their blobs unreferenced. An index over storage with
+// none is marked imported straight away.
+func CheckImported(ctx context.Context, store storage.Store, b *BoltIndex) error {
+	imported, err := b.Imported()
+	if err != nil || imported {
+		return err
+	}
+
+	uploads, err := storeIndex{store: store}.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(uploads) > 0 {
+		return fmt.Errorf("%d uploads keep their metadata in %s files that are not in the index", len(uploads), MetadataFileName)
+	}
+
+	_, err = ImportMetadata(ctx, store, b)
+	return err
+}
+
+// deleteExpiry removes an upload's expiry key, which is found from the
+// expiry in its stored metadata.
+func deleteExpiry(tx *bolt.Tx, slug string) error {
+	data := tx.Bucket(uploadsBucket).Get([]byte(slug))
+	if data == nil {
+		return nil
+	}
+
+	var meta UploadMetadata
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return err
+	}
+
+	if meta.ExpiresAt.IsZero() {
+		return nil
+	}
+
+	return tx.Bucket(expiryBucket).Delete(expiryKey(meta.ExpiresAt, slug))
+}
+
+func expiryKey(expires time.Time, slug string) []byte {
+	key := binary.BigEndian.AppendUint64(make([]byte, 0, 8+len(slug)), uint64(expires.UnixNano()))
+	return append(key, slug...)
+}
+
+func expiryTime(key []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(key[:8])))
+}
@@ -0,0 +1,244 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/elliota43/beam/internal/storage"
+	bolt "go.etcd.io/bbolt"
+)
+
+func openTestIndex(t *testing.T) *BoltIndex {
+	t.Helper()
+
+	index, err := OpenBoltIndex(filepath.Join(t.TempDir(), "index.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { index.Close() })
+
+	return index
+}
+
+func TestBoltIndexStoresMetadata(t *testing.T) {
+	index := openTestIndex(t)
+	ctx := context.Background()
+
+	want := UploadMetadata{
+		Slug:      "abc123",
+		CreatedAt: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC),
+		Owner:     "alice",
+		Files:     []FileMetadata{{OriginalName: "a.txt", Size: 5, SHA256: hashOf("hello")}},
+	}
+
+	if err := index.Put(ctx, want); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := index.Get(ctx, "abc123")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Owner != want.Owner || !got.CreatedAt.Equal(want.CreatedAt) || len(got.Files) != 1 || got.Files[0].SHA256 != want.Files[0].SHA256 {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+
+	uploads, err := index.List(ctx)
+	if err != nil || len(uploads) != 1 {
+		t.Fatalf("expected one upload listed, got %v, %v", uploads, err)
+	}
+
+	if err := index.Delete(ctx, "abc123"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := index.Get(ctx, "abc123"); !errors.Is(err, storage.ErrNotExist) {
+		t.Fatalf("expected %v after deleting, got %v", storage.ErrNotExist, err)
+	}
+
+	if err := index.Delete(ctx, "abc123"); err != nil {
+		t.Fatalf("expected deleting a missing upload to succeed, got %v", err)
+	}
+}
+
+func TestBoltIndexExpiredFollowsChangedExpiry(t *testing.T) {
+	index := openTestIndex(t)
+	ctx := context.Background()
+	now := time.Now()
+
+	for _, meta := range []UploadMetadata{
+		{Slug: "soon", ExpiresAt: now.Add(time.Minute)},
+		{Slug: "later", ExpiresAt: now.Add(time.Hour)},
+		{Slug: "never"},
+	} {
+		if err := index.Put(ctx, meta); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Extending an upload must drop its old position in expiry order.
+	if err := index.Put(ctx, UploadMetadata{Slug: "soon", ExpiresAt: now.Add(2 * time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	expired, err := index.Expired(ctx, now.Add(90*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(expired) != 1 || expired[0].Slug != "later" {
+		t.Fatalf("expected only later to have expired, got %+v", expired)
+	}
+
+	expired, err = index.Expired(ctx, now.Add(365*24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(expired) != 2 || expired[0].Slug != "later" || expired[1].Slug != "soon" {
+		t.Fatalf("expected later then soon, got %+v", expired)
+	}
+}
+
+func TestBoltIndexExpiredSkipsDanglingKeys(t *testing.T) {
+	index := openTestIndex(t)
+	ctx := context.Background()
+	now := time.Now()
+
+	if err := index.Put(ctx, UploadMetadata{Slug: "kept", ExpiresAt: now.Add(time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys for an upload that is gone and for an expiry the upload no
+	// longer has.
+	err := index.db.Update(func(tx *bolt.Tx) error {
+		expiry := tx.Bucket(expiryBucket)
+		if err := expiry.Put(expiryKey(now.Add(-time.Minute), "gone"), nil); err != nil {
+			return err
+		}
+
+		return expiry.Put(expiryKey(now.Add(-time.Minute), "kept"), nil)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expired, err := index.Expired(ctx, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(expired) != 1 || expired[0].Slug != "kept" {
+		t.Fatalf("expected only kept to have expired, got %+v", expired)
+	}
+
+	var keys int
+	index.db.View(func(tx *bolt.Tx) error {
+		keys = tx.Bucket(expiryBucket).Stats().KeyN
+		return nil
+	})
+
+	if keys != 1 {
+		t.Fatalf("expected the dangling expiry keys to be removed, %d keys remain", keys)
+	}
+}
+
+func TestHandlerWithBoltIndex(t *testing.T) {
+	h := NewHandler("http://example.com", t.TempDir())
+	h.Index = openTestIndex(t)
+	ctx := context.Background()
+
+	h.DefaultExpiry = time.Hour
+	meta := postUpload(t, h, map[string]string{"a.txt": "a"})
+
+	if _, err := h.Store.Stat(ctx, metadataKey(meta.Slug)); !errors.Is(err, storage.ErrNotExist) {
+		t.Fatalf("expected no %s with an index, got %v", MetadataFileName, err)
+	}
+
+	rr := httptest.NewRecorder()
+	h.ServeRaw(rr, httptest.NewRequest(http.MethodGet, "/raw/"+meta.Slug+"/a.txt", nil))
+
+	if rr.Code != http.StatusOK || rr.Body.String() != "a" {
+		t.Fatalf("expected the file, got %d %q", rr.Code, rr.Body.String())
+	}
+
+	removed, err := h.ExpireUploads(ctx, time.Now().Add(2*time.Hour))
+	if err != nil || removed != 1 {
+		t.Fatalf("expected the upload to expire, removed %d: %v", removed, err)
+	}
+
+	if _, err := h.Index.Get(ctx, meta.Slug); !errors.Is(err, storage.ErrNotExist) {
+		t.Fatalf("expected the expired upload to leave the index, got %v", err)
+	}
+}
+
+func TestImportMetadata(t *testing.T) {
+	h := NewHandler("http://example.com", t.TempDir())
+	ctx := context.Background()
+
+	meta := postUpload(t, h, map[string]string{"a.txt": "a"})
+
+	index := openTestIndex(t)
+
+	if err := CheckImported(ctx, h.Store, index); err == nil {
+		t.Fatal("expected an index missing existing uploads to be refused")
+	}
+
+	n, err := ImportMetadata(ctx, h.Store, index)
+	if err != nil || n != 1 {
+		t.Fatalf("expected 1 upload imported, got %d: %v", n, err)
+	}
+
+	if err := CheckImported(ctx, h.Store, index); err != nil {
+		t.Fatalf("expected the index to be accepted after importing, got %v", err)
+	}
+
+	if _, err := h.Store.Stat(ctx, metadataKey(meta.Slug)); !errors.Is(err, storage.ErrNotExist) {
+		t.Fatalf("expected %s to be moved aside once imported, got %v", MetadataFileName, err)
+	}
+
+	// The original is kept so the migration can be undone.
+	if _, err := h.Store.Stat(ctx, metadataKey(meta.Slug)+MigratedSuffix); err != nil {
+		t.Fatalf("expected the original %s to be kept, got %v", MetadataFileName, err)
+	}
+
+	h.Index = index
+
+	rr := httptest.NewRecorder()
+	h.ServeRaw(rr, httptest.NewRequest(http.MethodGet, "/raw/"+meta.Slug+"/a.txt", nil))
+
+	if rr.Code != http.StatusOK || rr.Body.String() != "a" {
+		t.Fatalf("expected the imported upload to be served, got %d %q", rr.Code, rr.Body.String())
+	}
+
+	if problems, err := h.Fsck(ctx, later(), FsckOptions{}); err != nil || len(problems) != 0 {
+		t.Fatalf("expected the kept original not to be taken for an orphan, got %v, %v", problems, err)
+	}
+
+	if err := h.deleteUpload(ctx, meta); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := h.Store.Stat(ctx, metadataKey(meta.Slug)+MigratedSuffix); !errors.Is(err, storage.ErrNotExist) {
+		t.Fatalf("expected the original to go with its upload, got %v", err)
+	}
+}
+
+func TestCheckImportedAcceptsEmptyStorage(t *testing.T) {
+	index := openTestIndex(t)
+
+	if err := CheckImported(context.Background(), storage.NewMemory(), index); err != nil {
+		t.Fatal(err)
+	}
+
+	if imported, err := index.Imported(); err != nil || !imported {
+		t.Fatalf("expected a fresh index to be marked imported, got %v, %v", imported, err)
+	}
+}
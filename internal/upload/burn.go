@@ -0,0 +1,108 @@
+package upload
+
+import (
+	"context"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+)
+
+// serveView delivers one file of a burn-after-read upload and spends one of
+// its views. The view is counted before any bytes are sent, so when several
+// requests race for the last view exactly one of them is served and the rest
+// get a 404. After the last view the upload is deleted. HEAD requests only
+// describe the file and spend nothing.
+func (h *Handler) serveView(w http.ResponseWriter, r *http.Request, slug, relativePath, disposition string) {
+	meta, ok := h.takeView(r, slug)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	last := meta.ViewsRemaining() == 0
+	if last {
+		// The metadata is already gone; the blobs are released only once
+		// they have been sent, since some stores cannot read deleted data.
+		defer h.discardUpload(meta)
+	}
+
+	f, ok := findFile(meta, relativePath)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	stored, err := h.Store.Get(r.Context(), f.storageKey(meta.Slug))
+	if err != nil {
+		http.Error(w, "failed to read upload", http.StatusInternalServerError)
+		return
+	}
+	defer stored.Close()
+
+	setFileHeaders(w, f, disposition)
+
+	contentType := f.ContentType
+	if contentType == "" || contentType == "application/octet-stream" {
+		contentType = mime.TypeByExtension(path.Ext(f.OriginalName))
+	}
+
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	// Ranges and conditional requests are deliberately not supported: each
+	// would spend a view without delivering the whole file.
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(stored.Info().Size, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Beam-Views-Remaining", strconv.Itoa(meta.ViewsRemaining()))
+
+	io.Copy(w, stored)
+}
+
+// takeView spends a view for GET requests, and for HEAD requests only
+// checks that one is left.
+func (h *Handler) takeView(r *http.Request, slug string) (UploadMetadata, bool) {
+	if r.Method != http.MethodHead {
+		return h.spendView(r.Context(), slug)
+	}
+
+	meta, err := h.index().Get(r.Context(), slug)
+	if err != nil || meta.Expired(time.Now()) || meta.ViewsRemaining() <= 0 {
+		return UploadMetadata{}, false
+	}
+
+	return meta, true
+}
+
+// spendView counts one view of a burn-after-read upload and returns its
+// metadata as of that view. On the last view the metadata is deleted before
+// returning, so no later request can find the upload. It reports false if
+// the upload is gone or has expired.
+func (h *Handler) spendView(ctx context.Context, slug string) (UploadMetadata, bool) {
+	h.metaMu.Lock()
+	defer h.metaMu.Unlock()
+
+	// Read again under the lock: the caller's copy may predate other views.
+	meta, err := h.index().Get(ctx, slug)
+	if err != nil || meta.Expired(time.Now()) || meta.ViewsRemaining() <= 0 {
+		return UploadMetadata{}, false
+	}
+
+	meta.Views++
+
+	if meta.ViewsRemaining() == 0 {
+		err = h.index().Delete(ctx, slug)
+	} else {
+		err = h.index().Put(ctx, meta)
+	}
+
+	if err != nil {
+		return UploadMetadata{}, false
+	}
+
+	return meta, true
+}
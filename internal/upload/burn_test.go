@@ -0,0 +1,191 @@
+package upload
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/elliota43/beam/internal/storage"
+)
+
+func createBurnUpload(t *testing.T, h *Handler, views string) UploadResponse {
+	t.Helper()
+
+	rr := createUpload(t, h, url.Values{"views": {views}}, helloFile)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+
+	var resp UploadResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	return resp
+}
+
+func TestBurnAfterReadServesOnce(t *testing.T) {
+	h := NewHandler("http://example.com", t.TempDir())
+	ctx := context.Background()
+
+	resp := createBurnUpload(t, h, "1")
+
+	if resp.ViewsRemaining != 1 {
+		t.Fatalf("expected 1 view remaining, got %d", resp.ViewsRemaining)
+	}
+
+	slug := strings.TrimPrefix(resp.URL, "http://example.com/u/")
+
+	// Browsers get the bytes too rather than a viewer page.
+	req := httptest.NewRequest(http.MethodGet, "/u/"+slug+"/hello.txt", nil)
+	req.Header.Set("Accept", "text/html")
+
+	rr := httptest.NewRecorder()
+	h.ServeUpload(rr, req)
+
+	if rr.Code != http.StatusOK || rr.Body.String() != "hello" {
+		t.Fatalf("expected file contents, got %d: %q", rr.Code, rr.Body.String())
+	}
+
+	if got := rr.Header().Get("Beam-Views-Remaining"); got != "0" {
+		t.Fatalf("expected 0 views remaining, got %q", got)
+	}
+
+	// Nothing may be cached or answered conditionally, but the digest is
+	// still there to check the bytes against.
+	if rr.Header().Get("Cache-Control") != "no-store" || rr.Header().Get("ETag") != "" {
+		t.Fatalf("expected an uncacheable response, got %v", rr.Header())
+	}
+
+	if rr.Header().Get("Repr-Digest") != reprDigest(hashOf("hello")) {
+		t.Fatalf("expected a Repr-Digest, got %q", rr.Header().Get("Repr-Digest"))
+	}
+
+	rr = httptest.NewRecorder()
+	h.ServeRaw(rr, httptest.NewRequest(http.MethodGet, "/raw/"+slug+"/hello.txt", nil))
+
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("expected %d after the last view, got %d", http.StatusNotFound, rr.Code)
+	}
+
+	if _, err := readMetadata(ctx, h.Store, slug); !errors.Is(err, storage.ErrNotExist) {
+		t.Fatalf("expected metadata to be deleted, got %v", err)
+	}
+
+	if _, err := h.Store.Stat(ctx, contentKey(hashOf("hello"))); !errors.Is(err, storage.ErrNotExist) {
+		t.Fatalf("expected blob to be deleted, got %v", err)
+	}
+}
+
+func TestBurnAfterReadCountsViews(t *testing.T) {
+	h := NewHandler("http://example.com", t.TempDir())
+
+	resp := createBurnUpload(t, h, "3")
+	slug := strings.TrimPrefix(resp.URL, "http://example.com/u/")
+
+	for _, want := range []string{"2", "1", "0"} {
+		rr := httptest.NewRecorder()
+		h.ServeRaw(rr, httptest.NewRequest(http.MethodGet, "/raw/"+slug+"/hello.txt", nil))
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		if got := rr.Header().Get("Beam-Views-Remaining"); got != want {
+			t.Fatalf("expected %s views remaining, got %q", want, got)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	h.ServeRaw(rr, httptest.NewRequest(http.MethodGet, "/raw/"+slug+"/hello.txt", nil))
+
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("expected %d after the last view, got %d", http.StatusNotFound, rr.Code)
+	}
+}
+
+func TestBurnAfterReadHasSingleWinner(t *testing.T) {
+	h := NewHandler("http://example.com", t.TempDir())
+
+	resp := createBurnUpload(t, h, "1")
+	slug := strings.TrimPrefix(resp.URL, "http://example.com/u/")
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		served int
+	)
+
+	for range 20 {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			rr := httptest.NewRecorder()
+			h.ServeRaw(rr, httptest.NewRequest(http.MethodGet, "/raw/"+slug+"/hello.txt", nil))
+
+			if rr.Code == http.StatusOK {
+				if rr.Body.String() != "hello" {
+					t.Errorf("expected full contents, got %q", rr.Body.String())
+				}
+
+				mu.Lock()
+				served++
+				mu.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if served != 1 {
+		t.Fatalf("expected exactly one request to be served, got %d", served)
+	}
+}
+
+func TestCreateUploadRejectsInvalidViews(t *testing.T) {
+	h := NewHandler("http://example.com", t.TempDir())
+
+	for _, views := range []string{"0", "-2", "many"} {
+		rr := createUpload(t, h, url.Values{"views": {views}}, helloFile)
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("expected %d for %q, got %d", http.StatusBadRequest, views, rr.Code)
+		}
+	}
+}
+
+func TestBurnAfterReadHeadSpendsNoView(t *testing.T) {
+	h := NewHandler("http://example.com", t.TempDir())
+
+	resp := createBurnUpload(t, h, "1")
+	slug := strings.TrimPrefix(resp.URL, "http://example.com/u/")
+
+	for _, target := range []string{"/raw/" + slug + "/hello.txt", "/u/" + slug + ".zip"} {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodHead, target, nil)
+
+		if strings.HasPrefix(target, "/raw/") {
+			h.ServeRaw(rr, req)
+		} else {
+			h.ServeUpload(rr, req)
+		}
+
+		if rr.Code != http.StatusOK || rr.Header().Get("Beam-Views-Remaining") != "1" {
+			t.Fatalf("expected HEAD %s to leave the view, got %d %v", target, rr.Code, rr.Header())
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	h.ServeRaw(rr, httptest.NewRequest(http.MethodGet, "/raw/"+slug+"/hello.txt", nil))
+
+	if rr.Code != http.StatusOK || rr.Body.String() != "hello" {
+		t.Fatalf("expected the file after HEAD requests, got %d %q", rr.Code, rr.Body.String())
+	}
+}
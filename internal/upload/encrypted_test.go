@@ -0,0 +1,96 @@
+package upload
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestEncryptedUploadServesDecryptingPage(t *testing.T) {
+	h := NewHandler("http://example.com", t.TempDir())
+
+	rr := createUpload(t, h, url.Values{"encrypted": {"true"}}, helloFile)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+
+	var resp UploadResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if !resp.Encrypted {
+		t.Fatal("expected the response to mark the upload encrypted")
+	}
+
+	target := strings.TrimPrefix(resp.Files[0].URL, h.BaseURL)
+
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.Header.Set("Accept", "text/html")
+
+	rr = httptest.NewRecorder()
+	h.ServeUpload(rr, req)
+
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "crypto.subtle") {
+		t.Fatalf("expected the decrypting page, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// Everything else still gets the stored bytes.
+	rr = httptest.NewRecorder()
+	h.ServeUpload(rr, httptest.NewRequest(http.MethodGet, target, nil))
+
+	if rr.Code != http.StatusOK || rr.Body.String() != "hello" {
+		t.Fatalf("expected the stored bytes, got %d %q", rr.Code, rr.Body.String())
+	}
+
+	rr = createUpload(t, h, url.Values{"encrypted": {"maybe"}}, helloFile)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected %d for an invalid flag, got %d", http.StatusBadRequest, rr.Code)
+	}
+}
+
+func TestServeUploadInfo(t *testing.T) {
+	h := NewHandler("http://example.com", t.TempDir())
+	h.DefaultExpiry = 0
+
+	meta := postUpload(t, h, map[string]string{"docs/a.txt": "a", "b.txt": "bb"})
+
+	rr := httptest.NewRecorder()
+	h.ServeUploadInfo(rr, httptest.NewRequest(http.MethodGet, "/api/uploads/"+meta.Slug, nil))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, rr.Code)
+	}
+
+	if strings.Contains(rr.Body.String(), "owner_token") {
+		t.Fatalf("expected no owner token, got %s", rr.Body.String())
+	}
+
+	var info UploadResponse
+	if err := json.NewDecoder(rr.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+
+	if info.URL != "http://example.com/u/"+meta.Slug || len(info.Files) != 2 {
+		t.Fatalf("unexpected upload info: %+v", info)
+	}
+
+	for _, f := range info.Files {
+		stored, ok := findFile(meta, f.Path)
+		if !ok || f.Hash != stored.SHA256 || f.Size != stored.Size {
+			t.Fatalf("expected %+v to describe a stored file", f)
+		}
+	}
+
+	for _, target := range []string{"/api/uploads/missing0", "/api/uploads/" + meta.Slug + "/b.txt"} {
+		rr := httptest.NewRecorder()
+		h.ServeUploadInfo(rr, httptest.NewRequest(http.MethodGet, target, nil))
+
+		if rr.Code != http.StatusNotFound {
+			t.Fatalf("expected %d for %s, got %d", http.StatusNotFound, target, rr.Code)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package upload
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// httpError is an error that carries the status code it should be reported
+// to the client with.
+type httpError struct {
+	status  int
+	message string
+}
+
+func newHTTPError(status int, format string, args ...any) error {
+	return &httpError{status: status, message: fmt.Sprintf(format, args...)}
+}
+
+func (e *httpError) Error() string {
+	return e.message
+}
+
+// asRequestError reports a failure reading the request body. Hitting the
+// request size limit becomes a 413; anything else is blamed on the request.
+func asRequestError(err error, message string) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return newHTTPError(http.StatusRequestEntityTooLarge, "upload too large")
+	}
+
+	return newHTTPError(http.StatusBadRequest, "%s", message)
+}
+
+// bodyReader remembers the first error reading a request body, so that a
+// client sending a broken or oversized body can be told apart from the
+// server failing to store what it sent.
+type bodyReader struct {
+	r   io.Reader
+	err error
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != nil && err != io.EOF && b.err == nil {
+		b.err = err
+	}
+
+	return n, err
+}
+
+// storeError reports a failure copying body into storage: one reading body
+// with asRequestError, and anything else, such as a full disk or an
+// unavailable store, as a 500 with message.
+func storeError(body *bodyReader, message string) error {
+	if body.err != nil {
+		return asRequestError(body.err, "failed to read upload data")
+	}
+
+	return newHTTPError(http.StatusInternalServerError, "%s", message)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	var he *httpError
+	if errors.As(err, &he) {
+		http.Error(w, he.message, he.status)
+		return
+	}
+
+	http.Error(w, "internal server error", http.StatusInternalServerError)
+}
@@ -0,0 +1,57 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/elliota43/beam/internal/storage"
+)
+
+// ExpireUploads deletes every upload whose lifetime has passed as of now and
+// returns how many were removed.
+func (h *Handler) ExpireUploads(ctx context.Context, now time.Time) (int, error) {
+	expired, err := h.index().Expired(ctx, now)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+
+	for _, meta := range expired {
+		deleted, err := h.expireUpload(ctx, meta.Slug, now)
+		if err != nil {
+			return removed, err
+		}
+
+		if deleted {
+			removed++
+		}
+	}
+
+	return removed, nil
+}
+
+// expireUpload deletes an upload if it is still there and still expired.
+// It reads the upload again under metaMu: since it was listed it may have
+// been deleted by its owner, lost a file or spent its last view, and
+// releasing its blobs a second time could free ones other uploads use.
+func (h *Handler) expireUpload(ctx context.Context, slug string, now time.Time) (bool, error) {
+	h.metaMu.Lock()
+	defer h.metaMu.Unlock()
+
+	meta, err := h.index().Get(ctx, slug)
+	if errors.Is(err, storage.ErrNotExist) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	if !meta.Expired(now) {
+		return false, nil
+	}
+
+	return true, h.deleteUpload(ctx, meta)
+}
@@ -0,0 +1,197 @@
+package upload
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elliota43/beam/internal/storage"
+)
+
+func TestCreateUploadSetsRequestedExpiry(t *testing.T) {
+	h := NewHandler("http://example.com", t.TempDir())
+
+	rr := createUpload(t, h, url.Values{"expires": {"90m"}}, helloFile)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+
+	var resp UploadResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if d := time.Until(resp.ExpiresAt); d < 89*time.Minute || d > 90*time.Minute {
+		t.Fatalf("expected expiry in about 90 minutes, got %s", resp.ExpiresAt)
+	}
+}
+
+func TestCreateUploadAppliesDefaultExpiry(t *testing.T) {
+	h := NewHandler("http://example.com", t.TempDir())
+	h.DefaultExpiry = time.Hour
+
+	meta := postUpload(t, h, map[string]string{"a.txt": "a"})
+
+	if got := meta.ExpiresAt.Sub(meta.CreatedAt); got != time.Hour {
+		t.Fatalf("expected default expiry of 1h, got %s", got)
+	}
+
+	h.DefaultExpiry = 0
+
+	meta = postUpload(t, h, map[string]string{"a.txt": "a"})
+
+	if !meta.ExpiresAt.IsZero() {
+		t.Fatalf("expected upload without expiry, got %s", meta.ExpiresAt)
+	}
+}
+
+func TestCreateUploadRejectsInvalidExpiry(t *testing.T) {
+	h := NewHandler("http://example.com", t.TempDir())
+	h.MaxExpiry = 24 * time.Hour
+
+	for _, expires := range []string{"soon", "-1h", "0s", "48h"} {
+		rr := createUpload(t, h, url.Values{"expires": {expires}}, helloFile)
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("expected %d for %q, got %d", http.StatusBadRequest, expires, rr.Code)
+		}
+	}
+
+	objects, err := h.Store.List(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(objects) != 0 {
+		t.Fatalf("expected rejected uploads to leave nothing behind, got %+v", objects)
+	}
+}
+
+func TestServeUploadReturnsGoneWhenExpired(t *testing.T) {
+	h := NewHandler("http://example.com", t.TempDir())
+	h.Store = storage.NewMemory()
+
+	meta := postUpload(t, h, map[string]string{"a.txt": "a", "b.txt": "b"})
+	meta.ExpiresAt = time.Now().Add(-time.Minute)
+
+	if err := writeMetadata(context.Background(), h.Store, meta); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, target := range []string{"/u/" + meta.Slug, "/u/" + meta.Slug + "/a.txt", "/raw/" + meta.Slug + "/a.txt"} {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+
+		if strings.HasPrefix(target, "/raw/") {
+			h.ServeRaw(rr, req)
+		} else {
+			h.ServeUpload(rr, req)
+		}
+
+		if rr.Code != http.StatusGone {
+			t.Fatalf("expected %d for %s, got %d", http.StatusGone, target, rr.Code)
+		}
+	}
+}
+
+func TestExpireUploadsRemovesExpiredUploads(t *testing.T) {
+	h := NewHandler("http://example.com", t.TempDir())
+	ctx := context.Background()
+
+	h.DefaultExpiry = time.Hour
+	expiring := postUpload(t, h, map[string]string{"shared.txt": "shared", "gone.txt": "gone"})
+
+	h.DefaultExpiry = 0
+	kept := postUpload(t, h, map[string]string{"shared.txt": "shared"})
+
+	removed, err := h.ExpireUploads(ctx, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if removed != 0 {
+		t.Fatalf("expected nothing to expire yet, removed %d", removed)
+	}
+
+	removed, err = h.ExpireUploads(ctx, time.Now().Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if removed != 1 {
+		t.Fatalf("expected 1 upload to expire, removed %d", removed)
+	}
+
+	if _, err := readMetadata(ctx, h.Store, expiring.Slug); !errors.Is(err, storage.ErrNotExist) {
+		t.Fatalf("expected expired upload metadata to be removed, got %v", err)
+	}
+
+	if _, err := h.Store.Stat(ctx, contentKey(hashOf("gone"))); !errors.Is(err, storage.ErrNotExist) {
+		t.Fatalf("expected expired upload's blob to be removed, got %v", err)
+	}
+
+	data, err := storage.ReadAll(ctx, h.Store, kept.Files[0].storageKey(kept.Slug))
+	if err != nil || string(data) != "shared" {
+		t.Fatalf("expected blob shared with a live upload to survive, got %q, %v", data, err)
+	}
+}
+
+// racingIndex runs beforeReturn after listing expired uploads and before
+// returning them, to interleave other requests with a sweep.
+type racingIndex struct {
+	Index
+	beforeReturn func()
+}
+
+func (r racingIndex) Expired(ctx context.Context, now time.Time) ([]UploadMetadata, error) {
+	expired, err := r.Index.Expired(ctx, now)
+	r.beforeReturn()
+	return expired, err
+}
+
+func TestExpireUploadsRacingDeleteReleasesBlobsOnce(t *testing.T) {
+	h := NewHandler("http://example.com", t.TempDir())
+	h.Store = storage.NewMemory()
+	ctx := context.Background()
+
+	token := "secret-token"
+	kept := postUpload(t, h, map[string]string{"shared.txt": "shared"})
+
+	meta := postUpload(t, h, map[string]string{"shared.txt": "shared"})
+	meta.ExpiresAt = time.Now().Add(-time.Minute)
+	meta.OwnerTokenHash = hashOwnerToken(token)
+
+	if err := h.index().Put(ctx, meta); err != nil {
+		t.Fatal(err)
+	}
+
+	// The owner deletes the upload after the sweeper has listed it.
+	h.Index = racingIndex{Index: h.index(), beforeReturn: func() {
+		if rr := deleteRequest(h, "/api/uploads/"+meta.Slug, token); rr.Code != http.StatusNoContent {
+			t.Errorf("expected %d, got %d", http.StatusNoContent, rr.Code)
+		}
+	}}
+
+	removed, err := h.ExpireUploads(ctx, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if removed != 0 {
+		t.Fatalf("expected the deleted upload not to be expired again, removed %d", removed)
+	}
+
+	if refs, _, _ := h.readRefs(ctx, hashOf("shared")); refs != 1 {
+		t.Fatalf("expected the live upload to hold the only reference, got %d", refs)
+	}
+
+	data, err := storage.ReadAll(ctx, h.Store, kept.Files[0].storageKey(kept.Slug))
+	if err != nil || string(data) != "shared" {
+		t.Fatalf("expected the shared blob to survive, got %q, %v", data, err)
+	}
+}
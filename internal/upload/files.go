@@ -1,6 +1,183 @@
 package upload
 
+import (
+	"fmt"
+	"io/fs"
+	"mime"
+	"net/textproto"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
 type UploadFile struct {
 	AbsolutePath string
 	RelativePath string
+	// ModTime is sent so archives of the upload can restore it. It is left
+	// zero for files whose times should not be shared.
+	ModTime time.Time
+	// ContentType, when set, is sent as the file's type.
+	ContentType string
+}
+
+// CollectFiles expands the given paths into the list of files to upload.
+// Plain files are uploaded under their base name; directories are walked
+// recursively and their files keep their path relative to the directory's
+// parent, so `beam ./myproject` uploads myproject/main.go and so on.
+func CollectFiles(paths []string) ([]UploadFile, error) {
+	var files []UploadFile
+	seen := make(map[string]string)
+	tree := newFilePaths()
+
+	add := func(abs, rel string, modTime time.Time) error {
+		rel = filepath.ToSlash(rel)
+
+		if prev, ok := seen[rel]; ok {
+			return fmt.Errorf("%s and %s would both be uploaded as %s", prev, abs, rel)
+		}
+
+		if err := tree.add(rel); err != nil {
+			return fmt.Errorf("%s: %w", abs, err)
+		}
+
+		seen[rel] = abs
+		files = append(files, UploadFile{AbsolutePath: abs, RelativePath: rel, ModTime: modTime})
+		return nil
+	}
+
+	for _, p := range paths {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return nil, err
+		}
+
+		info, err := os.Stat(abs)
+		if err != nil {
+			return nil, err
+		}
+
+		if !info.IsDir() {
+			if !info.Mode().IsRegular() {
+				return nil, fmt.Errorf("%s is not a regular file", p)
+			}
+
+			if err := add(abs, info.Name(), info.ModTime()); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		parent := filepath.Dir(abs)
+
+		err = filepath.WalkDir(abs, func(walkPath string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if d.IsDir() {
+				return nil
+			}
+
+			// WalkDir does not follow symlinks, so only pick up links that
+			// point at regular files rather than descending into linked dirs.
+			info, err := os.Stat(walkPath)
+			if err != nil {
+				return err
+			}
+
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+
+			rel, err := filepath.Rel(parent, walkPath)
+			if err != nil {
+				return err
+			}
+
+			return add(walkPath, rel, info.ModTime())
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return files, nil
+}
+
+// filePaths records the paths of an upload's files, refusing any path that
+// repeats an earlier one or that is also a directory holding another file:
+// an upload with both a and a/b could not be shown as a tree, archived or
+// extracted.
+type filePaths struct {
+	files map[string]bool
+	dirs  map[string]bool
+}
+
+func newFilePaths() *filePaths {
+	return &filePaths{files: make(map[string]bool), dirs: make(map[string]bool)}
+}
+
+func (fp *filePaths) add(p string) error {
+	if fp.files[p] {
+		return fmt.Errorf("duplicate file path: %s", p)
+	}
+
+	if fp.dirs[p] {
+		return fmt.Errorf("file path is also a directory: %s", p)
+	}
+
+	for dir := path.Dir(p); dir != "."; dir = path.Dir(dir) {
+		if fp.files[dir] {
+			return fmt.Errorf("file path is inside file %s: %s", dir, p)
+		}
+	}
+
+	fp.files[p] = true
+
+	for dir := path.Dir(p); dir != "." && !fp.dirs[dir]; dir = path.Dir(dir) {
+		fp.dirs[dir] = true
+	}
+
+	return nil
+}
+
+// cleanRelativePath normalizes a client supplied path and rejects anything
+// that could escape the upload, such as absolute paths or ".." segments.
+func cleanRelativePath(name string) (string, error) {
+	name = strings.ReplaceAll(name, `\`, "/")
+
+	if name == "" || strings.ContainsRune(name, 0) {
+		return "", fmt.Errorf("invalid file path %q", name)
+	}
+
+	if strings.HasPrefix(name, "/") || (len(name) >= 2 && name[1] == ':') {
+		return "", fmt.Errorf("absolute file paths are not allowed: %q", name)
+	}
+
+	for _, segment := range strings.Split(name, "/") {
+		if segment == ".." {
+			return "", fmt.Errorf("file path escapes upload: %q", name)
+		}
+	}
+
+	cleaned := path.Clean(name)
+	if cleaned == "." {
+		return "", fmt.Errorf("invalid file path %q", name)
+	}
+
+	return cleaned, nil
+}
+
+// partFilename returns the filename parameter of a multipart part as sent by
+// the client. mime/multipart strips directory components from filenames, so
+// the Content-Disposition header is parsed directly to keep relative paths.
+func partFilename(header textproto.MIMEHeader) string {
+	_, params, err := mime.ParseMediaType(header.Get("Content-Disposition"))
+	if err != nil {
+		return ""
+	}
+
+	return params["filename"]
 }
@@ -0,0 +1,103 @@
+package upload
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCollectFilesWalksDirectories(t *testing.T) {
+	root := t.TempDir()
+	project := filepath.Join(root, "myproject")
+
+	for _, name := range []string{"main.go", "cmd/main.go", "internal/pkg/doc.go"} {
+		path := filepath.Join(project, filepath.FromSlash(name))
+
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(path, []byte("package main"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	single := filepath.Join(root, "notes.txt")
+	if err := os.WriteFile(single, []byte("notes"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := CollectFiles([]string{project, single})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"myproject/cmd/main.go",
+		"myproject/internal/pkg/doc.go",
+		"myproject/main.go",
+		"notes.txt",
+	}
+
+	if len(files) != len(want) {
+		t.Fatalf("expected %d files, got %d", len(want), len(files))
+	}
+
+	for i, f := range files {
+		if f.RelativePath != want[i] {
+			t.Fatalf("expected file %d to be %q, got %q", i, want[i], f.RelativePath)
+		}
+
+		if !filepath.IsAbs(f.AbsolutePath) {
+			t.Fatalf("expected absolute path, got %q", f.AbsolutePath)
+		}
+	}
+}
+
+func TestCollectFilesRejectsDuplicatePaths(t *testing.T) {
+	root := t.TempDir()
+
+	for _, dir := range []string{"a", "b"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(filepath.Join(root, dir, "main.go"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := CollectFiles([]string{
+		filepath.Join(root, "a", "main.go"),
+		filepath.Join(root, "b", "main.go"),
+	})
+	if err == nil {
+		t.Fatal("expected duplicate relative paths to be rejected")
+	}
+}
+
+func TestCleanRelativePath(t *testing.T) {
+	valid := map[string]string{
+		"a.txt":         "a.txt",
+		"dir/a.txt":     "dir/a.txt",
+		"dir//./a.txt":  "dir/a.txt",
+		`dir\sub\a.txt`: "dir/sub/a.txt",
+	}
+
+	for in, want := range valid {
+		got, err := cleanRelativePath(in)
+		if err != nil {
+			t.Fatalf("expected %q to be accepted: %v", in, err)
+		}
+
+		if got != want {
+			t.Fatalf("expected %q to clean to %q, got %q", in, want, got)
+		}
+	}
+
+	for _, in := range []string{"", ".", "/abs", "../x", "dir/sub/../x", "C:/x", "a\x00b"} {
+		if _, err := cleanRelativePath(in); err == nil {
+			t.Fatalf("expected %q to be rejected", in)
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package upload
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/elliota43/beam/internal/storage"
+)
+
+// quarantinePrefix is where Fsck moves damaged and orphaned objects when
+// asked to keep them. Nothing else reads or collects it.
+const quarantinePrefix = "quarantine/"
+
+// FsckOptions choose what Fsck does about the problems it finds. Without
+// Repair it only reports them.
+type FsckOptions struct {
+	// Repair deletes orphaned objects and corrupt blobs, drops files whose
+	// contents are missing or corrupt from their uploads, deleting uploads
+	// left empty, and corrects reference counts.
+	Repair bool
+	// Quarantine makes Repair move objects under quarantine/ rather than
+	// delete them.
+	Quarantine bool
+}
+
+// FsckProblem is one inconsistency between the index and the objects in
+// storage.
+type FsckProblem struct {
+	// Kind is "corrupt", "missing", "orphan" or "refs".
+	Kind string
+	Key  string
+	// Slug and Path name the affected upload file, if any.
+	Slug   string
+	Path   string
+	Detail string
+}
+
+func (p FsckProblem) String() string {
+	s := p.Kind + " " + p.Key
+	if p.Slug != "" {
+		s += fmt.Sprintf(" (upload %s file %s)", p.Slug, p.Path)
+	}
+
+	if p.Detail != "" {
+		s += ": " + p.Detail
+	}
+
+	return s
+}
+
+// Fsck checks every committed upload against storage: that each file's
+// contents exist and match its SHA-256, that every blob and per-upload
+// object belongs to some upload, and that reference counts match the files
+// using each blob. It reads every stored byte. Like CollectGarbage it leaves
+// staging/, and objects and counts changed within gcGracePeriod of now, to
+// a later pass, since they may belong to uploads in flight on a running
+// server.
+func (h *Handler) Fsck(ctx context.Context, now time.Time, opts FsckOptions) ([]FsckProblem, error) {
+	uploads, err := h.index().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	objects, err := h.Store.List(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	stored := make(map[string]bool, len(objects))
+	for _, obj := range objects {
+		stored[obj.Key] = true
+	}
+
+	var problems []FsckProblem
+
+	// bad holds keys whose contents cannot be served: missing, or not
+	// matching the hash their files were uploaded with.
+	bad := make(map[string]bool)
+	checked := make(map[string]bool)
+
+	live := make(map[string]int)
+	owned := make(map[string]bool)
+
+	for _, meta := range uploads {
+		owned[metadataKey(meta.Slug)] = true
+
+		for _, f := range meta.Files {
+			key := f.storageKey(meta.Slug)
+			owned[key] = true
+
+			if f.StoredName == "" {
+				live[f.SHA256]++
+			}
+
+			if !checked[key] {
+				checked[key] = true
+
+				switch sum, err := h.hashStored(ctx, key); {
+				case errors.Is(err, storage.ErrNotExist):
+					bad[key] = true
+				case err != nil:
+					return nil, err
+				case sum != f.SHA256:
+					bad[key] = true
+					problems = append(problems, FsckProblem{Kind: "corrupt", Key: key, Detail: "contents have sha256 " + sum})
+				}
+			}
+
+			if bad[key] && h.stillIndexed(ctx, meta.Slug) {
+				problems = append(problems, FsckProblem{Kind: "missing", Key: key, Slug: meta.Slug, Path: f.Path(), Detail: "contents are missing or corrupt"})
+			}
+		}
+	}
+
+	var orphans []string
+
+	for _, obj := range objects {
+		if owned[obj.Key] || !beamObject(obj.Key) || strings.HasPrefix(obj.Key, stagingPrefix) {
+			continue
+		}
+
+		if now.Sub(obj.ModTime) <= gcGracePeriod {
+			continue
+		}
+
+		orphans = append(orphans, obj.Key)
+		problems = append(problems, FsckProblem{Kind: "orphan", Key: obj.Key, Detail: "not part of any upload"})
+	}
+
+	if opts.Repair {
+		if uploads, err = h.dropBadFiles(ctx, uploads, bad); err != nil {
+			return problems, err
+		}
+
+		for _, key := range append(orphans, slices.Sorted(maps.Keys(bad))...) {
+			if err := h.discardObject(ctx, key, stored[key], opts.Quarantine); err != nil {
+				return problems, err
+			}
+		}
+
+		// Count again without the dropped files.
+		clear(live)
+		for _, meta := range uploads {
+			for _, f := range meta.Files {
+				if f.StoredName == "" {
+					live[f.SHA256]++
+				}
+			}
+		}
+	}
+
+	refProblems, err := h.checkRefs(ctx, now, objects, live, opts.Repair)
+	if err != nil {
+		return problems, err
+	}
+
+	return append(problems, refProblems...), nil
+}
+
+// stillIndexed reports whether an upload has not been deleted since Fsck
+// listed it, so its files being gone is not mistaken for damage.
+func (h *Handler) stillIndexed(ctx context.Context, slug string) bool {
+	_, err := h.index().Get(ctx, slug)
+	return !errors.Is(err, storage.ErrNotExist)
+}
+
+// beamObject reports whether key is laid out like something beam stores,
+// other than reference counts and metadata kept from before the index, so
+// files it does not know about, such as an index kept beside the storage
+// directory, are never taken for orphans.
+func beamObject(key string) bool {
+	switch {
+	case strings.HasPrefix(key, refsPrefix), strings.HasPrefix(key, quarantinePrefix):
+		return false
+	case strings.HasSuffix(key, "/"+MetadataFileName+MigratedSuffix):
+		return false
+	case strings.HasPrefix(key, blobsPrefix), strings.HasPrefix(key, stagingPrefix):
+		return true
+	}
+
+	slug, _, ok := strings.Cut(key, "/")
+	return ok && validSlug(slug)
+}
+
+// hashStored returns the SHA-256 of a stored object's contents.
+func (h *Handler) hashStored(ctx context.Context, key string) (string, error) {
+	obj, err := h.Store.Get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer obj.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, obj); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// dropBadFiles removes the files whose contents are in bad from their
+// uploads, deleting uploads with no files left, and returns the uploads
+// that remain. Blobs are not released: their counts are corrected after.
+func (h *Handler) dropBadFiles(ctx context.Context, uploads []UploadMetadata, bad map[string]bool) ([]UploadMetadata, error) {
+	var kept []UploadMetadata
+
+	for _, meta := range uploads {
+		// Start from the upload as it is now, in case it has changed or
+		// been deleted since it was listed.
+		meta, err := h.index().Get(ctx, meta.Slug)
+		if errors.Is(err, storage.ErrNotExist) {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		files := slices.DeleteFunc(slices.Clone(meta.Files), func(f FileMetadata) bool {
+			return bad[f.storageKey(meta.Slug)]
+		})
+
+		switch {
+		case len(files) == len(meta.Files):
+			kept = append(kept, meta)
+			continue
+		case len(files) == 0:
+			if err := h.index().Delete(ctx, meta.Slug); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		meta.Files = files
+		if err := h.index().Put(ctx, meta); err != nil {
+			return nil, err
+		}
+
+		kept = append(kept, meta)
+	}
+
+	return kept, nil
+}
+
+// discardObject deletes an object, or moves it under quarantine/.
+func (h *Handler) discardObject(ctx context.Context, key string, exists, quarantine bool) error {
+	if !exists {
+		return nil
+	}
+
+	var err error
+
+	if quarantine {
+		err = h.Store.Rename(ctx, key, quarantinePrefix+key)
+	} else {
+		err = h.Store.Delete(ctx, key)
+	}
+
+	if errors.Is(err, storage.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+// checkRefs compares each blob's reference count with the files using it,
+// writing the right count when repair is set. Counts changed recently are
+// skipped.
+func (h *Handler) checkRefs(ctx context.Context, now time.Time, objects []storage.Info, live map[string]int, repair bool) ([]FsckProblem, error) {
+	hashes := make(map[string]bool)
+	for hash := range live {
+		hashes[hash] = true
+	}
+
+	for _, obj := range objects {
+		if strings.HasPrefix(obj.Key, refsPrefix) {
+			hashes[path.Base(obj.Key)] = true
+		}
+	}
+
+	var problems []FsckProblem
+
+	for _, hash := range slices.Sorted(maps.Keys(hashes)) {
+		refs, changed, err := h.readRefs(ctx, hash)
+		if err != nil {
+			return problems, err
+		}
+
+		if refs == live[hash] || now.Sub(changed) <= gcGracePeriod {
+			continue
+		}
+
+		problems = append(problems, FsckProblem{
+			Kind:   "refs",
+			Key:    refsKey(hash),
+			Detail: fmt.Sprintf("count is %d but %d files use the blob", refs, live[hash]),
+		})
+
+		if repair {
+			if err := h.writeRefs(ctx, hash, live[hash]); err != nil {
+				return problems, err
+			}
+		}
+	}
+
+	return problems, nil
+}
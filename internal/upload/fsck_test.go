@@ -0,0 +1,174 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elliota43/beam/internal/storage"
+)
+
+func problemKinds(problems []FsckProblem) map[string]int {
+	kinds := make(map[string]int)
+	for _, p := range problems {
+		kinds[p.Kind]++
+	}
+
+	return kinds
+}
+
+// later is when objects stored by a test are old enough for Fsck to judge.
+func later() time.Time {
+	return time.Now().Add(2 * gcGracePeriod)
+}
+
+func TestFsckFindsNothingWrongWithCleanStorage(t *testing.T) {
+	h := NewHandler("http://example.com", t.TempDir())
+	h.Store = storage.NewMemory()
+
+	postUpload(t, h, map[string]string{"a.txt": "a", "b.txt": "b"})
+	postUpload(t, h, map[string]string{"a.txt": "a"})
+
+	problems, err := h.Fsck(context.Background(), time.Now(), FsckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(problems) != 0 {
+		t.Fatalf("expected no problems, got %v", problems)
+	}
+}
+
+func TestFsckReportsDamage(t *testing.T) {
+	h := NewHandler("http://example.com", t.TempDir())
+	h.Store = storage.NewMemory()
+	ctx := context.Background()
+
+	postUpload(t, h, map[string]string{"a.txt": "a", "b.txt": "b"})
+
+	h.Store.Put(ctx, contentKey(hashOf("a")), strings.NewReader("not a"))
+	h.Store.Delete(ctx, contentKey(hashOf("b")))
+	h.Store.Put(ctx, contentKey(hashOf("stray")), strings.NewReader("stray"))
+
+	problems, err := h.Fsck(ctx, later(), FsckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kinds := problemKinds(problems)
+	if kinds["corrupt"] != 1 || kinds["missing"] != 2 || kinds["orphan"] != 1 {
+		t.Fatalf("expected a corrupt blob, two missing files and an orphan, got %v", problems)
+	}
+
+	// Reporting alone must not change anything.
+	if _, err := h.Store.Stat(ctx, contentKey(hashOf("stray"))); err != nil {
+		t.Fatalf("expected the orphan to be left alone, got %v", err)
+	}
+}
+
+func TestFsckRepairQuarantinesDamage(t *testing.T) {
+	h := NewHandler("http://example.com", t.TempDir())
+	h.Store = storage.NewMemory()
+	ctx := context.Background()
+
+	damaged := postUpload(t, h, map[string]string{"a.txt": "a", "b.txt": "b"})
+	lost := postUpload(t, h, map[string]string{"c.txt": "c"})
+
+	h.Store.Put(ctx, contentKey(hashOf("a")), strings.NewReader("not a"))
+	h.Store.Delete(ctx, contentKey(hashOf("c")))
+	h.Store.Put(ctx, contentKey(hashOf("stray")), strings.NewReader("stray"))
+
+	if _, err := h.Fsck(ctx, later(), FsckOptions{Repair: true, Quarantine: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	meta, err := h.index().Get(ctx, damaged.Slug)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(meta.Files) != 1 || meta.Files[0].Path() != "b.txt" {
+		t.Fatalf("expected only the intact file to remain, got %+v", meta.Files)
+	}
+
+	if _, err := h.index().Get(ctx, lost.Slug); !errors.Is(err, storage.ErrNotExist) {
+		t.Fatalf("expected an upload without intact files to be deleted, got %v", err)
+	}
+
+	for _, key := range []string{contentKey(hashOf("a")), contentKey(hashOf("stray"))} {
+		if _, err := h.Store.Stat(ctx, quarantinePrefix+key); err != nil {
+			t.Fatalf("expected %s in quarantine, got %v", key, err)
+		}
+	}
+
+	if refs, _, _ := h.readRefs(ctx, hashOf("a")); refs != 0 {
+		t.Fatalf("expected the corrupt blob's references to be dropped, got %d", refs)
+	}
+
+	problems, err := h.Fsck(ctx, later(), FsckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(problems) != 0 {
+		t.Fatalf("expected repaired storage to be clean, got %v", problems)
+	}
+}
+
+func TestFsckRepairFixesReferenceCounts(t *testing.T) {
+	h := NewHandler("http://example.com", t.TempDir())
+	h.Store = storage.NewMemory()
+	ctx := context.Background()
+
+	postUpload(t, h, map[string]string{"a.txt": "a"})
+	h.writeRefs(ctx, hashOf("a"), 5)
+
+	problems, err := h.Fsck(ctx, later(), FsckOptions{Repair: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if kinds := problemKinds(problems); kinds["refs"] != 1 {
+		t.Fatalf("expected a reference count problem, got %v", problems)
+	}
+
+	if refs, _, _ := h.readRefs(ctx, hashOf("a")); refs != 1 {
+		t.Fatalf("expected the count to be corrected to 1, got %d", refs)
+	}
+}
+
+func TestFsckRepairLeavesRecentObjectsAlone(t *testing.T) {
+	h := NewHandler("http://example.com", t.TempDir())
+	h.Store = storage.NewMemory()
+	ctx := context.Background()
+
+	postUpload(t, h, map[string]string{"a.txt": "a"})
+
+	// What an upload in flight on a running server leaves behind.
+	recent := []string{contentKey(hashOf("new")), stagingPrefix + "upload", "abcdefgh/file"}
+	for _, key := range recent {
+		h.Store.Put(ctx, key, strings.NewReader("new"))
+	}
+	h.writeRefs(ctx, hashOf("new"), 1)
+
+	problems, err := h.Fsck(ctx, time.Now(), FsckOptions{Repair: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(problems) != 0 {
+		t.Fatalf("expected recent objects to be skipped, got %v", problems)
+	}
+
+	for _, key := range recent {
+		if _, err := h.Store.Stat(ctx, key); err != nil {
+			t.Fatalf("expected %s to be left alone, got %v", key, err)
+		}
+	}
+
+	if refs, _, _ := h.readRefs(ctx, hashOf("new")); refs != 1 {
+		t.Fatalf("expected the recent count to be left alone, got %d", refs)
+	}
+}
@@ -1,8 +1,9 @@
 package upload
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
-	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
@@ -10,10 +11,15 @@ import (
 	"io"
 	"mime/multipart"
 	"net/http"
-	"os"
+	"net/url"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/elliota43/beam/internal/storage"
 )
 
 const (
@@ -23,43 +29,157 @@ const (
 )
 
 type Handler struct {
-	BaseURL     string
-	StorageDir  string
-	MaxFileSize int64
+	BaseURL       string
+	StorageDir    string
+	Store         storage.Store
+	PartialsDir   string
+	MaxFileSize   int64
+	MaxUploadSize int64
+	PartialTTL    time.Duration
+
+	// DefaultExpiry is how long uploads are kept when the client does not
+	// ask for a lifetime, and MaxExpiry the longest a client may ask for.
+	// Zero means uploads are kept forever and any lifetime is allowed.
+	DefaultExpiry time.Duration
+	MaxExpiry     time.Duration
+
+	// APIKeys, when set, are required by handlers wrapped in RequireAPIKey.
+	APIKeys APIKeys
+
+	// Limits throttles handlers wrapped in LimitUploads, LimitUploadBytes
+	// and LimitDownloads.
+	Limits Limits
+
+	// Quota caps the bytes each identity may keep stored, with anonymous
+	// uploads sharing one allowance. Zero means no quota.
+	Quota int64
+
+	// Index holds committed uploads' metadata. When nil, each upload's
+	// metadata is kept in a metadata.json object in Store.
+	Index Index
+
+	// MinFreeSpace is how much free disk space under StorageDir uploads
+	// must leave. Zero disables the check.
+	MinFreeSpace int64
+
+	// blobMu serialises changes to blob reference counts.
+	blobMu sync.Mutex
+
+	// usageMu guards usage, each identity's stored bytes, which is nil
+	// until first needed, and heldPartials, the partials whose length is
+	// counted in usage until they are claimed or removed.
+	usageMu      sync.Mutex
+	usage        map[string]int64
+	heldPartials map[string]heldPartial
+
+	// partialLocks holds a *sync.Mutex for each partial being written,
+	// deleted or claimed. See lockPartial.
+	partialLocks sync.Map
+
+	// metaMu serialises changes to existing uploads' metadata, such as
+	// counting views or deleting single files.
+	metaMu sync.Mutex
+
+	// unlockKey signs the cookies that unlock password-protected uploads.
+	// It is random per process, so a restart locks them again.
+	unlockKey []byte
 }
 
 type UploadResponse struct {
-	URL   string         `json:"url"`
-	Files []FileResponse `json:"files"`
+	URL            string         `json:"url"`
+	ExpiresAt      time.Time      `json:"expires_at,omitzero"`
+	ViewsRemaining int            `json:"views_remaining,omitempty"`
+	Encrypted      bool           `json:"encrypted,omitempty"`
+	OwnerToken     string         `json:"owner_token,omitempty"`
+	Files          []FileResponse `json:"files"`
 }
 
 type FileResponse struct {
 	Name string `json:"name"`
+	Path string `json:"path"`
 	Size int64  `json:"size"`
 	URL  string `json:"url"`
 	Hash string `json:"sha256"`
 }
 
 type UploadMetadata struct {
-	Slug      string         `json:"slug"`
-	CreatedAt time.Time      `json:"created_at"`
+	Slug      string    `json:"slug"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+	// Owner is the identity of the API key the upload was made with, if any.
+	Owner string `json:"owner,omitempty"`
+	// MaxViews makes the upload burn after reading: it is deleted once its
+	// files have been downloaded that many times in total. Views counts the
+	// downloads so far.
+	MaxViews int `json:"max_views,omitempty"`
+	Views    int `json:"views,omitempty"`
+	// OwnerTokenHash is the SHA-256 of the secret token returned to the
+	// uploader, which is needed to delete the upload or its files.
+	OwnerTokenHash string `json:"owner_token_sha256,omitempty"`
+	// PasswordHash, when set, is an Argon2id hash of the password needed
+	// to view or download the upload.
+	PasswordHash string `json:"password_hash,omitempty"`
+	// Encrypted marks uploads whose files and names were encrypted by the
+	// client. The server only ever sees ciphertext; the key travels in the
+	// fragment of the upload's URL.
+	Encrypted bool           `json:"encrypted,omitempty"`
 	Files     []FileMetadata `json:"files"`
 }
 
+// ViewsRemaining returns how many more downloads a burn-after-read upload
+// allows, or 0 for uploads without a view limit.
+func (m UploadMetadata) ViewsRemaining() int {
+	if m.MaxViews == 0 {
+		return 0
+	}
+
+	return m.MaxViews - m.Views
+}
+
+// Expired reports whether the upload's lifetime has passed. Uploads without
+// an expiry never expire.
+func (m UploadMetadata) Expired(now time.Time) bool {
+	return !m.ExpiresAt.IsZero() && !now.Before(m.ExpiresAt)
+}
+
 type FileMetadata struct {
 	OriginalName string    `json:"original_name"`
-	StoredName   string    `json:"stored_name"`
+	RelativePath string    `json:"relative_path,omitempty"`
+	StoredName   string    `json:"stored_name,omitempty"`
 	Size         int64     `json:"size"`
 	ContentType  string    `json:"content_type"`
 	SHA256       string    `json:"sha256"`
 	CreatedAt    time.Time `json:"created_at"`
+	// ModTime is the file's modification time on the uploader's machine,
+	// when the client sent one.
+	ModTime time.Time `json:"mod_time,omitzero"`
+}
+
+// Path returns the file's location within its upload. Uploads made before
+// relative paths were recorded only have an original name.
+func (f FileMetadata) Path() string {
+	if f.RelativePath != "" {
+		return f.RelativePath
+	}
+
+	return f.OriginalName
 }
 
 func NewHandler(baseURL, storageDir string) *Handler {
+	unlockKey := make([]byte, 32)
+	rand.Read(unlockKey)
+
 	return &Handler{
-		BaseURL:     baseURL,
-		StorageDir:  storageDir,
-		MaxFileSize: 100 << 20,
+		BaseURL:       baseURL,
+		StorageDir:    storageDir,
+		Store:         storage.NewFS(storageDir),
+		PartialsDir:   filepath.Join(storageDir, PartialsDirName),
+		MaxFileSize:   100 << 20,
+		MaxUploadSize: 1 << 30,
+		PartialTTL:    24 * time.Hour,
+		DefaultExpiry: 7 * 24 * time.Hour,
+		MaxExpiry:     30 * 24 * time.Hour,
+		unlockKey:     unlockKey,
 	}
 }
 
@@ -69,16 +189,18 @@ func (h *Handler) CreateUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	r.Body = http.MaxBytesReader(w, r.Body, h.MaxFileSize*10)
-
-	if err := r.ParseMultipartForm(32 << 20); err != nil {
-		http.Error(w, "invalid multipart upload", http.StatusBadRequest)
+	if err := h.checkFreeSpace(); err != nil {
+		writeError(w, err)
 		return
 	}
 
-	files := r.MultipartForm.File["files"]
-	if len(files) == 0 {
-		http.Error(w, "no files provided", http.StatusBadRequest)
+	r.Body = http.MaxBytesReader(w, r.Body, h.MaxUploadSize)
+
+	// Parts are streamed straight into storage as they arrive rather than
+	// buffered by ParseMultipartForm, so each file is written exactly once.
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "invalid multipart upload", http.StatusBadRequest)
 		return
 	}
 
@@ -88,99 +210,259 @@ func (h *Handler) CreateUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	uploadDir := filepath.Join(h.StorageDir, slug)
-	if err := os.MkdirAll(uploadDir, 0755); err != nil {
-		http.Error(w, "failed to create upload directory", http.StatusInternalServerError)
+	ownerToken, err := randomSlug(OwnerTokenLength)
+	if err != nil {
+		http.Error(w, "failed to generate owner token", http.StatusInternalServerError)
 		return
 	}
 
 	meta := UploadMetadata{
-		Slug:      slug,
-		CreatedAt: time.Now().UTC(),
+		Slug:           slug,
+		CreatedAt:      time.Now().UTC(),
+		Owner:          identityFrom(r.Context()),
+		OwnerTokenHash: hashOwnerToken(ownerToken),
+	}
+
+	if h.DefaultExpiry > 0 {
+		meta.ExpiresAt = meta.CreatedAt.Add(h.DefaultExpiry)
+		if h.MaxExpiry > 0 && h.DefaultExpiry > h.MaxExpiry {
+			meta.ExpiresAt = meta.CreatedAt.Add(h.MaxExpiry)
+		}
 	}
 
 	resp := UploadResponse{
-		URL: fmt.Sprintf("%s/u/%s", h.BaseURL, slug),
+		URL:        fmt.Sprintf("%s/u/%s", h.BaseURL, slug),
+		OwnerToken: ownerToken,
 	}
 
-	for _, fh := range files {
-		fileMeta, fileResp, err := h.saveUploadedFile(slug, uploadDir, fh)
-		if err != nil {
-			_ = os.RemoveAll(uploadDir)
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
+	ctx := r.Context()
 
-		meta.Files = append(meta.Files, fileMeta)
-		resp.Files = append(resp.Files, fileResp)
+	partials, err := h.receiveParts(ctx, reader, &meta, &resp)
+	if err != nil {
+		h.abandonUpload(meta, partials)
+		writeError(w, err)
+		return
 	}
 
-	if err := writeMetadata(uploadDir, meta); err != nil {
-		_ = os.RemoveAll(uploadDir)
+	if len(meta.Files) == 0 {
+		h.discardUpload(meta)
+		http.Error(w, "no files provided", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.index().Put(ctx, meta); err != nil {
+		h.abandonUpload(meta, partials)
 		http.Error(w, "failed to persist upload metadata", http.StatusInternalServerError)
 		return
 	}
 
+	for _, id := range partials {
+		h.releasePartial(id)
+	}
+
+	resp.ExpiresAt = meta.ExpiresAt
+	resp.ViewsRemaining = meta.ViewsRemaining()
+	resp.Encrypted = meta.Encrypted
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(resp)
 }
 
-func (h *Handler) saveUploadedFile(slug, uploadDir string, fh *multipart.FileHeader) (FileMetadata, FileResponse, error) {
-	if fh.Size > h.MaxFileSize {
-		return FileMetadata{}, FileResponse{}, fmt.Errorf("file too large: %s", fh.Filename)
+// receiveParts consumes the multipart body, saving every "files" part into
+// storage and recording it in meta and resp. Files are added to meta as soon
+// as they are stored, and counted against the owner's quota, so
+// discardUpload can release them if a later part fails.
+// Settings fields such as "expires" are applied with readSetting. "partial" fields name
+// completed resumable uploads to include; their ids are returned, even
+// with an error, so they can be released once the upload is committed or
+// kept for a retry. Other fields are ignored.
+func (h *Handler) receiveParts(ctx context.Context, reader *multipart.Reader, meta *UploadMetadata, resp *UploadResponse) ([]string, error) {
+	paths := newFilePaths()
+
+	var partials []string
+
+	// The body's size limit only covers files sent inline, so claimed
+	// partials are counted here as well.
+	var total int64
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return partials, nil
+		}
+
+		if err != nil {
+			return partials, asRequestError(err, "invalid multipart upload")
+		}
+
+		if part.FormName() == "expires" || part.FormName() == "views" || part.FormName() == "password" || part.FormName() == "encrypted" {
+			err = h.readSetting(part, meta)
+			part.Close()
+			if err != nil {
+				return partials, err
+			}
+			continue
+		}
+
+		if part.FormName() != "files" && part.FormName() != "partial" {
+			part.Close()
+			continue
+		}
+
+		if err := h.checkFreeSpace(); err != nil {
+			part.Close()
+			return partials, err
+		}
+
+		var fileMeta FileMetadata
+		var fileResp FileResponse
+
+		if part.FormName() == "partial" {
+			id, readErr := io.ReadAll(io.LimitReader(part, 256))
+			if readErr != nil {
+				part.Close()
+				return partials, asRequestError(readErr, "invalid multipart upload")
+			}
+
+			fileMeta, fileResp, err = h.claimPartial(ctx, meta.Slug, string(id))
+			if err == nil {
+				partials = append(partials, string(id))
+			}
+		} else {
+			fileMeta, fileResp, err = h.saveUploadedPart(ctx, meta.Slug, part)
+		}
+
+		part.Close()
+		if err != nil {
+			return partials, err
+		}
+
+		total += fileMeta.Size
+		if total > h.MaxUploadSize {
+			h.releaseBlobs(context.Background(), []FileMetadata{fileMeta})
+			return partials, newHTTPError(http.StatusRequestEntityTooLarge, "upload too large")
+		}
+
+		// A claimed partial's length is already counted against the quota.
+		if part.FormName() == "partial" {
+			err = h.reserveClaimed(ctx, partials[len(partials)-1], meta.Owner, fileMeta.Size)
+		} else {
+			err = h.reserveQuota(ctx, meta.Owner, fileMeta.Size)
+		}
+
+		if err != nil {
+			h.releaseBlobs(context.Background(), []FileMetadata{fileMeta})
+			return partials, err
+		}
+
+		meta.Files = append(meta.Files, fileMeta)
+
+		if err := paths.add(fileMeta.Path()); err != nil {
+			return partials, newHTTPError(http.StatusBadRequest, "%s", err)
+		}
+		resp.Files = append(resp.Files, fileResp)
 	}
+}
 
-	src, err := fh.Open()
+// readSetting applies an upload setting sent as a form field: "expires" is
+// a lifetime such as "24h" measured from when the upload was created, and
+// "views" the number of downloads after which the upload is deleted,
+// "password" a password that must be given to read it, and "encrypted"
+// whether the client encrypted the files.
+func (h *Handler) readSetting(part *multipart.Part, meta *UploadMetadata) error {
+	data, err := io.ReadAll(io.LimitReader(part, MaxPasswordLength+1))
 	if err != nil {
-		return FileMetadata{}, FileResponse{}, fmt.Errorf("failed to open uploaded file")
+		return asRequestError(err, "invalid multipart upload")
 	}
-	defer src.Close()
 
-	storedName, err := randomSlug(StorageSlugLength)
-	if err != nil {
-		return FileMetadata{}, FileResponse{}, fmt.Errorf("failed to generate stored filename")
+	if part.FormName() == "password" {
+		if len(data) == 0 || len(data) > MaxPasswordLength {
+			return newHTTPError(http.StatusBadRequest, "password must be 1 to %d bytes", MaxPasswordLength)
+		}
+
+		meta.PasswordHash = hashPassword(string(data))
+		return nil
 	}
 
-	storedPath := filepath.Join(uploadDir, storedName)
+	value := strings.TrimSpace(string(data))
 
-	dst, err := os.OpenFile(storedPath, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
-	if err != nil {
-		return FileMetadata{}, FileResponse{}, fmt.Errorf("failed to create stored file")
+	switch part.FormName() {
+	case "expires":
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return newHTTPError(http.StatusBadRequest, "invalid expiry: %q", value)
+		}
+
+		if h.MaxExpiry > 0 && d > h.MaxExpiry {
+			return newHTTPError(http.StatusBadRequest, "expiry exceeds the server maximum of %s", h.MaxExpiry)
+		}
+
+		meta.ExpiresAt = meta.CreatedAt.Add(d)
+	case "views":
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return newHTTPError(http.StatusBadRequest, "invalid view count: %q", value)
+		}
+
+		meta.MaxViews = n
+	case "encrypted":
+		encrypted, err := strconv.ParseBool(value)
+		if err != nil {
+			return newHTTPError(http.StatusBadRequest, "invalid encrypted flag: %q", value)
+		}
+
+		meta.Encrypted = encrypted
 	}
 
-	defer dst.Close()
+	return nil
+}
 
-	hasher := sha256.New()
+func (h *Handler) saveUploadedPart(ctx context.Context, slug string, part *multipart.Part) (FileMetadata, FileResponse, error) {
+	relativePath, err := cleanRelativePath(partFilename(part.Header))
+	if err != nil {
+		return FileMetadata{}, FileResponse{}, newHTTPError(http.StatusBadRequest, "%s", err)
+	}
+
+	// Read one byte past the limit so oversized files are detected without
+	// writing more than MaxFileSize+1 bytes of them.
+	body := &bodyReader{r: io.LimitReader(part, h.MaxFileSize+1)}
 
-	n, err := io.Copy(io.MultiWriter(dst, hasher), src)
+	staged, err := h.stageBlob(ctx, body)
 	if err != nil {
-		_ = os.Remove(storedPath)
-		return FileMetadata{}, FileResponse{}, fmt.Errorf("failed to save uploaded file")
+		return FileMetadata{}, FileResponse{}, storeError(body, "failed to save uploaded file")
 	}
 
+	n := staged.size
+
 	if n > h.MaxFileSize {
-		_ = os.Remove(storedPath)
-		return FileMetadata{}, FileResponse{}, fmt.Errorf("file too large: %s", fh.Filename)
+		h.discardStaged(staged)
+		return FileMetadata{}, FileResponse{}, newHTTPError(http.StatusBadRequest, "file too large: %s", relativePath)
 	}
 
-	originalName := filepath.Base(fh.Filename)
-	hash := hex.EncodeToString(hasher.Sum(nil))
+	if err := h.commitBlob(ctx, staged); err != nil {
+		return FileMetadata{}, FileResponse{}, newHTTPError(http.StatusInternalServerError, "failed to save uploaded file")
+	}
+
+	originalName := path.Base(relativePath)
+	hash := staged.hash
 	createdAt := time.Now().UTC()
 
 	fileMeta := FileMetadata{
 		OriginalName: originalName,
-		StoredName:   storedName,
+		RelativePath: relativePath,
 		Size:         n,
-		ContentType:  fh.Header.Get("Content-Type"),
+		ContentType:  part.Header.Get("Content-Type"),
 		SHA256:       hash,
 		CreatedAt:    createdAt,
+		ModTime:      parseModTime(part.Header.Get("Last-Modified")),
 	}
 
 	fileResp := FileResponse{
 		Name: originalName,
+		Path: relativePath,
 		Size: n,
-		URL:  fmt.Sprintf("%s/u/%s/%s", h.BaseURL, slug, originalName),
+		URL:  h.BaseURL + fileURLPath(slug, relativePath),
 		Hash: hash,
 	}
 
@@ -188,114 +470,396 @@ func (h *Handler) saveUploadedFile(slug, uploadDir string, fh *multipart.FileHea
 }
 
 func (h *Handler) ServeUpload(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// supports:
+	// supports, along with HEAD for each:
 	// GET /u/{slug}
-	// GET /u/{slug}/{filename}
-	path := strings.TrimPrefix(r.URL.Path, "/u/")
-	parts := strings.SplitN(path, "/", 2)
+	// GET /u/{slug}/{path...}
+	// GET /u/{slug}.zip
+	// GET /u/{slug}.tar.gz
+	//
+	// Files are rendered as an HTML page for browsers and served as bytes
+	// for everything else, e.g. curl.
+	if slug, ext, ok := parseArchivePath(r.URL.Path); ok {
+		h.serveArchive(w, r, slug, ext)
+		return
+	}
 
-	if len(parts) == 0 || parts[0] == "" {
-		http.NotFound(w, r)
+	// The same URL is a page for browsers and bytes for everything else,
+	// so caches must keep them apart.
+	w.Header().Set("Vary", "Accept")
+
+	meta, rest, ok := h.loadUpload(w, r, "/u/")
+	if !ok {
 		return
 	}
 
-	slug := parts[0]
-	uploadDir := filepath.Join(h.StorageDir, slug)
+	// Encrypted uploads are listed and shown by a page that decrypts them
+	// in the browser with the key from the URL fragment.
+	if meta.Encrypted && wantsHTML(r) {
+		h.renderEncrypted(w, meta)
+		return
+	}
 
-	meta, err := readMetadata(uploadDir)
+	if rest == "" {
+		if len(meta.Files) == 1 {
+			http.Redirect(w, r, fileURLPath(meta.Slug, meta.Files[0].Path()), http.StatusFound)
+			return
+		}
+
+		root, ok := buildTree(meta, "")
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		h.renderDirectory(w, meta, root)
+		return
+	}
+
+	relativePath, err := cleanRelativePath(rest)
 	if err != nil {
 		http.NotFound(w, r)
 		return
 	}
 
-	if len(parts) == 1 || parts[1] == "" {
-		if len(meta.Files) == 1 {
-			http.Redirect(w, r, "/u/"+slug+"/"+meta.Files[0].OriginalName, http.StatusFound)
+	if f, ok := findFile(meta, relativePath); ok {
+		// Burn-after-read files skip the viewer: its page and the raw bytes
+		// it links to would each spend a view.
+		if meta.MaxViews > 0 {
+			h.serveView(w, r, meta.Slug, f.Path(), "attachment")
+			return
+		}
+
+		if wantsHTML(r) {
+			h.renderFile(w, r, meta, f)
 			return
 		}
 
-		h.renderFileList(w, meta)
+		h.serveStoredFile(w, r, meta, f, "attachment")
 		return
 	}
 
-	requestedName := filepath.Base(parts[1])
+	if root, ok := buildTree(meta, relativePath); ok {
+		h.renderDirectory(w, meta, root)
+		return
+	}
 
-	for _, f := range meta.Files {
-		if f.OriginalName == requestedName {
-			storedPath := filepath.Join(uploadDir, f.StoredName)
+	http.NotFound(w, r)
+}
 
-			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", f.OriginalName))
+func (h *Handler) ServeRaw(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
-			if f.ContentType != "" {
-				w.Header().Set("Content-Type", f.ContentType)
-			}
+	// supports, along with HEAD for each:
+	// GET /raw/{slug}/{path...}
+	// GET /raw/{slug}/{path...}?download=1
+	meta, rest, ok := h.loadUpload(w, r, "/raw/")
+	if !ok {
+		return
+	}
 
-			http.ServeFile(w, r, storedPath)
-			return
-		}
+	relativePath, err := cleanRelativePath(rest)
+	if err != nil {
+		http.NotFound(w, r)
+		return
 	}
 
-	http.NotFound(w, r)
+	f, ok := findFile(meta, relativePath)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	disposition := "inline"
+	if r.URL.Query().Has("download") {
+		disposition = "attachment"
+	}
+
+	if meta.MaxViews > 0 {
+		h.serveView(w, r, meta.Slug, f.Path(), disposition)
+		return
+	}
+
+	h.serveStoredFile(w, r, meta, f, disposition)
 }
 
-func (h *Handler) renderFileList(w http.ResponseWriter, meta UploadMetadata) {
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+// ServeUploadInfo describes an upload and its files as JSON, in the same
+// shape CreateUpload returns but without the owner token. Reading it does
+// not count as a view.
+func (h *Handler) ServeUploadInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// supports:
+	// GET /api/uploads/{slug}
+	meta, rest, ok := h.loadUpload(w, r, "/api/uploads/")
+	if !ok {
+		return
+	}
+
+	if rest != "" {
+		http.NotFound(w, r)
+		return
+	}
 
-	fmt.Fprintf(w, "<h1>beam upload: %s</h1>", meta.Slug)
-	fmt.Fprintln(w, "<ul>")
+	resp := UploadResponse{
+		URL:            fmt.Sprintf("%s/u/%s", h.BaseURL, meta.Slug),
+		ExpiresAt:      meta.ExpiresAt,
+		ViewsRemaining: meta.ViewsRemaining(),
+		Encrypted:      meta.Encrypted,
+		Files:          make([]FileResponse, 0, len(meta.Files)),
+	}
 
 	for _, f := range meta.Files {
-		fmt.Fprintf(
-			w,
-			`<li><a href="/u/%s/%s">%s</a> (%d bytes)</li>`,
-			meta.Slug,
-			f.OriginalName,
-			f.OriginalName,
-			f.Size,
-		)
+		resp.Files = append(resp.Files, FileResponse{
+			Name: f.OriginalName,
+			Path: f.Path(),
+			Size: f.Size,
+			URL:  h.BaseURL + fileURLPath(meta.Slug, f.Path()),
+			Hash: f.SHA256,
+		})
 	}
 
-	fmt.Fprintln(w, "</ul>")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(resp)
 }
 
-func writeMetadata(uploadDir string, meta UploadMetadata) error {
-	path := filepath.Join(uploadDir, MetadataFileName)
+// loadUpload reads the metadata for the upload named in the request path,
+// as openUpload does, and returns the remainder of the path after the slug.
+func (h *Handler) loadUpload(w http.ResponseWriter, r *http.Request, prefix string) (UploadMetadata, string, bool) {
+	slug, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, prefix), "/")
 
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	meta, ok := h.openUpload(w, r, slug)
+	if !ok {
+		return UploadMetadata{}, "", false
+	}
+
+	return meta, rest, true
+}
+
+// openUpload reads an upload's metadata as findUpload does. It also writes a
+// 401 and returns false when the upload needs a password the request does
+// not carry.
+func (h *Handler) openUpload(w http.ResponseWriter, r *http.Request, slug string) (UploadMetadata, bool) {
+	meta, ok := h.findUpload(w, r, slug)
+	if !ok {
+		return UploadMetadata{}, false
+	}
+
+	if meta.PasswordHash != "" && !h.unlock(w, r, meta) {
+		return UploadMetadata{}, false
+	}
+
+	return meta, true
+}
+
+// findUpload reads an upload's metadata. It writes a 404 and returns false
+// when the upload does not exist, or a 410 when it has expired but not yet
+// been swept away.
+func (h *Handler) findUpload(w http.ResponseWriter, r *http.Request, slug string) (UploadMetadata, bool) {
+	if !validSlug(slug) {
+		http.NotFound(w, r)
+		return UploadMetadata{}, false
+	}
+
+	meta, err := h.index().Get(r.Context(), slug)
 	if err != nil {
-		return err
+		http.NotFound(w, r)
+		return UploadMetadata{}, false
+	}
+
+	if meta.Expired(time.Now()) {
+		http.Error(w, "upload has expired", http.StatusGone)
+		return UploadMetadata{}, false
+	}
+
+	return meta, true
+}
+
+func (h *Handler) serveStoredFile(w http.ResponseWriter, r *http.Request, meta UploadMetadata, f FileMetadata, disposition string) {
+	stored, err := h.Store.Get(r.Context(), f.storageKey(meta.Slug))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer stored.Close()
+
+	setFileHeaders(w, f, disposition)
+
+	// Leave generic types unset so ServeContent can pick one from the file
+	// extension or content instead.
+	if f.ContentType != "" && f.ContentType != "application/octet-stream" {
+		w.Header().Set("Content-Type", f.ContentType)
 	}
-	defer f.Close()
 
-	enc := json.NewEncoder(f)
-	enc.SetIndent("", "  ")
+	// A file's contents never change once uploaded and slugs are never
+	// reused, so its hash is a strong validator and caches need not
+	// revalidate it. ServeContent answers If-Match, If-None-Match and
+	// If-Range from the ETag.
+	if f.SHA256 != "" {
+		w.Header().Set("ETag", strconv.Quote(f.SHA256))
+		w.Header().Set("Cache-Control", cacheControl(r, meta, time.Now()))
+	}
 
-	return enc.Encode(meta)
+	// ServeContent rather than ServeFile: ServeFile redirects any request
+	// ending in /index.html, which would make uploaded index.html files
+	// unreachable.
+	http.ServeContent(w, r, f.OriginalName, stored.Info().ModTime, stored)
 }
 
-func readMetadata(uploadDir string) (UploadMetadata, error) {
-	path := filepath.Join(uploadDir, MetadataFileName)
+// maxCacheAge is how long caches may keep a file from an upload that never
+// expires.
+const maxCacheAge = 365 * 24 * time.Hour
+
+// cacheControl lets caches keep a file, without revalidating, until its
+// upload expires. Files read with credentials, a password or an API key
+// under -private-reads, must be revalidated and are only kept by the client
+// that sent them, so a cache never hands them to someone without access.
+// Burn-after-reading files are served with no-store by serveView.
+func cacheControl(r *http.Request, meta UploadMetadata, now time.Time) string {
+	if meta.PasswordHash != "" || r.Header.Get("Authorization") != "" {
+		return "private, no-cache"
+	}
 
-	f, err := os.Open(path)
+	age := maxCacheAge
+	if !meta.ExpiresAt.IsZero() {
+		age = min(age, max(meta.ExpiresAt.Sub(now), 0))
+	}
+
+	return fmt.Sprintf("public, max-age=%d, immutable", int64(age/time.Second))
+}
+
+// reprDigest formats a file's SHA-256 as an RFC 9530 Repr-Digest value,
+// which describes the whole file even in a range response. It returns ""
+// for files without a usable hash.
+func reprDigest(hash string) string {
+	sum, err := hex.DecodeString(hash)
+	if err != nil || len(sum) != 32 {
+		return ""
+	}
+
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(sum) + ":"
+}
+
+func setFileHeaders(w http.ResponseWriter, f FileMetadata, disposition string) {
+	w.Header().Set("Content-Disposition", fmt.Sprintf("%s; filename=%q", disposition, f.OriginalName))
+
+	if digest := reprDigest(f.SHA256); digest != "" {
+		w.Header().Set("Repr-Digest", digest)
+	}
+
+	// Uploaded HTML and SVG must never run as part of the beam origin.
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+}
+
+// parseModTime reads a file modification time sent by the client as an HTTP
+// date, in a part's Last-Modified header or the "lastmodified" tus metadata
+// key. Missing or malformed times are ignored.
+func parseModTime(value string) time.Time {
+	t, err := http.ParseTime(value)
 	if err != nil {
-		return UploadMetadata{}, err
+		return time.Time{}
+	}
+
+	return t.UTC()
+}
+
+// discardUpload removes everything stored for an upload that failed before
+// its metadata was committed. It runs after the request may have been
+// cancelled, so it does not use the request's context.
+func (h *Handler) discardUpload(meta UploadMetadata) {
+	_ = h.deleteUpload(context.Background(), meta)
+}
+
+// abandonUpload discards an upload that failed before it was committed, as
+// discardUpload does. The partials it claimed are left for a retry, so they
+// count against the quota again.
+func (h *Handler) abandonUpload(meta UploadMetadata, partials []string) {
+	h.discardUpload(meta)
+
+	for _, id := range partials {
+		h.restorePartialQuota(id)
 	}
+}
+
+func metadataKey(slug string) string {
+	return slug + "/" + MetadataFileName
+}
+
+func blobKey(slug, storedName string) string {
+	return slug + "/" + storedName
+}
 
-	defer f.Close()
+func writeMetadata(ctx context.Context, store storage.Store, meta UploadMetadata) error {
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = store.Put(ctx, metadataKey(meta.Slug), bytes.NewReader(append(data, '\n')))
+	return err
+}
+
+func readMetadata(ctx context.Context, store storage.Store, slug string) (UploadMetadata, error) {
+	data, err := storage.ReadAll(ctx, store, metadataKey(slug))
+	if err != nil {
+		return UploadMetadata{}, err
+	}
 
 	var meta UploadMetadata
 
-	if err := json.NewDecoder(f).Decode(&meta); err != nil {
+	if err := json.Unmarshal(data, &meta); err != nil {
 		return UploadMetadata{}, err
 	}
 	return meta, nil
 }
 
+// fileURLPath returns the escaped /u/ path for a file within an upload.
+func fileURLPath(slug, relativePath string) string {
+	return "/u/" + slug + "/" + escapePath(relativePath)
+}
+
+// rawURLPath returns the escaped /raw/ path that always serves file bytes.
+func rawURLPath(slug, relativePath string) string {
+	return "/raw/" + slug + "/" + escapePath(relativePath)
+}
+
+func escapePath(relativePath string) string {
+	segments := strings.Split(relativePath, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+
+	return strings.Join(segments, "/")
+}
+
+// validSlug reports whether s could have been produced by randomSlug, which
+// keeps values like ".." from being joined onto StorageDir.
+func validSlug(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+
+	return true
+}
+
 func randomSlug(n int) (string, error) {
 	buf := make([]byte, n)
 	if _, err := rand.Read(buf); err != nil {
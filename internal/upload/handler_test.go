@@ -2,18 +2,95 @@ package upload
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/textproto"
+	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/elliota43/beam/internal/storage"
 )
 
+// testFile is a file sent in a test upload. A non-zero modTime is sent as
+// its Last-Modified, as the client does.
+type testFile struct {
+	name    string
+	content string
+	modTime time.Time
+}
+
+var helloFile = testFile{name: "hello.txt", content: "hello"}
+
+// newUploadRequest builds a POST /api/uploads request the way the client
+// does, with the setting fields, including the ids of partials to attach,
+// before the files.
+func newUploadRequest(t *testing.T, fields url.Values, files ...testFile) *http.Request {
+	t.Helper()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	for _, name := range slices.Sorted(maps.Keys(fields)) {
+		for _, value := range fields[name] {
+			if err := writer.WriteField(name, value); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for _, f := range files {
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Disposition", multipart.FileContentDisposition("files", f.name))
+		header.Set("Content-Type", "application/octet-stream")
+
+		if !f.modTime.IsZero() {
+			header.Set("Last-Modified", f.modTime.UTC().Format(http.TimeFormat))
+		}
+
+		part, err := writer.CreatePart(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := part.Write([]byte(f.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/uploads", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	return req
+}
+
+// createUpload sends an upload built by newUploadRequest to CreateUpload.
+func createUpload(t *testing.T, h *Handler, fields url.Values, files ...testFile) *httptest.ResponseRecorder {
+	t.Helper()
+
+	rr := httptest.NewRecorder()
+	h.CreateUpload(rr, newUploadRequest(t, fields, files...))
+
+	return rr
+}
+
 func TestCreateUploadSingleFile(t *testing.T) {
 	storageDir := t.TempDir()
 	h := NewHandler("http://example.com", storageDir)
@@ -76,22 +153,13 @@ func TestCreateUploadSingleFile(t *testing.T) {
 		t.Fatalf("expected hash %s, got %s", wantHash, gotFile.Hash)
 	}
 
-	entries, err := os.ReadDir(storageDir)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	if len(entries) != 1 {
-		t.Fatalf("expected one upload directory, got %d", len(entries))
-	}
+	slug := strings.TrimPrefix(resp.URL, "http://example.com/u/")
 
-	uploadDir := filepath.Join(storageDir, entries[0].Name())
-
-	if _, err := os.Stat(filepath.Join(uploadDir, MetadataFileName)); err != nil {
+	if _, err := os.Stat(filepath.Join(storageDir, slug, MetadataFileName)); err != nil {
 		t.Fatalf("expected metadata file: %v", err)
 	}
 
-	meta, err := readMetadata(uploadDir)
+	meta, err := readMetadata(context.Background(), h.Store, slug)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -238,6 +306,43 @@ func TestCreateUploadRejectsTooLargeFile(t *testing.T) {
 	}
 }
 
+// fullStore is a store whose disk is full.
+type fullStore struct {
+	storage.Store
+}
+
+func (fullStore) Put(ctx context.Context, key string, r io.Reader) (storage.Info, error) {
+	return storage.Info{}, errors.New("no space left on device")
+}
+
+func TestCreateUploadReportsStorageFailuresAsServerErrors(t *testing.T) {
+	h := NewHandler("http://example.com", t.TempDir())
+	h.Store = fullStore{Store: storage.NewMemory()}
+
+	rr := createUpload(t, h, nil, helloFile)
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Fatalf("expected %d, got %d: %s", http.StatusInternalServerError, rr.Code, rr.Body.String())
+	}
+
+	// A body that breaks off in the middle of the file is still the
+	// client's fault.
+	req := newUploadRequest(t, nil, helloFile)
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Body = io.NopCloser(bytes.NewReader(body[:bytes.Index(body, []byte("hello\r\n"))+3]))
+
+	rr = httptest.NewRecorder()
+	NewHandler("http://example.com", t.TempDir()).CreateUpload(rr, req)
+
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "failed to read upload data") {
+		t.Fatalf("expected %d for a truncated body, got %d: %s", http.StatusBadRequest, rr.Code, rr.Body.String())
+	}
+}
+
 func TestServeUploadRedirectsSingleFileUpload(t *testing.T) {
 	storageDir := t.TempDir()
 	h := NewHandler("http://example.com", storageDir)
@@ -263,7 +368,7 @@ func TestServeUploadRedirectsSingleFileUpload(t *testing.T) {
 		},
 	}
 
-	if err := writeMetadata(uploadDir, meta); err != nil {
+	if err := writeMetadata(context.Background(), h.Store, meta); err != nil {
 		t.Fatal(err)
 	}
 
@@ -309,7 +414,7 @@ func TestServeUploadServesStoredFile(t *testing.T) {
 		},
 	}
 
-	if err := writeMetadata(uploadDir, meta); err != nil {
+	if err := writeMetadata(context.Background(), h.Store, meta); err != nil {
 		t.Fatal(err)
 	}
 
@@ -349,7 +454,7 @@ func TestServeUploadRendersFileListForMultipleFiles(t *testing.T) {
 		},
 	}
 
-	if err := writeMetadata(uploadDir, meta); err != nil {
+	if err := writeMetadata(context.Background(), h.Store, meta); err != nil {
 		t.Fatal(err)
 	}
 
@@ -402,7 +507,7 @@ func TestServeUploadReturnsNotFoundForMissingFile(t *testing.T) {
 		},
 	}
 
-	if err := writeMetadata(uploadDir, meta); err != nil {
+	if err := writeMetadata(context.Background(), h.Store, meta); err != nil {
 		t.Fatal(err)
 	}
 
@@ -417,7 +522,7 @@ func TestServeUploadReturnsNotFoundForMissingFile(t *testing.T) {
 }
 
 func TestWriteAndReadMetadata(t *testing.T) {
-	dir := t.TempDir()
+	store := storage.NewMemory()
 
 	want := UploadMetadata{
 		Slug: "abc123",
@@ -432,11 +537,11 @@ func TestWriteAndReadMetadata(t *testing.T) {
 		},
 	}
 
-	if err := writeMetadata(dir, want); err != nil {
+	if err := writeMetadata(context.Background(), store, want); err != nil {
 		t.Fatal(err)
 	}
 
-	got, err := readMetadata(dir)
+	got, err := readMetadata(context.Background(), store, "abc123")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -473,3 +578,476 @@ func TestRandomSlug(t *testing.T) {
 		t.Fatal("expected two random slugs to differ")
 	}
 }
+
+func TestCreateUploadPreservesRelativePaths(t *testing.T) {
+	storageDir := t.TempDir()
+	h := NewHandler("http://example.com", storageDir)
+
+	rr := createUpload(t, h, nil,
+		testFile{name: "myproject/main.go", content: "package main"},
+		testFile{name: "myproject/cmd/main.go", content: "package main"},
+	)
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+
+	var resp UploadResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.Files) != 2 {
+		t.Fatalf("expected 2 files, got %d", len(resp.Files))
+	}
+
+	if resp.Files[1].Path != "myproject/cmd/main.go" {
+		t.Fatalf("expected path myproject/cmd/main.go, got %q", resp.Files[1].Path)
+	}
+
+	if !strings.HasSuffix(resp.Files[1].URL, "/myproject/cmd/main.go") {
+		t.Fatalf("expected file URL to contain relative path, got %q", resp.Files[1].URL)
+	}
+
+	meta, err := readMetadata(context.Background(), h.Store, strings.TrimPrefix(resp.URL, "http://example.com/u/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if meta.Files[1].RelativePath != "myproject/cmd/main.go" {
+		t.Fatalf("expected metadata relative path myproject/cmd/main.go, got %q", meta.Files[1].RelativePath)
+	}
+
+	if meta.Files[1].OriginalName != "main.go" {
+		t.Fatalf("expected original name main.go, got %q", meta.Files[1].OriginalName)
+	}
+}
+
+func TestCreateUploadRejectsPathTraversal(t *testing.T) {
+	for _, name := range []string{"../escape.txt", "a/../../escape.txt", "/etc/passwd", `..\escape.txt`, "C:/windows.txt"} {
+		storageDir := t.TempDir()
+		h := NewHandler("http://example.com", storageDir)
+
+		rr := createUpload(t, h, nil, testFile{name: name, content: "nope"})
+
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected %d, got %d: %s", name, http.StatusBadRequest, rr.Code, rr.Body.String())
+		}
+
+		entries, err := os.ReadDir(storageDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(entries) != 0 {
+			t.Fatalf("%s: expected rejected upload to clean up storage dir, found %d entries", name, len(entries))
+		}
+	}
+}
+
+func TestCreateUploadRejectsDuplicatePaths(t *testing.T) {
+	h := NewHandler("http://example.com", t.TempDir())
+
+	// The second pair would make a both a file and a directory.
+	for _, names := range [][]string{{"dir/a.txt", "dir/./a.txt"}, {"a", "a/b"}} {
+		rr := createUpload(t, h, nil, testFile{name: names[0], content: "aaa"}, testFile{name: names[1], content: "aaa"})
+
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("expected %d for %v, got %d: %s", http.StatusBadRequest, names, rr.Code, rr.Body.String())
+		}
+	}
+}
+
+func TestFilePathsRejectsConflicts(t *testing.T) {
+	tests := []struct {
+		paths []string
+		ok    bool
+	}{
+		{[]string{"a/b", "a/c", "b"}, true},
+		{[]string{"a", "ab/c"}, true},
+		{[]string{"a", "a"}, false},
+		{[]string{"a", "a/b"}, false},
+		{[]string{"a/b/c", "a/b"}, false},
+		{[]string{"a/b", "a/b/c/d"}, false},
+	}
+
+	for _, tt := range tests {
+		paths := newFilePaths()
+
+		var err error
+		for _, p := range tt.paths {
+			if err = paths.add(p); err != nil {
+				break
+			}
+		}
+
+		if (err == nil) != tt.ok {
+			t.Errorf("%v: expected ok=%v, got %v", tt.paths, tt.ok, err)
+		}
+	}
+}
+
+func writeTreeUpload(t *testing.T, storageDir string, files map[string]string) {
+	t.Helper()
+
+	uploadDir := filepath.Join(storageDir, "abc123")
+	if err := os.MkdirAll(uploadDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	meta := UploadMetadata{Slug: "abc123"}
+
+	i := 0
+	for name, content := range files {
+		storedName := fmt.Sprintf("stored-%d", i)
+		i++
+
+		if err := os.WriteFile(filepath.Join(uploadDir, storedName), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		meta.Files = append(meta.Files, FileMetadata{
+			OriginalName: filepath.Base(name),
+			RelativePath: name,
+			StoredName:   storedName,
+			Size:         int64(len(content)),
+			ContentType:  "text/plain",
+		})
+	}
+
+	if err := writeMetadata(context.Background(), storage.NewFS(storageDir), meta); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServeUploadResolvesNestedPaths(t *testing.T) {
+	storageDir := t.TempDir()
+	h := NewHandler("http://example.com", storageDir)
+
+	writeTreeUpload(t, storageDir, map[string]string{
+		"proj/src/main.go": "package src",
+		"proj/cmd/main.go": "package cmd",
+		"proj/index.html":  "<p>hi</p>",
+	})
+
+	tests := map[string]string{
+		"/u/abc123/proj/src/main.go": "package src",
+		"/u/abc123/proj/cmd/main.go": "package cmd",
+		"/u/abc123/proj/index.html":  "<p>hi</p>",
+	}
+
+	for target, want := range tests {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		rr := httptest.NewRecorder()
+
+		h.ServeUpload(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: expected %d, got %d", target, http.StatusOK, rr.Code)
+		}
+
+		if rr.Body.String() != want {
+			t.Fatalf("%s: expected body %q, got %q", target, want, rr.Body.String())
+		}
+	}
+}
+
+func TestServeUploadListsIntermediateDirectories(t *testing.T) {
+	storageDir := t.TempDir()
+	h := NewHandler("http://example.com", storageDir)
+
+	writeTreeUpload(t, storageDir, map[string]string{
+		"proj/src/main.go": "package src",
+		"proj/cmd/main.go": "package cmd",
+		"proj/README.md":   "# proj",
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/u/abc123/proj", nil)
+	rr := httptest.NewRecorder()
+
+	h.ServeUpload(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, rr.Code)
+	}
+
+	body := rr.Body.String()
+
+	for _, want := range []string{"/u/abc123/proj/src", "/u/abc123/proj/cmd", "/u/abc123/proj/README.md"} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("expected directory listing to link %s, got %s", want, body)
+		}
+	}
+}
+
+func TestServeUploadReturnsNotFoundOutsideManifest(t *testing.T) {
+	storageDir := t.TempDir()
+	h := NewHandler("http://example.com", storageDir)
+
+	writeTreeUpload(t, storageDir, map[string]string{
+		"proj/src/main.go": "package src",
+		"proj/cmd/main.go": "package cmd",
+	})
+
+	for _, target := range []string{
+		"/u/abc123/main.go",
+		"/u/abc123/proj/src/main",
+		"/u/abc123/proj/sr",
+		"/u/abc123/proj/src/main.go/extra",
+		"/u/abc123/../abc123/proj/src/main.go",
+		"/u/abc123/" + MetadataFileName,
+		"/u/abc123/stored-0",
+	} {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		rr := httptest.NewRecorder()
+
+		h.ServeUpload(rr, req)
+
+		if rr.Code != http.StatusNotFound {
+			t.Fatalf("%s: expected %d, got %d", target, http.StatusNotFound, rr.Code)
+		}
+	}
+}
+
+func TestServeUploadRejectsInvalidSlug(t *testing.T) {
+	storageDir := t.TempDir()
+	h := NewHandler("http://example.com", filepath.Join(storageDir, "uploads"))
+
+	meta := `{"slug": "..", "files": [{"original_name": "a.txt", "stored_name": "stored-a"}]}`
+	if err := os.WriteFile(filepath.Join(storageDir, MetadataFileName), []byte(meta), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/u/../a.txt", nil)
+	rr := httptest.NewRecorder()
+
+	h.ServeUpload(rr, req)
+
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("expected %d, got %d", http.StatusNotFound, rr.Code)
+	}
+}
+
+func TestCreateUploadRejectsTooLargeUpload(t *testing.T) {
+	storageDir := t.TempDir()
+	h := NewHandler("http://example.com", storageDir)
+	h.MaxUploadSize = 1024
+
+	big := strings.Repeat("x", 600)
+
+	rr := createUpload(t, h, nil, testFile{name: "a.txt", content: big}, testFile{name: "b.txt", content: big})
+
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected %d, got %d: %s", http.StatusRequestEntityTooLarge, rr.Code, rr.Body.String())
+	}
+
+	entries, err := os.ReadDir(storageDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 0 {
+		t.Fatalf("expected failed upload to clean up storage dir, found %d entries", len(entries))
+	}
+}
+
+func TestCreateUploadStreamsPartsIntoStorage(t *testing.T) {
+	storageDir := t.TempDir()
+	h := NewHandler("http://example.com", storageDir)
+
+	pr, pw := io.Pipe()
+	writer := multipart.NewWriter(pw)
+
+	content := bytes.Repeat([]byte("beam"), 64<<10)
+
+	go func() {
+		if err := writer.WriteField("note", "ignored"); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		part, err := writer.CreateFormFile("files", "big.bin")
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		for i := 0; i < len(content); i += 4096 {
+			if _, err := part.Write(content[i : i+4096]); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+
+		pw.CloseWithError(writer.Close())
+	}()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/uploads", pr)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	rr := httptest.NewRecorder()
+	h.CreateUpload(rr, req)
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+
+	var resp UploadResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	meta, err := readMetadata(context.Background(), h.Store, strings.TrimPrefix(resp.URL, "http://example.com/u/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(meta.Files) != 1 {
+		t.Fatalf("expected 1 file, got %d", len(meta.Files))
+	}
+
+	stored, err := storage.ReadAll(context.Background(), h.Store, meta.Files[0].storageKey(meta.Slug))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(stored, content) {
+		t.Fatalf("expected stored file to match upload, got %d bytes", len(stored))
+	}
+
+	wantHash := sha256.Sum256(content)
+	if meta.Files[0].SHA256 != hex.EncodeToString(wantHash[:]) {
+		t.Fatalf("expected hash of streamed content, got %s", meta.Files[0].SHA256)
+	}
+}
+
+func TestUploadRoundTripWithMemoryStore(t *testing.T) {
+	h := NewHandler("http://example.com", t.TempDir())
+	h.Store = storage.NewMemory()
+
+	rr := createUpload(t, h, nil, testFile{name: "docs/hello.txt", content: "hello memory"})
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+
+	var resp UploadResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, strings.TrimPrefix(resp.Files[0].URL, "http://example.com"), nil)
+	rr = httptest.NewRecorder()
+
+	h.ServeUpload(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, rr.Code)
+	}
+
+	if rr.Body.String() != "hello memory" {
+		t.Fatalf("expected stored content, got %q", rr.Body.String())
+	}
+}
+
+func TestServeRawSetsValidators(t *testing.T) {
+	h := NewHandler("http://example.com", t.TempDir())
+	meta := postUpload(t, h, map[string]string{"hello.txt": "hello"})
+
+	get := func(header, value string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/raw/"+meta.Slug+"/hello.txt", nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+
+		rr := httptest.NewRecorder()
+		h.ServeRaw(rr, req)
+		return rr
+	}
+
+	rr := get("", "")
+	etag := `"` + hashOf("hello") + `"`
+
+	if rr.Code != http.StatusOK || rr.Header().Get("ETag") != etag {
+		t.Fatalf("expected ETag %s, got %d %v", etag, rr.Code, rr.Header())
+	}
+
+	if got := rr.Header().Get("Cache-Control"); !strings.HasPrefix(got, "public, max-age=") || !strings.HasSuffix(got, ", immutable") {
+		t.Fatalf("expected an immutable response, got %q", got)
+	}
+
+	// sha256("hello") in the structured field byte sequence form.
+	if got := rr.Header().Get("Repr-Digest"); got != "sha-256=:LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=:" {
+		t.Fatalf("unexpected Repr-Digest %q", got)
+	}
+
+	if rr := get("If-None-Match", etag); rr.Code != http.StatusNotModified {
+		t.Fatalf("expected %d for a matching If-None-Match, got %d", http.StatusNotModified, rr.Code)
+	}
+
+	if rr := get("If-None-Match", `"other"`); rr.Code != http.StatusOK {
+		t.Fatalf("expected %d for a different If-None-Match, got %d", http.StatusOK, rr.Code)
+	}
+
+	if rr := get("If-Match", `"other"`); rr.Code != http.StatusPreconditionFailed {
+		t.Fatalf("expected %d for a different If-Match, got %d", http.StatusPreconditionFailed, rr.Code)
+	}
+
+	if rr := get("If-Match", etag); rr.Code != http.StatusOK || rr.Body.String() != "hello" {
+		t.Fatalf("expected the file for a matching If-Match, got %d %q", rr.Code, rr.Body.String())
+	}
+
+	head := httptest.NewRequest(http.MethodHead, "/raw/"+meta.Slug+"/hello.txt", nil)
+	head.Header.Set("If-None-Match", etag)
+
+	rr = httptest.NewRecorder()
+	h.ServeRaw(rr, head)
+
+	if rr.Code != http.StatusNotModified || rr.Header().Get("ETag") != etag {
+		t.Fatalf("expected HEAD to be answered from the ETag, got %d %v", rr.Code, rr.Header())
+	}
+}
+
+func TestServeUploadVariesByAccept(t *testing.T) {
+	h := NewHandler("http://example.com", t.TempDir())
+	meta := postUpload(t, h, map[string]string{"hello.txt": "hello"})
+
+	for _, accept := range []string{"text/html", "*/*"} {
+		req := httptest.NewRequest(http.MethodGet, "/u/"+meta.Slug+"/hello.txt", nil)
+		req.Header.Set("Accept", accept)
+
+		rr := httptest.NewRecorder()
+		h.ServeUpload(rr, req)
+
+		if rr.Code != http.StatusOK || rr.Header().Get("Vary") != "Accept" {
+			t.Fatalf("expected Vary: Accept for %q, got %d %v", accept, rr.Code, rr.Header())
+		}
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	now := time.Now()
+
+	anonymous := httptest.NewRequest(http.MethodGet, "/raw/abc123/a.txt", nil)
+	withKey := httptest.NewRequest(http.MethodGet, "/raw/abc123/a.txt", nil)
+	withKey.Header.Set("Authorization", "Bearer key")
+
+	tests := []struct {
+		name string
+		req  *http.Request
+		meta UploadMetadata
+		want string
+	}{
+		{"never expires", anonymous, UploadMetadata{}, "public, max-age=31536000, immutable"},
+		{"expires", anonymous, UploadMetadata{ExpiresAt: now.Add(time.Hour)}, "public, max-age=3600, immutable"},
+		{"expired", anonymous, UploadMetadata{ExpiresAt: now.Add(-time.Hour)}, "public, max-age=0, immutable"},
+		{"password", anonymous, UploadMetadata{PasswordHash: "x"}, "private, no-cache"},
+		{"api key", withKey, UploadMetadata{}, "private, no-cache"},
+	}
+
+	for _, tt := range tests {
+		if got := cacheControl(tt.req, tt.meta, now); got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,408 @@
+package upload
+
+import (
+	"path"
+	"strings"
+)
+
+type language struct {
+	Name          string
+	Keywords      []string
+	IgnoreCase    bool
+	LineComments  []string
+	BlockComments [][2]string
+	// Quotes are single-line string delimiters; BlockStrings may span lines.
+	Quotes       string
+	BlockStrings []string
+}
+
+type span struct {
+	Class string
+	Text  string
+}
+
+var (
+	cLikeKeywords = []string{
+		"auto", "break", "case", "catch", "char", "class", "const", "continue", "default",
+		"delete", "do", "double", "else", "enum", "extends", "false", "final", "float",
+		"for", "goto", "if", "implements", "import", "int", "interface", "long", "namespace",
+		"new", "null", "nullptr", "package", "private", "protected", "public", "return",
+		"short", "signed", "sizeof", "static", "struct", "super", "switch", "template",
+		"this", "throw", "throws", "true", "try", "typedef", "union", "unsigned", "using",
+		"virtual", "void", "volatile", "while",
+	}
+
+	languages = map[string]*language{
+		"go": {
+			Name: "Go",
+			Keywords: []string{
+				"break", "case", "chan", "const", "continue", "default", "defer", "else",
+				"fallthrough", "for", "func", "go", "goto", "if", "import", "interface", "map",
+				"package", "range", "return", "select", "struct", "switch", "type", "var",
+				"nil", "true", "false", "iota",
+			},
+			LineComments:  []string{"//"},
+			BlockComments: [][2]string{{"/*", "*/"}},
+			Quotes:        `"'`,
+			BlockStrings:  []string{"`"},
+		},
+		"python": {
+			Name: "Python",
+			Keywords: []string{
+				"and", "as", "assert", "async", "await", "break", "class", "continue", "def",
+				"del", "elif", "else", "except", "finally", "for", "from", "global", "if",
+				"import", "in", "is", "lambda", "nonlocal", "not", "or", "pass", "raise",
+				"return", "try", "while", "with", "yield", "None", "True", "False",
+			},
+			LineComments: []string{"#"},
+			Quotes:       `"'`,
+			BlockStrings: []string{`"""`, `'''`},
+		},
+		"javascript": {
+			Name: "JavaScript",
+			Keywords: []string{
+				"async", "await", "break", "case", "catch", "class", "const", "continue",
+				"debugger", "default", "delete", "do", "else", "export", "extends", "false",
+				"finally", "for", "from", "function", "if", "import", "in", "instanceof",
+				"interface", "let", "new", "null", "of", "return", "static", "super", "switch",
+				"this", "throw", "true", "try", "type", "typeof", "undefined", "var", "void",
+				"while", "yield",
+			},
+			LineComments:  []string{"//"},
+			BlockComments: [][2]string{{"/*", "*/"}},
+			Quotes:        `"'`,
+			BlockStrings:  []string{"`"},
+		},
+		"rust": {
+			Name: "Rust",
+			Keywords: []string{
+				"as", "async", "await", "break", "const", "continue", "crate", "dyn", "else",
+				"enum", "extern", "false", "fn", "for", "if", "impl", "in", "let", "loop",
+				"match", "mod", "move", "mut", "pub", "ref", "return", "self", "Self",
+				"static", "struct", "super", "trait", "true", "type", "unsafe", "use",
+				"where", "while",
+			},
+			LineComments:  []string{"//"},
+			BlockComments: [][2]string{{"/*", "*/"}},
+			Quotes:        `"`,
+		},
+		"c": {
+			Name:          "C-like",
+			Keywords:      cLikeKeywords,
+			LineComments:  []string{"//"},
+			BlockComments: [][2]string{{"/*", "*/"}},
+			Quotes:        `"'`,
+		},
+		"shell": {
+			Name: "Shell",
+			Keywords: []string{
+				"case", "do", "done", "elif", "else", "esac", "export", "fi", "for",
+				"function", "if", "in", "local", "return", "then", "until", "while",
+			},
+			LineComments: []string{"#"},
+			Quotes:       `"'`,
+		},
+		"ruby": {
+			Name: "Ruby",
+			Keywords: []string{
+				"begin", "class", "def", "do", "else", "elsif", "end", "ensure", "false",
+				"for", "if", "module", "next", "nil", "require", "rescue", "return", "self",
+				"then", "true", "unless", "until", "when", "while", "yield",
+			},
+			LineComments: []string{"#"},
+			Quotes:       `"'`,
+		},
+		"sql": {
+			Name: "SQL",
+			Keywords: []string{
+				"and", "as", "by", "create", "delete", "drop", "from", "group", "having",
+				"index", "inner", "insert", "into", "join", "left", "limit", "not", "null",
+				"on", "or", "order", "primary", "key", "select", "set", "table", "update",
+				"values", "where",
+			},
+			IgnoreCase:    true,
+			LineComments:  []string{"--"},
+			BlockComments: [][2]string{{"/*", "*/"}},
+			Quotes:        `'"`,
+		},
+		"json": {
+			Name:     "JSON",
+			Keywords: []string{"true", "false", "null"},
+			Quotes:   `"`,
+		},
+		"yaml": {
+			Name:         "YAML",
+			Keywords:     []string{"true", "false", "null", "yes", "no"},
+			LineComments: []string{"#"},
+			Quotes:       `"'`,
+		},
+		"toml": {
+			Name:         "TOML",
+			Keywords:     []string{"true", "false"},
+			LineComments: []string{"#"},
+			Quotes:       `"'`,
+			BlockStrings: []string{`"""`, `'''`},
+		},
+		"html": {
+			Name:          "HTML",
+			BlockComments: [][2]string{{"<!--", "-->"}},
+			Quotes:        `"'`,
+		},
+		"css": {
+			Name:          "CSS",
+			BlockComments: [][2]string{{"/*", "*/"}},
+			Quotes:        `"'`,
+		},
+		"make": {
+			Name:         "Makefile",
+			Keywords:     []string{"define", "endef", "ifeq", "ifneq", "ifdef", "ifndef", "else", "endif", "include"},
+			LineComments: []string{"#"},
+		},
+		"dockerfile": {
+			Name: "Dockerfile",
+			Keywords: []string{
+				"ADD", "ARG", "CMD", "COPY", "ENTRYPOINT", "ENV", "EXPOSE", "FROM", "LABEL",
+				"RUN", "USER", "VOLUME", "WORKDIR", "AS",
+			},
+			LineComments: []string{"#"},
+			Quotes:       `"'`,
+		},
+	}
+
+	languageByExtension = map[string]string{
+		".go":   "go",
+		".py":   "python",
+		".js":   "javascript",
+		".mjs":  "javascript",
+		".cjs":  "javascript",
+		".jsx":  "javascript",
+		".ts":   "javascript",
+		".tsx":  "javascript",
+		".rs":   "rust",
+		".c":    "c",
+		".h":    "c",
+		".cc":   "c",
+		".cpp":  "c",
+		".hpp":  "c",
+		".java": "c",
+		".cs":   "c",
+		".kt":   "c",
+		".sh":   "shell",
+		".bash": "shell",
+		".zsh":  "shell",
+		".rb":   "ruby",
+		".sql":  "sql",
+		".json": "json",
+		".yaml": "yaml",
+		".yml":  "yaml",
+		".toml": "toml",
+		".html": "html",
+		".htm":  "html",
+		".xml":  "html",
+		".svg":  "html",
+		".css":  "css",
+		".mk":   "make",
+	}
+
+	languageByFileName = map[string]string{
+		"Makefile":    "make",
+		"GNUmakefile": "make",
+		"Dockerfile":  "dockerfile",
+		"go.mod":      "go",
+		"go.sum":      "go",
+	}
+)
+
+// detectLanguage picks a highlighter from the file name. It returns nil for
+// files that should be shown as plain text.
+func detectLanguage(name string) *language {
+	base := path.Base(name)
+
+	if key, ok := languageByFileName[base]; ok {
+		return languages[key]
+	}
+
+	if key, ok := languageByExtension[strings.ToLower(path.Ext(base))]; ok {
+		return languages[key]
+	}
+
+	return nil
+}
+
+// highlight splits src into lines of classified spans. Tokens that span
+// several lines, such as block comments, are split at each newline so every
+// line can be rendered and linked on its own.
+func highlight(src string, lang *language) [][]span {
+	lines := [][]span{nil}
+
+	emit := func(class, text string) {
+		for {
+			before, after, found := strings.Cut(text, "\n")
+			if before != "" {
+				last := len(lines) - 1
+				lines[last] = append(lines[last], span{Class: class, Text: before})
+			}
+
+			if !found {
+				return
+			}
+
+			lines = append(lines, nil)
+			text = after
+		}
+	}
+
+	if lang == nil {
+		emit("", src)
+		return trimTrailingLine(lines)
+	}
+
+	keywords := make(map[string]bool, len(lang.Keywords))
+	for _, kw := range lang.Keywords {
+		if lang.IgnoreCase {
+			kw = strings.ToLower(kw)
+		}
+
+		keywords[kw] = true
+	}
+
+	plainStart := 0
+	flush := func(i int) {
+		if i > plainStart {
+			emit("", src[plainStart:i])
+		}
+	}
+
+	i := 0
+	for i < len(src) {
+		class, end := lang.token(src, i, keywords)
+		if end == i {
+			i++
+			continue
+		}
+
+		if class == "" {
+			i = end
+			continue
+		}
+
+		flush(i)
+		emit(class, src[i:end])
+		i = end
+		plainStart = i
+	}
+
+	flush(len(src))
+
+	return trimTrailingLine(lines)
+}
+
+// token classifies the token starting at src[i] and returns its end. Plain
+// identifiers are reported with an empty class so they are skipped whole.
+func (lang *language) token(src string, i int, keywords map[string]bool) (string, int) {
+	rest := src[i:]
+
+	for _, delims := range lang.BlockComments {
+		if strings.HasPrefix(rest, delims[0]) {
+			return "com", i + scanTo(rest, len(delims[0]), delims[1])
+		}
+	}
+
+	for _, prefix := range lang.LineComments {
+		if strings.HasPrefix(rest, prefix) {
+			return "com", i + scanLine(rest)
+		}
+	}
+
+	for _, delim := range lang.BlockStrings {
+		if strings.HasPrefix(rest, delim) {
+			return "str", i + scanTo(rest, len(delim), delim)
+		}
+	}
+
+	c := src[i]
+
+	if strings.IndexByte(lang.Quotes, c) >= 0 {
+		return "str", i + scanQuoted(rest, c)
+	}
+
+	if isIdentStart(c) {
+		end := i + 1
+		for end < len(src) && isIdentChar(src[end]) {
+			end++
+		}
+
+		word := src[i:end]
+		if lang.IgnoreCase {
+			word = strings.ToLower(word)
+		}
+
+		if keywords[word] {
+			return "kw", end
+		}
+
+		return "", end
+	}
+
+	if c >= '0' && c <= '9' {
+		end := i + 1
+		for end < len(src) && (isIdentChar(src[end]) || src[end] == '.') {
+			end++
+		}
+
+		return "num", end
+	}
+
+	return "", i
+}
+
+// scanTo returns the offset just past the closing delimiter, searching from
+// offset start. Unterminated tokens run to the end of the input.
+func scanTo(s string, start int, closing string) int {
+	if idx := strings.Index(s[start:], closing); idx >= 0 {
+		return start + idx + len(closing)
+	}
+
+	return len(s)
+}
+
+func scanLine(s string) int {
+	if idx := strings.IndexByte(s, '\n'); idx >= 0 {
+		return idx
+	}
+
+	return len(s)
+}
+
+func scanQuoted(s string, quote byte) int {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case quote:
+			return i + 1
+		case '\n':
+			return i
+		}
+	}
+
+	return len(s)
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || c >= '0' && c <= '9'
+}
+
+// trimTrailingLine drops the empty line produced by a final newline so files
+// ending in "\n" don't render an extra numbered line.
+func trimTrailingLine(lines [][]span) [][]span {
+	if len(lines) > 1 && len(lines[len(lines)-1]) == 0 {
+		return lines[:len(lines)-1]
+	}
+
+	return lines
+}
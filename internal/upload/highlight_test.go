@@ -0,0 +1,93 @@
+package upload
+
+import (
+	"testing"
+)
+
+func TestDetectLanguage(t *testing.T) {
+	tests := map[string]string{
+		"main.go":           "Go",
+		"proj/cmd/Makefile": "Makefile",
+		"script.PY":         "Python",
+		"web/app.tsx":       "JavaScript",
+		"notes.txt":         "",
+	}
+
+	for name, want := range tests {
+		lang := detectLanguage(name)
+
+		got := ""
+		if lang != nil {
+			got = lang.Name
+		}
+
+		if got != want {
+			t.Fatalf("%s: expected language %q, got %q", name, want, got)
+		}
+	}
+}
+
+func TestHighlightClassifiesTokens(t *testing.T) {
+	src := "package main\n\n// say hi\nfunc main() { println(\"hi\", 42) }\n"
+
+	lines := highlight(src, detectLanguage("main.go"))
+
+	if len(lines) != 4 {
+		t.Fatalf("expected 4 lines, got %d: %+v", len(lines), lines)
+	}
+
+	if lines[0][0] != (span{Class: "kw", Text: "package"}) {
+		t.Fatalf("expected package keyword, got %+v", lines[0][0])
+	}
+
+	if len(lines[1]) != 0 {
+		t.Fatalf("expected empty second line, got %+v", lines[1])
+	}
+
+	if lines[2][0] != (span{Class: "com", Text: "// say hi"}) {
+		t.Fatalf("expected comment, got %+v", lines[2][0])
+	}
+
+	classes := map[string]string{}
+	for _, s := range lines[3] {
+		classes[s.Text] = s.Class
+	}
+
+	if classes["func"] != "kw" || classes[`"hi"`] != "str" || classes["42"] != "num" {
+		t.Fatalf("unexpected classes for line 4: %+v", lines[3])
+	}
+}
+
+func TestHighlightSplitsMultiLineTokens(t *testing.T) {
+	src := "a := `one\ntwo`\n/* x\ny */ b"
+
+	lines := highlight(src, detectLanguage("main.go"))
+
+	if len(lines) != 4 {
+		t.Fatalf("expected 4 lines, got %d: %+v", len(lines), lines)
+	}
+
+	if last := lines[0][len(lines[0])-1]; last != (span{Class: "str", Text: "`one"}) {
+		t.Fatalf("expected raw string to start on line 1, got %+v", last)
+	}
+
+	if lines[1][0] != (span{Class: "str", Text: "two`"}) {
+		t.Fatalf("expected raw string to continue on line 2, got %+v", lines[1][0])
+	}
+
+	if lines[3][0] != (span{Class: "com", Text: "y */"}) {
+		t.Fatalf("expected block comment to end on line 4, got %+v", lines[3][0])
+	}
+}
+
+func TestHighlightPlainText(t *testing.T) {
+	lines := highlight("if x\nreturn\n", nil)
+
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %d", len(lines))
+	}
+
+	if lines[0][0] != (span{Text: "if x"}) {
+		t.Fatalf("expected unhighlighted text, got %+v", lines[0][0])
+	}
+}
@@ -0,0 +1,103 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/elliota43/beam/internal/storage"
+)
+
+// Index holds the metadata of committed uploads. Get returns an error
+// matching storage.ErrNotExist for uploads it does not hold, and Delete
+// succeeds for them.
+type Index interface {
+	Get(ctx context.Context, slug string) (UploadMetadata, error)
+	Put(ctx context.Context, meta UploadMetadata) error
+	Delete(ctx context.Context, slug string) error
+	// List returns every upload, sorted by slug.
+	List(ctx context.Context) ([]UploadMetadata, error)
+	// Expired returns the uploads whose lifetime has passed as of now.
+	Expired(ctx context.Context, now time.Time) ([]UploadMetadata, error)
+}
+
+// index returns the Handler's Index, or one keeping metadata.json files in
+// Store when none is set.
+func (h *Handler) index() Index {
+	if h.Index != nil {
+		return h.Index
+	}
+
+	return storeIndex{store: h.Store}
+}
+
+// storeIndex keeps each upload's metadata in a metadata.json object beside
+// its files, the layout beam has always used. Listing reads every one, but
+// only lists the top-level directories to find them, so it does not walk
+// every blob in a bucket.
+type storeIndex struct {
+	store storage.Store
+}
+
+func (s storeIndex) Get(ctx context.Context, slug string) (UploadMetadata, error) {
+	return readMetadata(ctx, s.store, slug)
+}
+
+func (s storeIndex) Put(ctx context.Context, meta UploadMetadata) error {
+	return writeMetadata(ctx, s.store, meta)
+}
+
+func (s storeIndex) Delete(ctx context.Context, slug string) error {
+	err := s.store.Delete(ctx, metadataKey(slug))
+	if errors.Is(err, storage.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+// List skips uploads deleted while the list is being read.
+func (s storeIndex) List(ctx context.Context) ([]UploadMetadata, error) {
+	dirs, err := s.store.ListDirs(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var uploads []UploadMetadata
+
+	for _, slug := range dirs {
+		if !validSlug(slug) {
+			continue
+		}
+
+		meta, err := readMetadata(ctx, s.store, slug)
+		if errors.Is(err, storage.ErrNotExist) {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		uploads = append(uploads, meta)
+	}
+
+	return uploads, nil
+}
+
+func (s storeIndex) Expired(ctx context.Context, now time.Time) ([]UploadMetadata, error) {
+	uploads, err := s.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var expired []UploadMetadata
+
+	for _, meta := range uploads {
+		if meta.Expired(now) {
+			expired = append(expired, meta)
+		}
+	}
+
+	return expired, nil
+}
@@ -0,0 +1,142 @@
+package upload
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/elliota43/beam/internal/ratelimit"
+)
+
+// Limits throttles clients. Each limiter is optional. Clients are told apart
+// by the identity of their API key when they send one, and by address
+// otherwise.
+type Limits struct {
+	// Uploads limits how many uploads a client may create.
+	Uploads *ratelimit.Limiter
+	// UploadBytes limits how many bytes a client may send, both in uploads
+	// and in resumable partials.
+	UploadBytes *ratelimit.Limiter
+	// Downloads limits requests to view or download uploads.
+	Downloads *ratelimit.Limiter
+
+	// TrustedProxies are the addresses of proxies whose X-Forwarded-For
+	// headers are believed when working out a client's address.
+	TrustedProxies []netip.Prefix
+}
+
+// LimitUploads wraps the handler that creates uploads with the upload count
+// and upload bytes limits.
+func (h *Handler) LimitUploads(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := h.clientKey(r)
+
+		if !checkDebt(w, h.Limits.UploadBytes, key) {
+			return
+		}
+
+		if h.Limits.Uploads != nil {
+			if wait := h.Limits.Uploads.Take(key, 1); wait > 0 {
+				tooManyRequests(w, wait)
+				return
+			}
+		}
+
+		h.chargeBody(r, key)
+		next(w, r)
+	}
+}
+
+// LimitUploadBytes wraps handlers that receive file data outside of an
+// upload, such as resumable partials, with the upload bytes limit.
+func (h *Handler) LimitUploadBytes(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := h.clientKey(r)
+
+		if !checkDebt(w, h.Limits.UploadBytes, key) {
+			return
+		}
+
+		h.chargeBody(r, key)
+		next(w, r)
+	}
+}
+
+// LimitDownloads wraps handlers that serve uploads with the download limit.
+func (h *Handler) LimitDownloads(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.Limits.Downloads != nil {
+			if wait := h.Limits.Downloads.Take(h.clientKey(r), 1); wait > 0 {
+				tooManyRequests(w, wait)
+				return
+			}
+		}
+
+		next(w, r)
+	}
+}
+
+// clientKey names the client a request is counted against. Limits run
+// before RequireAPIKey, so that guessing keys is throttled too, and look the
+// key up themselves: requests with a known key count against it, and all
+// others, including those with a wrong key, against their address.
+func (h *Handler) clientKey(r *http.Request) string {
+	if identity := identityFrom(r.Context()); identity != "" {
+		return "key:" + identity
+	}
+
+	if identity, ok := h.apiKeyIdentity(r); ok {
+		return "key:" + identity
+	}
+
+	return "ip:" + ratelimit.ClientIP(r, h.Limits.TrustedProxies)
+}
+
+// checkDebt refuses the request while the client has sent more bytes than
+// its allowance. Byte counts are charged as bodies are read, since streamed
+// uploads do not declare their size up front, so a client may overdraw by
+// one request before being held back.
+func checkDebt(w http.ResponseWriter, limiter *ratelimit.Limiter, key string) bool {
+	if limiter == nil {
+		return true
+	}
+
+	if wait := limiter.Debt(key); wait > 0 {
+		tooManyRequests(w, wait)
+		return false
+	}
+
+	return true
+}
+
+func (h *Handler) chargeBody(r *http.Request, key string) {
+	if h.Limits.UploadBytes == nil || r.Body == nil {
+		return
+	}
+
+	r.Body = &chargedBody{ReadCloser: r.Body, limiter: h.Limits.UploadBytes, key: key}
+}
+
+// chargedBody charges every byte read from a request body to a client.
+type chargedBody struct {
+	io.ReadCloser
+	limiter *ratelimit.Limiter
+	key     string
+}
+
+func (b *chargedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.limiter.Charge(b.key, float64(n))
+	}
+
+	return n, err
+}
+
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+}
@@ -0,0 +1,157 @@
+package upload
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/elliota43/beam/internal/ratelimit"
+)
+
+func uploadRequest(t *testing.T, remoteAddr string) *http.Request {
+	t.Helper()
+
+	req := newUploadRequest(t, nil, helloFile)
+	req.RemoteAddr = remoteAddr
+
+	return req
+}
+
+func expectTooManyRequests(t *testing.T, rr *httptest.ResponseRecorder) {
+	t.Helper()
+
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected %d, got %d", http.StatusTooManyRequests, rr.Code)
+	}
+
+	if seconds, err := strconv.Atoi(rr.Header().Get("Retry-After")); err != nil || seconds <= 0 {
+		t.Fatalf("expected a positive Retry-After, got %q", rr.Header().Get("Retry-After"))
+	}
+}
+
+func TestLimitUploadsCountsUploadsPerClient(t *testing.T) {
+	h := NewHandler("http://example.com", t.TempDir())
+	h.Limits.Uploads = ratelimit.New(ratelimit.Rate{N: 1, Window: time.Hour})
+
+	create := h.LimitUploads(h.CreateUpload)
+
+	rr := httptest.NewRecorder()
+	create(rr, uploadRequest(t, "203.0.113.1:1000"))
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected %d, got %d", http.StatusCreated, rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	create(rr, uploadRequest(t, "203.0.113.1:1001"))
+	expectTooManyRequests(t, rr)
+
+	rr = httptest.NewRecorder()
+	create(rr, uploadRequest(t, "203.0.113.2:1000"))
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected another address to have its own limit, got %d", rr.Code)
+	}
+
+	// Requests with an API key are counted against the key, not the address.
+	req := uploadRequest(t, "203.0.113.1:1002")
+	req = req.WithContext(context.WithValue(req.Context(), identityKey{}, "alice"))
+
+	rr = httptest.NewRecorder()
+	create(rr, req)
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected an API key to have its own limit, got %d", rr.Code)
+	}
+}
+
+func TestLimitUploadsThrottlesWrongAPIKeys(t *testing.T) {
+	h := NewHandler("http://example.com", t.TempDir())
+	h.APIKeys = APIKeys{hashAPIKey("alice-key-0123456789"): "alice"}
+	h.Limits.Uploads = ratelimit.New(ratelimit.Rate{N: 1, Window: time.Hour})
+
+	create := h.LimitUploads(h.RequireAPIKey(h.CreateUpload))
+
+	send := func(key string) int {
+		req := uploadRequest(t, "203.0.113.1:1000")
+		req.Header.Set("Authorization", "Bearer "+key)
+
+		rr := httptest.NewRecorder()
+		create(rr, req)
+		return rr.Code
+	}
+
+	if code := send("wrong-key-0123456789"); code != http.StatusUnauthorized {
+		t.Fatalf("expected %d, got %d", http.StatusUnauthorized, code)
+	}
+
+	if code := send("other-key-0123456789"); code != http.StatusTooManyRequests {
+		t.Fatalf("expected guesses from one address to be throttled, got %d", code)
+	}
+
+	if code := send("alice-key-0123456789"); code != http.StatusCreated {
+		t.Fatalf("expected a valid key to be limited separately, got %d", code)
+	}
+}
+
+func TestLimitUploadsChargesBytes(t *testing.T) {
+	h := NewHandler("http://example.com", t.TempDir())
+	h.Limits.UploadBytes = ratelimit.New(ratelimit.Rate{N: 100, Window: time.Hour})
+
+	create := h.LimitUploads(h.CreateUpload)
+
+	// The first upload overdraws the allowance, since its size is only
+	// known once it has been read; the next one has to wait.
+	rr := httptest.NewRecorder()
+	create(rr, uploadRequest(t, "203.0.113.1:1000"))
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected %d, got %d", http.StatusCreated, rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	create(rr, uploadRequest(t, "203.0.113.1:1000"))
+	expectTooManyRequests(t, rr)
+
+	req := httptest.NewRequest(http.MethodPatch, "/api/partials/abc", nil)
+	req.RemoteAddr = "203.0.113.1:1000"
+
+	rr = httptest.NewRecorder()
+	h.LimitUploadBytes(h.PatchPartial)(rr, req)
+	expectTooManyRequests(t, rr)
+}
+
+func TestLimitDownloadsHonoursTrustedProxies(t *testing.T) {
+	storageDir := t.TempDir()
+	h := NewHandler("http://example.com", storageDir)
+	h.Limits.Downloads = ratelimit.New(ratelimit.Rate{N: 1, Window: time.Minute})
+	h.Limits.TrustedProxies, _ = ratelimit.ParsePrefixes("10.0.0.1")
+
+	writeTreeUpload(t, storageDir, map[string]string{"a.txt": "a"})
+
+	serve := h.LimitDownloads(h.ServeRaw)
+
+	get := func(forwardedFor string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/raw/abc123/a.txt", nil)
+		req.RemoteAddr = "10.0.0.1:5000"
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+
+		rr := httptest.NewRecorder()
+		serve(rr, req)
+
+		return rr
+	}
+
+	if rr := get("198.51.100.1"); rr.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, rr.Code)
+	}
+
+	expectTooManyRequests(t, get("198.51.100.1"))
+
+	if rr := get("198.51.100.2"); rr.Code != http.StatusOK {
+		t.Fatalf("expected clients behind the proxy to be limited separately, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,121 @@
+package upload
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+const (
+	OwnerTokenLength = 32
+	OwnerTokenHeader = "Beam-Owner-Token"
+)
+
+// DeleteUpload removes an upload, or a single file from it, for whoever
+// holds the owner token returned when it was created.
+func (h *Handler) DeleteUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// supports:
+	// DELETE /api/uploads/{slug}
+	// DELETE /api/uploads/{slug}/{path...}
+	slug, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/uploads/"), "/")
+	if !validSlug(slug) {
+		http.NotFound(w, r)
+		return
+	}
+
+	ctx := r.Context()
+
+	h.metaMu.Lock()
+	defer h.metaMu.Unlock()
+
+	meta, err := h.index().Get(ctx, slug)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !validOwnerToken(meta, r.Header.Get(OwnerTokenHeader)) {
+		http.Error(w, "invalid owner token", http.StatusForbidden)
+		return
+	}
+
+	if rest == "" {
+		if err := h.deleteUpload(ctx, meta); err != nil {
+			http.Error(w, "failed to delete upload", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	relativePath, err := cleanRelativePath(rest)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	i := slices.IndexFunc(meta.Files, func(f FileMetadata) bool {
+		return f.Path() == relativePath
+	})
+	if i < 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	if err := h.deleteFile(ctx, meta, i); err != nil {
+		http.Error(w, "failed to delete file", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteFile removes the file at index i from an upload, deleting the whole
+// upload when it was the last file. The caller must hold metaMu.
+func (h *Handler) deleteFile(ctx context.Context, meta UploadMetadata, i int) error {
+	if len(meta.Files) == 1 {
+		return h.deleteUpload(ctx, meta)
+	}
+
+	f := meta.Files[i]
+	meta.Files = slices.Delete(slices.Clone(meta.Files), i, i+1)
+
+	// Commit the smaller manifest first so the file stops being served
+	// before its contents go.
+	if err := h.index().Put(ctx, meta); err != nil {
+		return err
+	}
+
+	h.releaseQuota(meta.Owner, []FileMetadata{f})
+
+	if f.StoredName != "" {
+		return h.Store.Delete(ctx, f.storageKey(meta.Slug))
+	}
+
+	return h.releaseBlobs(ctx, []FileMetadata{f})
+}
+
+func hashOwnerToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// validOwnerToken reports whether token is the upload's owner token.
+// Uploads made before owner tokens existed cannot be deleted this way.
+func validOwnerToken(meta UploadMetadata, token string) bool {
+	if meta.OwnerTokenHash == "" || token == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(hashOwnerToken(token)), []byte(meta.OwnerTokenHash)) == 1
+}
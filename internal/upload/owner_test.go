@@ -0,0 +1,150 @@
+package upload
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/elliota43/beam/internal/storage"
+)
+
+func deleteRequest(h *Handler, target, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodDelete, target, nil)
+	if token != "" {
+		req.Header.Set(OwnerTokenHeader, token)
+	}
+
+	rr := httptest.NewRecorder()
+	h.DeleteUpload(rr, req)
+
+	return rr
+}
+
+func TestCreateUploadReturnsOwnerToken(t *testing.T) {
+	h := NewHandler("http://example.com", t.TempDir())
+
+	rr := createUpload(t, h, nil, helloFile)
+
+	var resp UploadResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.OwnerToken == "" {
+		t.Fatal("expected owner token in response")
+	}
+
+	meta, err := readMetadata(context.Background(), h.Store, strings.TrimPrefix(resp.URL, "http://example.com/u/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if meta.OwnerTokenHash != hashOwnerToken(resp.OwnerToken) {
+		t.Fatalf("expected metadata to hold the token's hash, got %q", meta.OwnerTokenHash)
+	}
+
+	if strings.Contains(rr.Body.String(), meta.OwnerTokenHash) {
+		t.Fatal("expected token hash not to be returned")
+	}
+}
+
+func TestDeleteUploadRequiresOwnerToken(t *testing.T) {
+	h := NewHandler("http://example.com", t.TempDir())
+	ctx := context.Background()
+
+	rr := createUpload(t, h, nil, helloFile)
+
+	var resp UploadResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	slug := strings.TrimPrefix(resp.URL, "http://example.com/u/")
+
+	for _, token := range []string{"", "wrong"} {
+		if rr := deleteRequest(h, "/api/uploads/"+slug, token); rr.Code != http.StatusForbidden {
+			t.Fatalf("expected %d for token %q, got %d", http.StatusForbidden, token, rr.Code)
+		}
+	}
+
+	if rr := deleteRequest(h, "/api/uploads/"+slug, resp.OwnerToken); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected %d, got %d: %s", http.StatusNoContent, rr.Code, rr.Body.String())
+	}
+
+	if _, err := readMetadata(ctx, h.Store, slug); !errors.Is(err, storage.ErrNotExist) {
+		t.Fatalf("expected upload to be deleted, got %v", err)
+	}
+
+	if _, err := h.Store.Stat(ctx, contentKey(hashOf("hello"))); !errors.Is(err, storage.ErrNotExist) {
+		t.Fatalf("expected blob to be deleted, got %v", err)
+	}
+
+	if rr := deleteRequest(h, "/api/uploads/"+slug, resp.OwnerToken); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected %d for a deleted upload, got %d", http.StatusNotFound, rr.Code)
+	}
+}
+
+func TestDeleteUploadRemovesSingleFile(t *testing.T) {
+	h := NewHandler("http://example.com", t.TempDir())
+	ctx := context.Background()
+
+	token := "secret-token"
+
+	meta := postUpload(t, h, map[string]string{"docs/a.txt": "aaa", "docs/b.txt": "bbb"})
+	meta.OwnerTokenHash = hashOwnerToken(token)
+
+	if err := writeMetadata(ctx, h.Store, meta); err != nil {
+		t.Fatal(err)
+	}
+
+	if rr := deleteRequest(h, "/api/uploads/"+meta.Slug+"/docs/missing.txt", token); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected %d, got %d", http.StatusNotFound, rr.Code)
+	}
+
+	if rr := deleteRequest(h, "/api/uploads/"+meta.Slug+"/docs/a.txt", token); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected %d, got %d: %s", http.StatusNoContent, rr.Code, rr.Body.String())
+	}
+
+	updated, err := readMetadata(ctx, h.Store, meta.Slug)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(updated.Files) != 1 || updated.Files[0].Path() != "docs/b.txt" {
+		t.Fatalf("expected only docs/b.txt to remain, got %+v", updated.Files)
+	}
+
+	if _, err := h.Store.Stat(ctx, contentKey(hashOf("aaa"))); !errors.Is(err, storage.ErrNotExist) {
+		t.Fatalf("expected deleted file's blob to be removed, got %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	h.ServeRaw(rr, httptest.NewRequest(http.MethodGet, "/raw/"+meta.Slug+"/docs/a.txt", nil))
+
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("expected deleted file to be gone, got %d", rr.Code)
+	}
+
+	if rr := deleteRequest(h, "/api/uploads/"+meta.Slug+"/docs/b.txt", token); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected %d, got %d", http.StatusNoContent, rr.Code)
+	}
+
+	if _, err := readMetadata(ctx, h.Store, meta.Slug); !errors.Is(err, storage.ErrNotExist) {
+		t.Fatalf("expected upload to be deleted with its last file, got %v", err)
+	}
+}
+
+func TestDeleteUploadRejectsUploadsWithoutToken(t *testing.T) {
+	storageDir := t.TempDir()
+	h := NewHandler("http://example.com", storageDir)
+
+	writeTreeUpload(t, storageDir, map[string]string{"a.txt": "a"})
+
+	if rr := deleteRequest(h, "/api/uploads/abc123", "anything"); rr.Code != http.StatusForbidden {
+		t.Fatalf("expected %d, got %d", http.StatusForbidden, rr.Code)
+	}
+}
@@ -0,0 +1,622 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elliota43/beam/internal/storage"
+)
+
+// Resumable uploads follow the core tus 1.0.0 protocol (https://tus.io) with
+// the creation, expiration and termination extensions. Each partial holds a
+// single file; once complete it is attached to a regular upload by sending
+// its id as a "partial" field in POST /api/uploads.
+const (
+	TusVersion       = "1.0.0"
+	TusExtensions    = "creation,expiration,termination"
+	PartialsDirName  = ".partials"
+	PartialIDLength  = 16
+	partialDataName  = "data"
+	partialInfoName  = "info.json"
+	offsetOctetsType = "application/offset+octet-stream"
+)
+
+type partialInfo struct {
+	ID           string    `json:"id"`
+	RelativePath string    `json:"relative_path"`
+	ContentType  string    `json:"content_type"`
+	ModTime      time.Time `json:"mod_time,omitzero"`
+	Owner        string    `json:"owner,omitempty"`
+	Length       int64     `json:"length"`
+	Offset       int64     `json:"offset"`
+	HashState    []byte    `json:"hash_state"`
+	CreatedAt    time.Time `json:"created_at"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+func (p partialInfo) complete() bool {
+	return p.Offset == p.Length
+}
+
+// lockPartial serializes PATCH, DELETE and claims of a single partial. Its
+// lock is dropped with forgetPartialLock once the partial is gone, so ids
+// that never existed do not accumulate.
+func (h *Handler) lockPartial(id string) (func(), bool) {
+	v, _ := h.partialLocks.LoadOrStore(id, &sync.Mutex{})
+	mu := v.(*sync.Mutex)
+
+	if !mu.TryLock() {
+		return nil, false
+	}
+
+	return mu.Unlock, true
+}
+
+// forgetPartialLock drops the lock of a partial that does not exist or has
+// just been removed. Anyone still holding it finds the partial gone.
+func (h *Handler) forgetPartialLock(id string) {
+	h.partialLocks.Delete(id)
+}
+
+func (h *Handler) PartialOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", TusVersion)
+	w.Header().Set("Tus-Version", TusVersion)
+	w.Header().Set("Tus-Extension", TusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(h.MaxFileSize, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) CreatePartial(w http.ResponseWriter, r *http.Request) {
+	if !checkTusVersion(w, r) {
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+
+	if length > h.MaxFileSize {
+		http.Error(w, "file too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if err := h.checkFreeSpace(); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, "invalid Upload-Metadata", http.StatusBadRequest)
+		return
+	}
+
+	relativePath, err := cleanRelativePath(metadata["filename"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, err := randomSlug(PartialIDLength)
+	if err != nil {
+		http.Error(w, "failed to generate upload id", http.StatusInternalServerError)
+		return
+	}
+
+	// The whole length counts against the quota until the partial is
+	// claimed or removed, so open partials cannot overrun it.
+	if err := h.reservePartial(r.Context(), id, identityFrom(r.Context()), length); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	now := time.Now().UTC()
+
+	info := partialInfo{
+		ID:           id,
+		RelativePath: relativePath,
+		ContentType:  metadata["filetype"],
+		ModTime:      parseModTime(metadata["lastmodified"]),
+		Owner:        identityFrom(r.Context()),
+		Length:       length,
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(h.PartialTTL),
+	}
+
+	if err := h.createPartialDir(info); err != nil {
+		h.releasePartialQuota(id)
+		http.Error(w, "failed to create upload", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Tus-Resumable", TusVersion)
+	w.Header().Set("Location", h.BaseURL+"/api/partials/"+id)
+	w.Header().Set("Upload-Expires", info.ExpiresAt.Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// createPartialDir stores a new partial's empty data and its info.
+func (h *Handler) createPartialDir(info partialInfo) error {
+	var err error
+	if info.HashState, err = marshalHash(sha256.New()); err != nil {
+		return err
+	}
+
+	dir := filepath.Join(h.PartialsDir, info.ID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, partialDataName), nil, 0644); err != nil {
+		_ = os.RemoveAll(dir)
+		return err
+	}
+
+	if err := writePartialInfo(dir, info); err != nil {
+		_ = os.RemoveAll(dir)
+		return err
+	}
+
+	return nil
+}
+
+func (h *Handler) HeadPartial(w http.ResponseWriter, r *http.Request) {
+	info, _, ok := h.loadPartial(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Tus-Resumable", TusVersion)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(info.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(info.Length, 10))
+	w.Header().Set("Upload-Expires", info.ExpiresAt.Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *Handler) PatchPartial(w http.ResponseWriter, r *http.Request) {
+	if !checkTusVersion(w, r) {
+		return
+	}
+
+	if r.Header.Get("Content-Type") != offsetOctetsType {
+		http.Error(w, "expected Content-Type "+offsetOctetsType, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/api/partials/")
+	if !validSlug(id) {
+		http.NotFound(w, r)
+		return
+	}
+
+	unlock, ok := h.lockPartial(id)
+	if !ok {
+		http.Error(w, "upload is being written by another request", http.StatusLocked)
+		return
+	}
+	defer unlock()
+
+	info, dir, ok := h.loadPartial(w, r)
+	if !ok {
+		h.forgetPartialLock(id)
+		return
+	}
+
+	if err := h.checkFreeSpace(); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if offset != info.Offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(info.Offset, 10))
+		http.Error(w, "Upload-Offset does not match current offset", http.StatusConflict)
+		return
+	}
+
+	body := &bodyReader{r: http.MaxBytesReader(w, r.Body, info.Length-info.Offset)}
+
+	written, copyErr := appendPartial(dir, &info, body)
+
+	// Whatever arrived before a dropped connection is kept so the client
+	// can resume from the new offset.
+	if written > 0 {
+		info.ExpiresAt = time.Now().UTC().Add(h.PartialTTL)
+
+		if err := writePartialInfo(dir, info); err != nil {
+			http.Error(w, "failed to record upload progress", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if copyErr != nil {
+		writeError(w, storeError(body, "failed to store upload data"))
+		return
+	}
+
+	w.Header().Set("Tus-Resumable", TusVersion)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(info.Offset, 10))
+	w.Header().Set("Upload-Expires", info.ExpiresAt.Format(http.TimeFormat))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) DeletePartial(w http.ResponseWriter, r *http.Request) {
+	if !checkTusVersion(w, r) {
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/api/partials/")
+	if !validSlug(id) {
+		http.NotFound(w, r)
+		return
+	}
+
+	unlock, ok := h.lockPartial(id)
+	if !ok {
+		http.Error(w, "upload is being written by another request", http.StatusLocked)
+		return
+	}
+	defer unlock()
+
+	_, dir, ok := h.loadPartial(w, r)
+	if !ok {
+		h.forgetPartialLock(id)
+		return
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		http.Error(w, "failed to delete upload", http.StatusInternalServerError)
+		return
+	}
+
+	h.releasePartialQuota(id)
+	h.forgetPartialLock(id)
+
+	w.Header().Set("Tus-Resumable", TusVersion)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ExpirePartials removes partial uploads that have seen no progress within
+// PartialTTL. It returns the number of partials removed.
+func (h *Handler) ExpirePartials(now time.Time) (int, error) {
+	entries, err := os.ReadDir(h.PartialsDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+
+	for _, e := range entries {
+		unlock, ok := h.lockPartial(e.Name())
+		if !ok {
+			continue
+		}
+
+		dir := filepath.Join(h.PartialsDir, e.Name())
+
+		expiresAt := time.Time{}
+		if info, err := readPartialInfo(dir); err == nil {
+			expiresAt = info.ExpiresAt
+		} else if fi, err := e.Info(); err == nil {
+			// A partial without readable info is either mid-creation or
+			// damaged; give it a full TTL before reclaiming it.
+			expiresAt = fi.ModTime().Add(h.PartialTTL)
+		}
+
+		if now.Before(expiresAt) {
+			unlock()
+			continue
+		}
+
+		if err := os.RemoveAll(dir); err == nil {
+			h.releasePartialQuota(e.Name())
+			removed++
+		}
+
+		h.forgetPartialLock(e.Name())
+		unlock()
+	}
+
+	return removed, nil
+}
+
+// claimPartial moves a completed partial into blob storage and returns its
+// file metadata. The partial itself is left in place so a failed
+// upload can be retried; callers remove it with releasePartial once
+// committed.
+func (h *Handler) claimPartial(ctx context.Context, slug, id string) (FileMetadata, FileResponse, error) {
+	if !validSlug(id) {
+		return FileMetadata{}, FileResponse{}, newHTTPError(http.StatusBadRequest, "unknown partial upload: %s", id)
+	}
+
+	unlock, ok := h.lockPartial(id)
+	if !ok {
+		return FileMetadata{}, FileResponse{}, newHTTPError(http.StatusConflict, "partial upload %s is still being written", id)
+	}
+	defer unlock()
+
+	dir := filepath.Join(h.PartialsDir, id)
+
+	info, err := readPartialInfo(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		h.forgetPartialLock(id)
+	}
+
+	if err != nil || time.Now().After(info.ExpiresAt) || info.Owner != identityFrom(ctx) {
+		return FileMetadata{}, FileResponse{}, newHTTPError(http.StatusBadRequest, "unknown partial upload: %s", id)
+	}
+
+	if !info.complete() {
+		return FileMetadata{}, FileResponse{}, newHTTPError(http.StatusBadRequest, "partial upload %s is incomplete", id)
+	}
+
+	hasher, err := unmarshalHash(info.HashState)
+	if err != nil {
+		return FileMetadata{}, FileResponse{}, newHTTPError(http.StatusInternalServerError, "failed to read partial upload")
+	}
+
+	// The hash was computed as the data arrived, so it is not read again.
+	hash := hex.EncodeToString(hasher.Sum(nil))
+
+	staged, err := h.stagePartial(ctx, dir, info, hash)
+	if errors.Is(err, errPartialCorrupt) {
+		return FileMetadata{}, FileResponse{}, newHTTPError(http.StatusInternalServerError, "partial upload %s is corrupt", id)
+	}
+
+	if err != nil {
+		return FileMetadata{}, FileResponse{}, newHTTPError(http.StatusInternalServerError, "failed to store partial upload")
+	}
+
+	if err := h.commitBlob(ctx, staged); err != nil {
+		return FileMetadata{}, FileResponse{}, newHTTPError(http.StatusInternalServerError, "failed to store partial upload")
+	}
+
+	originalName := path.Base(info.RelativePath)
+
+	fileMeta := FileMetadata{
+		OriginalName: originalName,
+		RelativePath: info.RelativePath,
+		Size:         info.Length,
+		ContentType:  info.ContentType,
+		SHA256:       hash,
+		CreatedAt:    time.Now().UTC(),
+		ModTime:      info.ModTime,
+	}
+
+	fileResp := FileResponse{
+		Name: originalName,
+		Path: info.RelativePath,
+		Size: info.Length,
+		URL:  h.BaseURL + fileURLPath(slug, info.RelativePath),
+		Hash: hash,
+	}
+
+	return fileMeta, fileResp, nil
+}
+
+// errPartialCorrupt means a partial's data no longer matches the length or
+// hash recorded as it arrived.
+var errPartialCorrupt = errors.New("partial upload data does not match its info")
+
+// stagePartial stages a completed partial's data for commitBlob. Stores
+// that can link a local file take the data without copying it, leaving the
+// partial whole until the upload commits in case it has to be retried.
+// Other stores, or a store on another filesystem, are sent a copy, which is
+// checked against the hash.
+func (h *Handler) stagePartial(ctx context.Context, dir string, info partialInfo, hash string) (stagedBlob, error) {
+	dataPath := filepath.Join(dir, partialDataName)
+
+	if linker, ok := h.Store.(storage.Linker); ok {
+		name, err := randomSlug(StorageSlugLength)
+		if err != nil {
+			return stagedBlob{}, err
+		}
+
+		staged := stagedBlob{key: stagingPrefix + name, hash: hash}
+
+		if stored, err := linker.Link(ctx, dataPath, staged.key); err == nil {
+			staged.size = stored.Size
+			if staged.size != info.Length {
+				h.discardStaged(staged)
+				return stagedBlob{}, errPartialCorrupt
+			}
+
+			return staged, nil
+		}
+	}
+
+	data, err := os.Open(dataPath)
+	if err != nil {
+		return stagedBlob{}, err
+	}
+	defer data.Close()
+
+	staged, err := h.stageBlob(ctx, data)
+	if err != nil {
+		return stagedBlob{}, err
+	}
+
+	if staged.hash != hash || staged.size != info.Length {
+		h.discardStaged(staged)
+		return stagedBlob{}, errPartialCorrupt
+	}
+
+	return staged, nil
+}
+
+func (h *Handler) releasePartial(id string) {
+	_ = os.RemoveAll(filepath.Join(h.PartialsDir, id))
+	h.releasePartialQuota(id)
+	h.forgetPartialLock(id)
+}
+
+func (h *Handler) loadPartial(w http.ResponseWriter, r *http.Request) (partialInfo, string, bool) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/partials/")
+
+	if !validSlug(id) {
+		http.NotFound(w, r)
+		return partialInfo{}, "", false
+	}
+
+	dir := filepath.Join(h.PartialsDir, id)
+
+	// Partials made with another API key are hidden rather than refused,
+	// so ids cannot be probed across identities.
+	info, err := readPartialInfo(dir)
+	if err != nil || info.Owner != identityFrom(r.Context()) {
+		http.NotFound(w, r)
+		return partialInfo{}, "", false
+	}
+
+	if time.Now().After(info.ExpiresAt) {
+		http.Error(w, "upload expired", http.StatusGone)
+		return partialInfo{}, "", false
+	}
+
+	return info, dir, true
+}
+
+// appendPartial writes src to the end of the partial's data, updating the
+// offset and running hash in info. Any bytes past the recorded offset, left
+// behind by a crash during an earlier PATCH, are discarded first.
+func appendPartial(dir string, info *partialInfo, src io.Reader) (int64, error) {
+	hasher, err := unmarshalHash(info.HashState)
+	if err != nil {
+		return 0, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, partialDataName), os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	if err := f.Truncate(info.Offset); err != nil {
+		return 0, err
+	}
+
+	if _, err := f.Seek(info.Offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	written, copyErr := io.Copy(io.MultiWriter(f, hasher), src)
+
+	// The data must be on disk before info records the new offset.
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+
+	info.Offset += written
+
+	if info.HashState, err = marshalHash(hasher); err != nil {
+		return written, err
+	}
+
+	return written, copyErr
+}
+
+func checkTusVersion(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("Tus-Resumable") != TusVersion {
+		w.Header().Set("Tus-Version", TusVersion)
+		http.Error(w, "unsupported Tus-Resumable version", http.StatusPreconditionFailed)
+		return false
+	}
+
+	return true
+}
+
+// parseTusMetadata decodes an Upload-Metadata header: comma separated pairs
+// of a key and a base64 encoded value.
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, fmt.Errorf("empty metadata key")
+		}
+
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, err
+		}
+
+		metadata[key] = string(value)
+	}
+
+	return metadata, nil
+}
+
+func marshalHash(h hash.Hash) ([]byte, error) {
+	return h.(encoding.BinaryMarshaler).MarshalBinary()
+}
+
+func unmarshalHash(state []byte) (hash.Hash, error) {
+	h := sha256.New()
+	if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// writePartialInfo replaces the partial's info through FS.Put, which syncs
+// a temporary file and renames it into place, so a crash never leaves a
+// truncated info.json behind.
+func writePartialInfo(dir string, info partialInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	_, err = storage.NewFS(dir).Put(context.Background(), partialInfoName, bytes.NewReader(data))
+	return err
+}
+
+func readPartialInfo(dir string) (partialInfo, error) {
+	data, err := os.ReadFile(filepath.Join(dir, partialInfoName))
+	if err != nil {
+		return partialInfo{}, err
+	}
+
+	var info partialInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return partialInfo{}, err
+	}
+
+	return info, nil
+}
@@ -0,0 +1,407 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elliota43/beam/internal/storage"
+)
+
+func createPartial(t *testing.T, h *Handler, name string, length int) string {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/partials", nil)
+	req.Header.Set("Tus-Resumable", TusVersion)
+	req.Header.Set("Upload-Length", strconv.Itoa(length))
+	req.Header.Set("Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte(name)))
+
+	rr := httptest.NewRecorder()
+	h.CreatePartial(rr, req)
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+
+	location := rr.Header().Get("Location")
+	if !strings.HasPrefix(location, "http://example.com/api/partials/") {
+		t.Fatalf("unexpected Location %q", location)
+	}
+
+	return strings.TrimPrefix(location, "http://example.com/api/partials/")
+}
+
+func patchPartial(h *Handler, id string, offset int, data []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPatch, "/api/partials/"+id, bytes.NewReader(data))
+	req.Header.Set("Tus-Resumable", TusVersion)
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", strconv.Itoa(offset))
+
+	rr := httptest.NewRecorder()
+	h.PatchPartial(rr, req)
+
+	return rr
+}
+
+func deletePartial(h *Handler, id string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodDelete, "/api/partials/"+id, nil)
+	req.Header.Set("Tus-Resumable", TusVersion)
+
+	rr := httptest.NewRecorder()
+	h.DeletePartial(rr, req)
+
+	return rr
+}
+
+func headPartial(t *testing.T, h *Handler, id string) int {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodHead, "/api/partials/"+id, nil)
+	req.Header.Set("Tus-Resumable", TusVersion)
+
+	rr := httptest.NewRecorder()
+	h.HeadPartial(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, rr.Code)
+	}
+
+	offset, err := strconv.Atoi(rr.Header().Get("Upload-Offset"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return offset
+}
+
+func TestPartialUploadResumesAndAttachesToUpload(t *testing.T) {
+	storageDir := t.TempDir()
+	h := NewHandler("http://example.com", storageDir)
+
+	content := []byte("hello resumable beam")
+	id := createPartial(t, h, "logs/big.log", len(content))
+
+	if got := headPartial(t, h, id); got != 0 {
+		t.Fatalf("expected offset 0, got %d", got)
+	}
+
+	if rr := patchPartial(h, id, 0, content[:5]); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected %d, got %d: %s", http.StatusNoContent, rr.Code, rr.Body.String())
+	}
+
+	if got := headPartial(t, h, id); got != 5 {
+		t.Fatalf("expected offset 5, got %d", got)
+	}
+
+	if rr := patchPartial(h, id, 0, content); rr.Code != http.StatusConflict {
+		t.Fatalf("expected %d for stale offset, got %d", http.StatusConflict, rr.Code)
+	}
+
+	rr := patchPartial(h, id, 5, content[5:])
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("expected %d, got %d: %s", http.StatusNoContent, rr.Code, rr.Body.String())
+	}
+
+	if got := rr.Header().Get("Upload-Offset"); got != strconv.Itoa(len(content)) {
+		t.Fatalf("expected final offset %d, got %s", len(content), got)
+	}
+
+	rr = createUpload(t, h, url.Values{"partial": {id}}, testFile{name: "logs/small.log", content: "small"})
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+
+	var resp UploadResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.Files) != 2 || resp.Files[0].Path != "logs/big.log" {
+		t.Fatalf("expected partial and inline file in upload, got %+v", resp.Files)
+	}
+
+	wantHash := sha256.Sum256(content)
+	if resp.Files[0].Hash != hex.EncodeToString(wantHash[:]) {
+		t.Fatalf("expected hash of resumed content, got %s", resp.Files[0].Hash)
+	}
+
+	if _, err := os.Stat(filepath.Join(storageDir, PartialsDirName, id)); !os.IsNotExist(err) {
+		t.Fatalf("expected attached partial to be removed, got %v", err)
+	}
+
+	slug := strings.TrimPrefix(resp.URL, "http://example.com/u/")
+
+	meta, err := readMetadata(context.Background(), h.Store, slug)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := storage.ReadAll(context.Background(), h.Store, meta.Files[0].storageKey(slug))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(stored, content) {
+		t.Fatalf("expected stored partial to match, got %q", stored)
+	}
+}
+
+func TestCreateUploadRejectsIncompletePartial(t *testing.T) {
+	storageDir := t.TempDir()
+	h := NewHandler("http://example.com", storageDir)
+
+	id := createPartial(t, h, "big.log", 10)
+
+	if rr := patchPartial(h, id, 0, []byte("abc")); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected %d, got %d", http.StatusNoContent, rr.Code)
+	}
+
+	rr := createUpload(t, h, url.Values{"partial": {id}})
+
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected %d, got %d: %s", http.StatusBadRequest, rr.Code, rr.Body.String())
+	}
+
+	if got := headPartial(t, h, id); got != 3 {
+		t.Fatalf("expected partial to survive failed upload with offset 3, got %d", got)
+	}
+}
+
+func TestClaimPartialStagesDataWithoutCopyingOnFS(t *testing.T) {
+	content := []byte("hello resumable beam")
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])
+
+	for name, linked := range map[string]bool{"fs": true, "memory": false} {
+		t.Run(name, func(t *testing.T) {
+			storageDir := t.TempDir()
+			h := NewHandler("http://example.com", storageDir)
+			if !linked {
+				h.Store = storage.NewMemory()
+			}
+
+			id := createPartial(t, h, "big.log", len(content))
+			if rr := patchPartial(h, id, 0, content); rr.Code != http.StatusNoContent {
+				t.Fatalf("expected %d, got %d: %s", http.StatusNoContent, rr.Code, rr.Body.String())
+			}
+
+			fileMeta, _, err := h.claimPartial(context.Background(), "abc123", id)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if fileMeta.SHA256 != hash {
+				t.Fatalf("expected hash %s, got %s", hash, fileMeta.SHA256)
+			}
+
+			stored, err := storage.ReadAll(context.Background(), h.Store, contentKey(hash))
+			if err != nil || !bytes.Equal(stored, content) {
+				t.Fatalf("expected the blob to hold the partial's data, got %q, %v", stored, err)
+			}
+
+			// The partial stays whole until the upload commits.
+			data, err := os.Stat(filepath.Join(h.PartialsDir, id, partialDataName))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !linked {
+				return
+			}
+
+			blob, err := os.Stat(filepath.Join(storageDir, filepath.FromSlash(contentKey(hash))))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !os.SameFile(data, blob) {
+				t.Fatal("expected the blob to share the partial's data rather than copy it")
+			}
+		})
+	}
+}
+
+func TestCreateUploadCountsPartialsTowardsUploadSize(t *testing.T) {
+	h := NewHandler("http://example.com", t.TempDir())
+	h.MaxUploadSize = 1024
+
+	var ids []string
+
+	for _, name := range []string{"a.txt", "b.txt"} {
+		id := createPartial(t, h, name, 600)
+
+		if rr := patchPartial(h, id, 0, bytes.Repeat([]byte("x"), 600)); rr.Code != http.StatusNoContent {
+			t.Fatalf("expected %d, got %d: %s", http.StatusNoContent, rr.Code, rr.Body.String())
+		}
+
+		ids = append(ids, id)
+	}
+
+	rr := createUpload(t, h, url.Values{"partial": ids})
+
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected %d, got %d: %s", http.StatusRequestEntityTooLarge, rr.Code, rr.Body.String())
+	}
+
+	blobs, err := h.Store.List(context.Background(), blobsPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(blobs) != 0 {
+		t.Fatalf("expected the rejected upload to release its blobs, got %+v", blobs)
+	}
+}
+
+func TestPartialRejectsDataPastLength(t *testing.T) {
+	h := NewHandler("http://example.com", t.TempDir())
+
+	id := createPartial(t, h, "a.txt", 3)
+
+	if rr := patchPartial(h, id, 0, []byte("toolong")); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected %d, got %d", http.StatusRequestEntityTooLarge, rr.Code)
+	}
+}
+
+func TestCreatePartialValidatesRequest(t *testing.T) {
+	h := NewHandler("http://example.com", t.TempDir())
+	h.MaxFileSize = 10
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    int
+	}{
+		{"missing version", map[string]string{"Upload-Length": "1"}, http.StatusPreconditionFailed},
+		{"missing length", map[string]string{"Tus-Resumable": TusVersion}, http.StatusBadRequest},
+		{"too large", map[string]string{"Tus-Resumable": TusVersion, "Upload-Length": "11"}, http.StatusRequestEntityTooLarge},
+		{"traversal", map[string]string{
+			"Tus-Resumable":   TusVersion,
+			"Upload-Length":   "1",
+			"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("../x")),
+		}, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/api/partials", nil)
+		for k, v := range tt.headers {
+			req.Header.Set(k, v)
+		}
+
+		rr := httptest.NewRecorder()
+		h.CreatePartial(rr, req)
+
+		if rr.Code != tt.want {
+			t.Fatalf("%s: expected %d, got %d", tt.name, tt.want, rr.Code)
+		}
+	}
+}
+
+func TestExpirePartialsRemovesAbandonedUploads(t *testing.T) {
+	storageDir := t.TempDir()
+	h := NewHandler("http://example.com", storageDir)
+	h.PartialTTL = time.Hour
+
+	id := createPartial(t, h, "a.txt", 3)
+
+	removed, err := h.ExpirePartials(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if removed != 0 {
+		t.Fatalf("expected fresh partial to be kept, removed %d", removed)
+	}
+
+	removed, err = h.ExpirePartials(time.Now().Add(2 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if removed != 1 {
+		t.Fatalf("expected abandoned partial to be removed, removed %d", removed)
+	}
+
+	if _, err := os.Stat(filepath.Join(storageDir, PartialsDirName, id)); !os.IsNotExist(err) {
+		t.Fatalf("expected partial directory to be gone, got %v", err)
+	}
+}
+
+func TestPartialLocksAreDroppedWithTheirPartials(t *testing.T) {
+	h := NewHandler("http://example.com", t.TempDir())
+
+	for range 3 {
+		unknown, err := randomSlug(PartialIDLength)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if rr := patchPartial(h, unknown, 0, []byte("abc")); rr.Code != http.StatusNotFound {
+			t.Fatalf("expected %d for an unknown partial, got %d", http.StatusNotFound, rr.Code)
+		}
+
+		if rr := deletePartial(h, unknown); rr.Code != http.StatusNotFound {
+			t.Fatalf("expected %d for an unknown partial, got %d", http.StatusNotFound, rr.Code)
+		}
+	}
+
+	deleted := createPartial(t, h, "a.txt", 3)
+	if rr := patchPartial(h, deleted, 0, []byte("abc")); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected %d, got %d: %s", http.StatusNoContent, rr.Code, rr.Body.String())
+	}
+
+	if rr := deletePartial(h, deleted); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected %d, got %d: %s", http.StatusNoContent, rr.Code, rr.Body.String())
+	}
+
+	claimed := createPartial(t, h, "b.txt", 3)
+	if rr := patchPartial(h, claimed, 0, []byte("abc")); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected %d, got %d: %s", http.StatusNoContent, rr.Code, rr.Body.String())
+	}
+
+	if rr := createUpload(t, h, url.Values{"partial": {claimed}}); rr.Code != http.StatusCreated {
+		t.Fatalf("expected %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+
+	// Claiming it again finds nothing and leaves no lock behind either.
+	if rr := createUpload(t, h, url.Values{"partial": {claimed}}); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected %d, got %d: %s", http.StatusBadRequest, rr.Code, rr.Body.String())
+	}
+
+	h.partialLocks.Range(func(id, _ any) bool {
+		t.Errorf("expected no partial locks to be kept, found one for %v", id)
+		return true
+	})
+}
+
+func TestParseTusMetadata(t *testing.T) {
+	got, err := parseTusMetadata("filename " + base64.StdEncoding.EncodeToString([]byte("a/b.txt")) + ",is_confidential")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got["filename"] != "a/b.txt" {
+		t.Fatalf("expected filename a/b.txt, got %q", got["filename"])
+	}
+
+	if _, ok := got["is_confidential"]; !ok {
+		t.Fatal("expected key without value to be present")
+	}
+
+	if _, err := parseTusMetadata("filename !!!"); err == nil {
+		t.Fatal("expected invalid base64 to be rejected")
+	}
+}
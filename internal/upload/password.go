@@ -0,0 +1,218 @@
+package upload
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	// PasswordHeader carries an upload's password for clients that do not
+	// use HTTP Basic authentication.
+	PasswordHeader    = "Beam-Password"
+	MaxPasswordLength = 256
+
+	unlockCookiePrefix = "beam_unlock_"
+	unlockCookieTTL    = time.Hour
+)
+
+// Argon2id parameters for new password hashes, following the OWASP
+// recommendation of 19 MiB of memory and two passes. Stored hashes record
+// their own parameters so these can be raised later.
+const (
+	argonTime    = 2
+	argonMemory  = 19 * 1024
+	argonThreads = 1
+	argonKeyLen  = 32
+	argonSaltLen = 16
+)
+
+type passwordPage struct {
+	Title string
+	Error string
+}
+
+// UnlockUpload handles the password prompt's form. A correct password sets
+// a cookie that unlocks the upload for unlockCookieTTL and redirects back to
+// the page that asked for it.
+func (h *Handler) UnlockUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// The prompt can come from a file, a directory or an archive, and the
+	// redirect below returns to whichever it was.
+	slug, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/u/"), "/")
+	if archiveSlug, _, ok := parseArchivePath(r.URL.Path); ok {
+		slug = archiveSlug
+	}
+
+	meta, ok := h.findUpload(w, r, slug)
+	if !ok {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 4<<10)
+
+	if meta.PasswordHash != "" && !checkPassword(meta.PasswordHash, r.PostFormValue("password")) {
+		w.Header().Set("Cache-Control", "no-store")
+		renderTemplateStatus(w, http.StatusUnauthorized, "password.html", passwordPage{Title: meta.Slug, Error: "Wrong password."})
+		return
+	}
+
+	h.setUnlockCookie(w, meta, time.Now())
+	http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+}
+
+// unlock checks that a request may read a password-protected upload. The
+// password can come from an unlock cookie, the Beam-Password header or HTTP
+// Basic authentication with any user name. Otherwise it writes a 401:
+// browsers get a prompt page, other clients a Basic challenge.
+func (h *Handler) unlock(w http.ResponseWriter, r *http.Request, meta UploadMetadata) bool {
+	if h.validUnlockCookie(r, meta, time.Now()) {
+		return true
+	}
+
+	password := r.Header.Get(PasswordHeader)
+	if password == "" {
+		_, password, _ = r.BasicAuth()
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	if password != "" {
+		if checkPassword(meta.PasswordHash, password) {
+			h.setUnlockCookie(w, meta, time.Now())
+			return true
+		}
+
+		w.Header().Set("WWW-Authenticate", `Basic realm="beam"`)
+		http.Error(w, "invalid password", http.StatusUnauthorized)
+		return false
+	}
+
+	if wantsHTML(r) {
+		renderTemplateStatus(w, http.StatusUnauthorized, "password.html", passwordPage{Title: meta.Slug})
+		return false
+	}
+
+	w.Header().Set("WWW-Authenticate", `Basic realm="beam"`)
+	http.Error(w, "this upload needs a password", http.StatusUnauthorized)
+	return false
+}
+
+// Unlock cookies are named per upload and hold their expiry and an HMAC
+// over the slug, the expiry and the password hash, so changing the password
+// would revoke them.
+func (h *Handler) setUnlockCookie(w http.ResponseWriter, meta UploadMetadata, now time.Time) {
+	expires := now.Add(unlockCookieTTL).Unix()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     unlockCookiePrefix + meta.Slug,
+		Value:    strconv.FormatInt(expires, 10) + "." + h.signUnlock(meta, expires),
+		Path:     "/",
+		MaxAge:   int(unlockCookieTTL / time.Second),
+		Secure:   strings.HasPrefix(h.BaseURL, "https://"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (h *Handler) validUnlockCookie(r *http.Request, meta UploadMetadata, now time.Time) bool {
+	cookie, err := r.Cookie(unlockCookiePrefix + meta.Slug)
+	if err != nil {
+		return false
+	}
+
+	value, mac, ok := strings.Cut(cookie.Value, ".")
+	if !ok {
+		return false
+	}
+
+	expires, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || now.Unix() >= expires {
+		return false
+	}
+
+	return hmac.Equal([]byte(mac), []byte(h.signUnlock(meta, expires)))
+}
+
+func (h *Handler) signUnlock(meta UploadMetadata, expires int64) string {
+	mac := hmac.New(sha256.New, h.unlockKey)
+	fmt.Fprintf(mac, "%s\n%d\n%s", meta.Slug, expires, meta.PasswordHash)
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// hashPassword returns an Argon2id hash of password in the PHC string
+// format, e.g. $argon2id$v=19$m=19456,t=2,p=1$<salt>$<key>.
+func hashPassword(password string) string {
+	salt := make([]byte, argonSaltLen)
+	rand.Read(salt)
+
+	key := argon2.IDKey([]byte(password), salt, argonTime, argonMemory, argonThreads, argonKeyLen)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, argonMemory, argonTime, argonThreads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key))
+}
+
+// checkPassword reports whether password matches a hash made by
+// hashPassword.
+func checkPassword(encoded, password string) bool {
+	params, err := parsePasswordHash(encoded)
+	if err != nil {
+		return false
+	}
+
+	key := argon2.IDKey([]byte(password), params.salt, params.time, params.memory, params.threads, uint32(len(params.key)))
+
+	return subtle.ConstantTimeCompare(key, params.key) == 1
+}
+
+type passwordHash struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+var errBadPasswordHash = errors.New("malformed password hash")
+
+func parsePasswordHash(encoded string) (passwordHash, error) {
+	var p passwordHash
+
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" || parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return p, errBadPasswordHash
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads); err != nil {
+		return p, errBadPasswordHash
+	}
+
+	var err error
+
+	if p.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return p, errBadPasswordHash
+	}
+
+	if p.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(p.key) == 0 {
+		return p, errBadPasswordHash
+	}
+
+	return p, nil
+}
@@ -0,0 +1,211 @@
+package upload
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHashPassword(t *testing.T) {
+	hash := hashPassword("correct horse")
+
+	if !strings.HasPrefix(hash, "$argon2id$v=19$") {
+		t.Fatalf("expected an encoded argon2id hash, got %q", hash)
+	}
+
+	if !checkPassword(hash, "correct horse") {
+		t.Fatal("expected the password to match its hash")
+	}
+
+	if checkPassword(hash, "battery staple") || checkPassword("", "") || checkPassword("$argon2id$v=19$m=1,t=1,p=1$$", "") {
+		t.Fatal("expected wrong passwords and malformed hashes not to match")
+	}
+}
+
+func TestServeRawRequiresPassword(t *testing.T) {
+	h := NewHandler("http://example.com", t.TempDir())
+
+	rr := createUpload(t, h, url.Values{"password": {"hunter2"}}, helloFile)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+
+	var resp UploadResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	target := strings.TrimPrefix(resp.Files[0].URL, h.BaseURL)
+	target = "/raw/" + strings.TrimPrefix(target, "/u/")
+
+	get := func(setup func(*http.Request)) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		setup(req)
+
+		rr := httptest.NewRecorder()
+		h.ServeRaw(rr, req)
+
+		return rr
+	}
+
+	rr = get(func(*http.Request) {})
+	if rr.Code != http.StatusUnauthorized || rr.Header().Get("WWW-Authenticate") == "" {
+		t.Fatalf("expected a Basic challenge, got %d %v", rr.Code, rr.Header())
+	}
+
+	rr = get(func(req *http.Request) { req.Header.Set(PasswordHeader, "wrong") })
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected %d for a wrong password, got %d", http.StatusUnauthorized, rr.Code)
+	}
+
+	rr = get(func(req *http.Request) { req.SetBasicAuth("", "hunter2") })
+	if rr.Code != http.StatusOK || rr.Body.String() != "hello" {
+		t.Fatalf("expected Basic auth to unlock the file, got %d %q", rr.Code, rr.Body.String())
+	}
+
+	rr = get(func(req *http.Request) { req.Header.Set(PasswordHeader, "hunter2") })
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected the password header to unlock the file, got %d", rr.Code)
+	}
+
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected an unlock cookie, got %v", cookies)
+	}
+
+	rr = get(func(req *http.Request) { req.AddCookie(cookies[0]) })
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected the cookie to unlock the file, got %d", rr.Code)
+	}
+
+	forged := *cookies[0]
+	forged.Value = "9999999999" + forged.Value[strings.Index(forged.Value, "."):]
+
+	rr = get(func(req *http.Request) { req.AddCookie(&forged) })
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected a cookie with a changed expiry to be rejected, got %d", rr.Code)
+	}
+}
+
+func TestUnlockCookieExpires(t *testing.T) {
+	h := NewHandler("http://example.com", t.TempDir())
+	meta := UploadMetadata{Slug: "abcdefgh", PasswordHash: hashPassword("hunter2")}
+
+	rr := httptest.NewRecorder()
+	h.setUnlockCookie(rr, meta, time.Now())
+
+	req := httptest.NewRequest(http.MethodGet, "/u/abcdefgh", nil)
+	req.AddCookie(rr.Result().Cookies()[0])
+
+	if !h.validUnlockCookie(req, meta, time.Now()) {
+		t.Fatal("expected a fresh cookie to be valid")
+	}
+
+	if h.validUnlockCookie(req, meta, time.Now().Add(unlockCookieTTL)) {
+		t.Fatal("expected the cookie to expire")
+	}
+
+	if NewHandler("http://example.com", t.TempDir()).validUnlockCookie(req, meta, time.Now()) {
+		t.Fatal("expected a cookie signed by another process to be rejected")
+	}
+}
+
+func TestPasswordPromptUnlocksUpload(t *testing.T) {
+	h := NewHandler("http://example.com", t.TempDir())
+
+	rr := createUpload(t, h, url.Values{"password": {"hunter2"}}, helloFile)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+
+	var resp UploadResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	target := strings.TrimPrefix(resp.URL, h.BaseURL)
+
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.Header.Set("Accept", "text/html")
+
+	rr = httptest.NewRecorder()
+	h.ServeUpload(rr, req)
+
+	if rr.Code != http.StatusUnauthorized || !strings.Contains(rr.Body.String(), `name="password"`) {
+		t.Fatalf("expected the password prompt, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	unlock := func(password string) *httptest.ResponseRecorder {
+		form := url.Values{"password": {password}}
+
+		req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		rr := httptest.NewRecorder()
+		h.UnlockUpload(rr, req)
+
+		return rr
+	}
+
+	rr = unlock("wrong")
+	if rr.Code != http.StatusUnauthorized || !strings.Contains(rr.Body.String(), "Wrong password") {
+		t.Fatalf("expected the prompt again for a wrong password, got %d", rr.Code)
+	}
+
+	rr = unlock("hunter2")
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != target {
+		t.Fatalf("expected a redirect back to %s, got %d %v", target, rr.Code, rr.Header())
+	}
+
+	req = httptest.NewRequest(http.MethodGet, target, nil)
+	req.Header.Set("Accept", "text/html")
+	req.AddCookie(rr.Result().Cookies()[0])
+
+	rr = httptest.NewRecorder()
+	h.ServeUpload(rr, req)
+
+	if rr.Code != http.StatusFound {
+		t.Fatalf("expected the unlocked upload to redirect to its file, got %d", rr.Code)
+	}
+}
+
+func TestPasswordPromptUnlocksArchive(t *testing.T) {
+	h := NewHandler("http://example.com", t.TempDir())
+
+	rr := createUpload(t, h, url.Values{"password": {"hunter2"}}, helloFile)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+
+	var resp UploadResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	target := strings.TrimPrefix(resp.URL, h.BaseURL) + ".zip"
+
+	form := url.Values{"password": {"hunter2"}}
+	req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	rr = httptest.NewRecorder()
+	h.UnlockUpload(rr, req)
+
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != target {
+		t.Fatalf("expected a redirect back to %s, got %d %v", target, rr.Code, rr.Header())
+	}
+
+	req = httptest.NewRequest(http.MethodGet, target, nil)
+	req.AddCookie(rr.Result().Cookies()[0])
+
+	rr = httptest.NewRecorder()
+	h.ServeUpload(rr, req)
+
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("expected the unlocked archive, got %d %v", rr.Code, rr.Header())
+	}
+}
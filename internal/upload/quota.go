@@ -0,0 +1,280 @@
+package upload
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/elliota43/beam/internal/storage"
+)
+
+// QuotaResponse reports an identity's storage use.
+type QuotaResponse struct {
+	Identity string `json:"identity,omitempty"`
+	Used     int64  `json:"used"`
+	// Limit and Remaining are omitted when there is no quota.
+	Limit     int64 `json:"limit,omitempty"`
+	Remaining int64 `json:"remaining,omitempty"`
+}
+
+// ServeQuota reports the requesting identity's storage use and quota.
+// Anonymous requests report the use shared by all anonymous uploads.
+func (h *Handler) ServeQuota(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	identity := identityFrom(r.Context())
+
+	used, err := h.usageOf(r.Context(), identity)
+	if err != nil {
+		http.Error(w, "failed to compute storage use", http.StatusInternalServerError)
+		return
+	}
+
+	resp := QuotaResponse{
+		Identity: identity,
+		Used:     used,
+		Limit:    h.Quota,
+	}
+
+	if h.Quota > 0 {
+		resp.Remaining = max(h.Quota-used, 0)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Storage use is the total size of each identity's files, as recorded in
+// FileMetadata.Size, so deduplicated content still counts against everyone
+// who uploads it. It is read from every upload's metadata the first time
+// it is needed and kept up to date from then on; without a quota nothing is
+// kept, and GET /api/quota adds it up afresh each time. Files count from the
+// moment they are stored, before their upload is committed, so concurrent
+// uploads cannot overrun a quota together. Resumable partials count their
+// full length from the moment they are created until they are claimed by
+// an upload, whose file then takes over the count, or removed.
+
+// heldPartial is a partial's length counted against its owner's quota.
+type heldPartial struct {
+	owner string
+	size  int64
+}
+
+// usageOf returns the storage used by identity.
+func (h *Handler) usageOf(ctx context.Context, identity string) (int64, error) {
+	if h.Quota <= 0 {
+		usage, _, err := h.computeUsage(ctx)
+		return usage[identity], err
+	}
+
+	h.usageMu.Lock()
+	defer h.usageMu.Unlock()
+
+	if err := h.loadUsage(ctx); err != nil {
+		return 0, err
+	}
+
+	return h.usage[identity], nil
+}
+
+// reserveQuota counts n more bytes against identity, failing with 507 if
+// that would take it over its quota.
+func (h *Handler) reserveQuota(ctx context.Context, identity string, n int64) error {
+	if h.Quota <= 0 {
+		return nil
+	}
+
+	h.usageMu.Lock()
+	defer h.usageMu.Unlock()
+
+	if err := h.loadUsage(ctx); err != nil {
+		return newHTTPError(http.StatusInternalServerError, "failed to compute storage use")
+	}
+
+	if h.usage[identity]+n > h.Quota {
+		return h.quotaExceeded()
+	}
+
+	h.usage[identity] += n
+	return nil
+}
+
+// reservePartial counts a new partial's length against identity, failing
+// with 507 if that would take it over its quota.
+func (h *Handler) reservePartial(ctx context.Context, id, identity string, n int64) error {
+	if h.Quota <= 0 {
+		return nil
+	}
+
+	h.usageMu.Lock()
+	defer h.usageMu.Unlock()
+
+	if err := h.loadUsage(ctx); err != nil {
+		return newHTTPError(http.StatusInternalServerError, "failed to compute storage use")
+	}
+
+	if h.usage[identity]+n > h.Quota {
+		return h.quotaExceeded()
+	}
+
+	h.usage[identity] += n
+	h.heldPartials[id] = heldPartial{owner: identity, size: n}
+	return nil
+}
+
+// reserveClaimed counts a file claimed from partial id against identity.
+// The partial's own count is handed over to the file; a partial that no
+// longer holds one, because an upload that claimed it before failed, is
+// reserved afresh.
+func (h *Handler) reserveClaimed(ctx context.Context, id, identity string, n int64) error {
+	if h.Quota <= 0 {
+		return nil
+	}
+
+	h.usageMu.Lock()
+
+	if err := h.loadUsage(ctx); err != nil {
+		h.usageMu.Unlock()
+		return newHTTPError(http.StatusInternalServerError, "failed to compute storage use")
+	}
+
+	if held, ok := h.heldPartials[id]; ok && held == (heldPartial{owner: identity, size: n}) {
+		delete(h.heldPartials, id)
+		h.usageMu.Unlock()
+		return nil
+	}
+
+	h.usageMu.Unlock()
+
+	return h.reserveQuota(ctx, identity, n)
+}
+
+// restorePartialQuota counts partial id against its owner again after an
+// upload that claimed it failed.
+func (h *Handler) restorePartialQuota(id string) {
+	if h.Quota <= 0 {
+		return
+	}
+
+	info, err := readPartialInfo(filepath.Join(h.PartialsDir, id))
+	if err != nil {
+		return
+	}
+
+	h.usageMu.Lock()
+	defer h.usageMu.Unlock()
+
+	if _, ok := h.heldPartials[id]; ok || h.usage == nil {
+		return
+	}
+
+	h.usage[info.Owner] += info.Length
+	h.heldPartials[id] = heldPartial{owner: info.Owner, size: info.Length}
+}
+
+// releasePartialQuota stops counting a partial removed without being
+// claimed.
+func (h *Handler) releasePartialQuota(id string) {
+	h.usageMu.Lock()
+	defer h.usageMu.Unlock()
+
+	if held, ok := h.heldPartials[id]; ok {
+		h.usage[held.owner] -= held.size
+		delete(h.heldPartials, id)
+	}
+}
+
+func (h *Handler) quotaExceeded() error {
+	return newHTTPError(http.StatusInsufficientStorage, "storage quota of %d bytes exceeded", h.Quota)
+}
+
+// releaseQuota stops counting files against identity.
+func (h *Handler) releaseQuota(identity string, files []FileMetadata) {
+	h.usageMu.Lock()
+	defer h.usageMu.Unlock()
+
+	// Until use has been loaded there is nothing to adjust; loading will
+	// not see the released files.
+	if h.usage == nil {
+		return
+	}
+
+	for _, f := range files {
+		h.usage[identity] -= f.Size
+	}
+}
+
+// loadUsage reads the use of every identity, if there is a quota to keep
+// it for. The caller must hold usageMu.
+func (h *Handler) loadUsage(ctx context.Context) error {
+	if h.usage != nil || h.Quota <= 0 {
+		return nil
+	}
+
+	usage, held, err := h.computeUsage(ctx)
+	if err != nil {
+		return err
+	}
+
+	h.usage = usage
+	h.heldPartials = held
+	return nil
+}
+
+// computeUsage totals every committed upload's files and every open
+// partial by owner.
+func (h *Handler) computeUsage(ctx context.Context) (map[string]int64, map[string]heldPartial, error) {
+	uploads, err := h.index().List(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	usage := make(map[string]int64)
+	held := make(map[string]heldPartial)
+
+	for _, meta := range uploads {
+		for _, f := range meta.Files {
+			usage[meta.Owner] += f.Size
+		}
+	}
+
+	entries, err := os.ReadDir(h.PartialsDir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, err
+	}
+
+	for _, e := range entries {
+		info, err := readPartialInfo(filepath.Join(h.PartialsDir, e.Name()))
+		if err != nil {
+			continue
+		}
+
+		usage[info.Owner] += info.Length
+		held[e.Name()] = heldPartial{owner: info.Owner, size: info.Length}
+	}
+
+	return usage, held, nil
+}
+
+// checkFreeSpace fails with 507 when the disk holding StorageDir has less
+// than MinFreeSpace bytes free. Disks that cannot be measured are assumed
+// to have room.
+func (h *Handler) checkFreeSpace() error {
+	if h.MinFreeSpace <= 0 {
+		return nil
+	}
+
+	free, err := storage.FreeSpace(h.StorageDir)
+	if err != nil || free >= h.MinFreeSpace {
+		return nil
+	}
+
+	return newHTTPError(http.StatusInsufficientStorage, "server is low on storage space")
+}
@@ -0,0 +1,193 @@
+package upload
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/elliota43/beam/internal/storage"
+)
+
+func TestCreateUploadEnforcesQuota(t *testing.T) {
+	h := NewHandler("http://example.com", t.TempDir())
+	h.Quota = 8
+
+	first := postUpload(t, h, map[string]string{"hello.txt": "hello"})
+
+	rr := createUpload(t, h, nil, helloFile)
+	if rr.Code != http.StatusInsufficientStorage {
+		t.Fatalf("expected %d, got %d: %s", http.StatusInsufficientStorage, rr.Code, rr.Body.String())
+	}
+
+	if n := refCount(t, h, hashOf("hello")); n != 1 {
+		t.Fatalf("expected the rejected file to release its reference, got %d", n)
+	}
+
+	if err := h.deleteUpload(context.Background(), first); err != nil {
+		t.Fatal(err)
+	}
+
+	rr = createUpload(t, h, nil, helloFile)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected deleting an upload to free its quota, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestQuotaIsPerIdentity(t *testing.T) {
+	dir := t.TempDir()
+
+	h := NewHandler("http://example.com", dir)
+	h.Quota = 8
+
+	if err := h.reserveQuota(context.Background(), "alice", 8); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.reserveQuota(context.Background(), "alice", 1); err == nil {
+		t.Fatal("expected alice to be over quota")
+	}
+
+	postUpload(t, h, map[string]string{"hello.txt": "hello"})
+
+	// A restarted server recovers use from the stored uploads.
+	h = NewHandler("http://example.com", dir)
+	h.Quota = 8
+	h.APIKeys = APIKeys{hashAPIKey("alice-key-0123456789"): "alice"}
+
+	for key, want := range map[string]QuotaResponse{
+		"":                     {Used: 5, Limit: 8, Remaining: 3},
+		"alice-key-0123456789": {Identity: "alice", Limit: 8, Remaining: 8},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/api/quota", nil)
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+
+		rr := httptest.NewRecorder()
+
+		if key == "" {
+			h.ServeQuota(rr, req)
+		} else {
+			h.RequireAPIKey(h.ServeQuota)(rr, req)
+		}
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		var got QuotaResponse
+		if err := json.NewDecoder(rr.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+
+		if got != want {
+			t.Fatalf("expected %+v, got %+v", want, got)
+		}
+	}
+}
+
+func TestServeQuotaWithoutQuotaKeepsNoUsage(t *testing.T) {
+	h := NewHandler("http://example.com", t.TempDir())
+
+	postUpload(t, h, map[string]string{"hello.txt": "hello"})
+	createPartial(t, h, "big.log", 10)
+
+	if h.usage != nil {
+		t.Fatalf("expected no use to be kept without a quota, got %v", h.usage)
+	}
+
+	rr := httptest.NewRecorder()
+	h.ServeQuota(rr, httptest.NewRequest(http.MethodGet, "/api/quota", nil))
+
+	var got QuotaResponse
+	if err := json.NewDecoder(rr.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+
+	if got != (QuotaResponse{Used: 15}) {
+		t.Fatalf("expected the upload and partial to be reported, got %+v", got)
+	}
+
+	if h.usage != nil {
+		t.Fatalf("expected reporting use not to keep it, got %v", h.usage)
+	}
+}
+
+func TestCreateUploadRefusesWhenDiskIsLow(t *testing.T) {
+	h := NewHandler("http://example.com", t.TempDir())
+	h.MinFreeSpace = 1 << 62
+
+	if _, err := storage.FreeSpace(h.StorageDir); err != nil {
+		t.Skip(err)
+	}
+
+	rr := createUpload(t, h, nil, helloFile)
+	if rr.Code != http.StatusInsufficientStorage {
+		t.Fatalf("expected %d, got %d", http.StatusInsufficientStorage, rr.Code)
+	}
+}
+
+func TestOpenPartialsCountTowardsQuota(t *testing.T) {
+	dir := t.TempDir()
+
+	h := NewHandler("http://example.com", dir)
+	h.Quota = 10
+
+	first := createPartial(t, h, "a.txt", 8)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/partials", nil)
+	req.Header.Set("Tus-Resumable", TusVersion)
+	req.Header.Set("Upload-Length", "8")
+	req.Header.Set("Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte("b.txt")))
+
+	rr := httptest.NewRecorder()
+	h.CreatePartial(rr, req)
+
+	if rr.Code != http.StatusInsufficientStorage {
+		t.Fatalf("expected %d while a partial holds the quota, got %d", http.StatusInsufficientStorage, rr.Code)
+	}
+
+	// A restarted server counts the partials left on disk.
+	h = NewHandler("http://example.com", dir)
+	h.Quota = 10
+
+	if used, err := h.usageOf(context.Background(), ""); err != nil || used != 8 {
+		t.Fatalf("expected the open partial to be counted after a restart, got %d, %v", used, err)
+	}
+
+	if rr := deletePartial(h, first); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected %d, got %d", http.StatusNoContent, rr.Code)
+	}
+
+	second := createPartial(t, h, "b.txt", 8)
+
+	if rr := patchPartial(h, second, 0, []byte("12345678")); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected %d, got %d", http.StatusNoContent, rr.Code)
+	}
+
+	// Claiming the partial hands its count to the file rather than adding
+	// to it.
+	rr = createUpload(t, h, url.Values{"partial": {second}}, helloFile)
+	if rr.Code != http.StatusInsufficientStorage {
+		t.Fatalf("expected the inline file to exceed the quota, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	if used, err := h.usageOf(context.Background(), ""); err != nil || used != 8 {
+		t.Fatalf("expected the partial to be counted again after the failed upload, got %d, %v", used, err)
+	}
+
+	// Retrying with the partial alone fits, counted once.
+	rr = createUpload(t, h, url.Values{"partial": {second}})
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+
+	if used, err := h.usageOf(context.Background(), ""); err != nil || used != 8 {
+		t.Fatalf("expected the claimed file to be counted once, got %d, %v", used, err)
+	}
+}
@@ -0,0 +1,123 @@
+package upload
+
+import (
+	"sort"
+	"strings"
+)
+
+type treeNode struct {
+	Name     string
+	Path     string
+	URL      string
+	IsDir    bool
+	Depth    int
+	Size     int64
+	Files    int
+	File     FileMetadata
+	Children []*treeNode
+}
+
+// findFile returns the manifest entry stored at the given relative path.
+func findFile(meta UploadMetadata, relativePath string) (FileMetadata, bool) {
+	for _, f := range meta.Files {
+		if f.Path() == relativePath {
+			return f, true
+		}
+	}
+
+	return FileMetadata{}, false
+}
+
+// buildTree arranges the files stored under dir into a directory tree, with
+// directories sorted before files at every level. dir is "" for the root of
+// the upload. The boolean is false when no file in the manifest lives under
+// dir.
+func buildTree(meta UploadMetadata, dir string) (*treeNode, bool) {
+	prefix := ""
+	if dir != "" {
+		prefix = dir + "/"
+	}
+
+	root := &treeNode{
+		Path:  dir,
+		URL:   fileURLPath(meta.Slug, dir),
+		IsDir: true,
+	}
+
+	for _, f := range meta.Files {
+		p := f.Path()
+		if !strings.HasPrefix(p, prefix) {
+			continue
+		}
+
+		node := root
+		segments := strings.Split(strings.TrimPrefix(p, prefix), "/")
+
+		for i, segment := range segments {
+			node.Size += f.Size
+			node.Files++
+
+			if i == len(segments)-1 {
+				node.Children = append(node.Children, &treeNode{
+					Name:  segment,
+					Path:  p,
+					URL:   fileURLPath(meta.Slug, p),
+					Depth: i,
+					Size:  f.Size,
+					Files: 1,
+					File:  f,
+				})
+				break
+			}
+
+			node = node.child(meta.Slug, segment, i)
+		}
+	}
+
+	if root.Files == 0 {
+		return nil, false
+	}
+
+	root.sort()
+
+	return root, true
+}
+
+func (n *treeNode) child(slug, name string, depth int) *treeNode {
+	for _, c := range n.Children {
+		if c.IsDir && c.Name == name {
+			return c
+		}
+	}
+
+	p := name
+	if n.Path != "" {
+		p = n.Path + "/" + name
+	}
+
+	c := &treeNode{
+		Name:  name,
+		Path:  p,
+		URL:   fileURLPath(slug, p),
+		IsDir: true,
+		Depth: depth,
+	}
+
+	n.Children = append(n.Children, c)
+	return c
+}
+
+func (n *treeNode) sort() {
+	sort.Slice(n.Children, func(i, j int) bool {
+		a, b := n.Children[i], n.Children[j]
+		if a.IsDir != b.IsDir {
+			return a.IsDir
+		}
+
+		return a.Name < b.Name
+	})
+
+	for _, c := range n.Children {
+		c.sort()
+	}
+}
@@ -0,0 +1,220 @@
+package upload
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/elliota43/beam/internal/storage"
+)
+
+//go:embed templates/*.html
+var templateFS embed.FS
+
+var templates = template.Must(template.New("").Funcs(template.FuncMap{
+	"formatSize": formatSize,
+	"formatTime": formatTime,
+	"inc":        func(i int) int { return i + 1 },
+	"shortHash":  shortHash,
+}).ParseFS(templateFS, "templates/*.html"))
+
+type breadcrumb struct {
+	Name string
+	URL  string
+}
+
+type uploadPage struct {
+	Title       string
+	Meta        UploadMetadata
+	Breadcrumbs []breadcrumb
+	Root        *treeNode
+}
+
+func (h *Handler) renderDirectory(w http.ResponseWriter, meta UploadMetadata, root *treeNode) {
+	page := uploadPage{
+		Title:       meta.Slug,
+		Meta:        meta,
+		Breadcrumbs: breadcrumbsFor(meta.Slug, root.Path),
+		Root:        root,
+	}
+
+	if root.Path != "" {
+		page.Title += "/" + root.Path
+	}
+
+	renderTemplate(w, "upload.html", page)
+}
+
+func renderTemplate(w http.ResponseWriter, name string, data any) {
+	renderTemplateStatus(w, http.StatusOK, name, data)
+}
+
+func renderTemplateStatus(w http.ResponseWriter, status int, name string, data any) {
+	var buf strings.Builder
+	if err := templates.ExecuteTemplate(&buf, name, data); err != nil {
+		http.Error(w, "failed to render page", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprint(w, buf.String())
+}
+
+// breadcrumbsFor links every directory on the way to relativePath. The last
+// crumb is the current page and has no link.
+func breadcrumbsFor(slug, relativePath string) []breadcrumb {
+	crumbs := []breadcrumb{{Name: slug, URL: fileURLPath(slug, "")}}
+
+	if relativePath != "" {
+		segments := strings.Split(relativePath, "/")
+		for i, segment := range segments {
+			crumbs = append(crumbs, breadcrumb{
+				Name: segment,
+				URL:  fileURLPath(slug, strings.Join(segments[:i+1], "/")),
+			})
+		}
+	}
+
+	crumbs[len(crumbs)-1].URL = ""
+	return crumbs
+}
+
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+func shortHash(hash string) string {
+	if len(hash) > 12 {
+		return hash[:12]
+	}
+
+	return hash
+}
+
+// maxViewSize caps how much of a file is highlighted inline. Larger files
+// are linked to /raw/ instead.
+const maxViewSize = 2 << 20
+
+type filePage struct {
+	Title       string
+	Breadcrumbs []breadcrumb
+	File        FileMetadata
+	RawURL      string
+	DownloadURL string
+	Language    string
+	Lines       [][]span
+	Image       bool
+	Binary      bool
+	TooLarge    bool
+}
+
+func (h *Handler) renderFile(w http.ResponseWriter, r *http.Request, meta UploadMetadata, f FileMetadata) {
+	page := filePage{
+		Title:       meta.Slug + "/" + f.Path(),
+		Breadcrumbs: breadcrumbsFor(meta.Slug, f.Path()),
+		File:        f,
+		RawURL:      rawURLPath(meta.Slug, f.Path()),
+		DownloadURL: rawURLPath(meta.Slug, f.Path()) + "?download=1",
+	}
+
+	switch {
+	case strings.HasPrefix(f.ContentType, "image/") && f.ContentType != "image/svg+xml":
+		page.Image = true
+	case f.Size > maxViewSize:
+		page.TooLarge = true
+	default:
+		content, err := storage.ReadAll(r.Context(), h.Store, f.storageKey(meta.Slug))
+		if err != nil {
+			http.Error(w, "failed to read stored file", http.StatusInternalServerError)
+			return
+		}
+
+		if isBinary(content) {
+			page.Binary = true
+			break
+		}
+
+		lang := detectLanguage(f.Path())
+		if lang != nil {
+			page.Language = lang.Name
+		}
+
+		page.Lines = highlight(string(content), lang)
+	}
+
+	renderTemplate(w, "file.html", page)
+}
+
+// wantsHTML reports whether the request came from a browser rather than a
+// tool like curl that expects the file bytes.
+func wantsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// isBinary applies the same heuristic as git: content with a NUL byte in
+// its first 8000 bytes, or that isn't UTF-8, isn't shown as text.
+func isBinary(content []byte) bool {
+	head := content
+	if len(head) > 8000 {
+		head = head[:8000]
+	}
+
+	return bytes.IndexByte(head, 0) >= 0 || !utf8.Valid(content)
+}
+
+type encryptedPage struct {
+	Title string
+	Meta  UploadMetadata
+	Files []encryptedFile
+}
+
+// encryptedFile is what the decrypting page knows about a file: its
+// encrypted path and where to fetch its ciphertext.
+type encryptedFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	URL    string `json:"url"`
+	RawURL string `json:"raw"`
+}
+
+// renderEncrypted serves the page that lists an encrypted upload and shows
+// its files, decrypting both in the browser. The page is the same for every
+// path in the upload; its script picks out the file being viewed.
+func (h *Handler) renderEncrypted(w http.ResponseWriter, meta UploadMetadata) {
+	page := encryptedPage{
+		Title: meta.Slug,
+		Meta:  meta,
+	}
+
+	for _, f := range meta.Files {
+		page.Files = append(page.Files, encryptedFile{
+			Name:   f.Path(),
+			Size:   f.Size,
+			URL:    fileURLPath(meta.Slug, f.Path()),
+			RawURL: rawURLPath(meta.Slug, f.Path()),
+		})
+	}
+
+	renderTemplate(w, "encrypted.html", page)
+}
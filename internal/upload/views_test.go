@@ -0,0 +1,245 @@
+package upload
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildTreeNestsDirectoriesBeforeFiles(t *testing.T) {
+	meta := UploadMetadata{
+		Slug: "abc123",
+		Files: []FileMetadata{
+			{RelativePath: "proj/main.go", Size: 1},
+			{RelativePath: "proj/cmd/main.go", Size: 2},
+			{RelativePath: "proj/cmd/tool/main.go", Size: 4},
+			{RelativePath: "other.txt", Size: 8},
+		},
+	}
+
+	root, ok := buildTree(meta, "")
+	if !ok {
+		t.Fatal("expected tree for upload root")
+	}
+
+	if root.Files != 4 || root.Size != 15 {
+		t.Fatalf("expected 4 files totalling 15 bytes, got %d files, %d bytes", root.Files, root.Size)
+	}
+
+	if len(root.Children) != 2 || root.Children[0].Name != "proj" || root.Children[1].Name != "other.txt" {
+		t.Fatalf("expected proj/ then other.txt at root, got %+v", root.Children)
+	}
+
+	proj := root.Children[0]
+	if proj.Files != 3 || proj.Size != 7 {
+		t.Fatalf("expected proj/ to hold 3 files totalling 7 bytes, got %d files, %d bytes", proj.Files, proj.Size)
+	}
+
+	if proj.Children[0].Path != "proj/cmd" || !proj.Children[0].IsDir {
+		t.Fatalf("expected proj/cmd directory first, got %+v", proj.Children[0])
+	}
+
+	cmd, ok := buildTree(meta, "proj/cmd")
+	if !ok {
+		t.Fatal("expected tree for proj/cmd")
+	}
+
+	if cmd.Files != 2 || cmd.URL != "/u/abc123/proj/cmd" {
+		t.Fatalf("unexpected proj/cmd tree: %+v", cmd)
+	}
+
+	if _, ok := buildTree(meta, "proj/cm"); ok {
+		t.Fatal("expected no tree for partial directory name")
+	}
+}
+
+func TestServeUploadRendersTreeView(t *testing.T) {
+	storageDir := t.TempDir()
+	h := NewHandler("http://example.com", storageDir)
+
+	writeTreeUpload(t, storageDir, map[string]string{
+		"proj/src/main.go":       "package src",
+		"proj/src/<script>.go":   "package src",
+		"proj/cmd/beam/main.go":  "package main",
+		"proj/docs/overview.txt": "docs",
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/u/abc123/proj/src", nil)
+	rr := httptest.NewRecorder()
+
+	h.ServeUpload(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, rr.Code)
+	}
+
+	body := rr.Body.String()
+
+	for _, want := range []string{
+		`<a href="/u/abc123/">abc123</a>`,
+		`<a href="/u/abc123/proj">proj</a>`,
+		`<strong>src</strong>`,
+		`/u/abc123/proj/src/main.go`,
+		`text/plain`,
+		`&lt;script&gt;.go`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("expected tree view to contain %s, got %s", want, body)
+		}
+	}
+
+	if strings.Contains(body, "overview.txt") {
+		t.Fatal("expected directory view to only include files under proj/src")
+	}
+}
+
+func TestBreadcrumbsFor(t *testing.T) {
+	crumbs := breadcrumbsFor("abc123", "proj/src")
+
+	want := []breadcrumb{
+		{Name: "abc123", URL: "/u/abc123/"},
+		{Name: "proj", URL: "/u/abc123/proj"},
+		{Name: "src"},
+	}
+
+	if len(crumbs) != len(want) {
+		t.Fatalf("expected %d breadcrumbs, got %d", len(want), len(crumbs))
+	}
+
+	for i := range want {
+		if crumbs[i] != want[i] {
+			t.Fatalf("expected breadcrumb %d to be %+v, got %+v", i, want[i], crumbs[i])
+		}
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	tests := map[int64]string{
+		0:         "0 B",
+		1023:      "1023 B",
+		1024:      "1.0 KiB",
+		1536:      "1.5 KiB",
+		100 << 20: "100.0 MiB",
+	}
+
+	for n, want := range tests {
+		if got := formatSize(n); got != want {
+			t.Fatalf("formatSize(%d): expected %q, got %q", n, want, got)
+		}
+	}
+
+	if got := formatTime(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)); got != "2024-01-02T03:04:05Z" {
+		t.Fatalf("unexpected formatted time %q", got)
+	}
+}
+
+func TestServeUploadRendersSourceViewForBrowsers(t *testing.T) {
+	storageDir := t.TempDir()
+	h := NewHandler("http://example.com", storageDir)
+
+	writeTreeUpload(t, storageDir, map[string]string{
+		"proj/main.go":  "package main\n\nfunc main() {}\n",
+		"proj/other.go": "package main\n",
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/u/abc123/proj/main.go", nil)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+	rr := httptest.NewRecorder()
+
+	h.ServeUpload(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, rr.Code)
+	}
+
+	if got := rr.Header().Get("Content-Disposition"); got != "" {
+		t.Fatalf("expected no Content-Disposition on HTML view, got %q", got)
+	}
+
+	body := rr.Body.String()
+
+	for _, want := range []string{
+		`<tr id="L1"><td class="ln"><a href="#L1">1</a></td><td class="code"><span class="kw">package</span> main</td></tr>`,
+		`<tr id="L3">`,
+		`href="/raw/abc123/proj/main.go"`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("expected source view to contain %s, got %s", want, body)
+		}
+	}
+
+	if strings.Contains(body, `id="L4"`) {
+		t.Fatal("expected trailing newline not to add a line")
+	}
+}
+
+func TestServeUploadRendersBinaryNotice(t *testing.T) {
+	storageDir := t.TempDir()
+	h := NewHandler("http://example.com", storageDir)
+
+	writeTreeUpload(t, storageDir, map[string]string{
+		"core.bin": "\x00\x01\x02",
+		"a.txt":    "a",
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/u/abc123/core.bin", nil)
+	req.Header.Set("Accept", "text/html")
+	rr := httptest.NewRecorder()
+
+	h.ServeUpload(rr, req)
+
+	if !strings.Contains(rr.Body.String(), "looks binary") {
+		t.Fatalf("expected binary notice, got %s", rr.Body.String())
+	}
+}
+
+func TestServeRawServesBytesInline(t *testing.T) {
+	storageDir := t.TempDir()
+	h := NewHandler("http://example.com", storageDir)
+
+	writeTreeUpload(t, storageDir, map[string]string{
+		"proj/main.go": "package main\n",
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/raw/abc123/proj/main.go", nil)
+	req.Header.Set("Accept", "text/html")
+	rr := httptest.NewRecorder()
+
+	h.ServeRaw(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, rr.Code)
+	}
+
+	if rr.Body.String() != "package main\n" {
+		t.Fatalf("expected raw bytes, got %q", rr.Body.String())
+	}
+
+	if got := rr.Header().Get("Content-Disposition"); !strings.HasPrefix(got, "inline") {
+		t.Fatalf("expected inline disposition, got %q", got)
+	}
+
+	if got := rr.Header().Get("Content-Security-Policy"); got != "sandbox" {
+		t.Fatalf("expected sandbox CSP, got %q", got)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/raw/abc123/proj/main.go?download=1", nil)
+	rr = httptest.NewRecorder()
+
+	h.ServeRaw(rr, req)
+
+	if got := rr.Header().Get("Content-Disposition"); !strings.HasPrefix(got, "attachment") {
+		t.Fatalf("expected attachment disposition, got %q", got)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/raw/abc123/proj", nil)
+	rr = httptest.NewRecorder()
+
+	h.ServeRaw(rr, req)
+
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("expected %d for directory, got %d", http.StatusNotFound, rr.Code)
+	}
+}